@@ -0,0 +1,84 @@
+package rbg2p
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AlignedChunk is a chunk of input graphemes, along with the phonemes it was mapped to
+type AlignedChunk struct {
+	Graphemes string
+	Phonemes  []string
+
+	// LineNumber is the line number of the rule that produced the mapping (0 if no rule was applied, i.e., the default phoneme was used, or if the transcription was taken from the lexicon)
+	LineNumber int
+}
+
+// SyllableBoundary is the position of a syllable boundary in an aligned transcription. The boundary is placed before the phoneme with index Phoneme in the chunk with index Chunk.
+type SyllableBoundary struct {
+	Chunk   int
+	Phoneme int
+}
+
+// AlignedTrans is a grapheme-phoneme aligned transcription variant
+type AlignedTrans struct {
+	Chunks             []AlignedChunk
+	SyllableBoundaries []SyllableBoundary
+
+	// Transcription is the output string, as returned by RuleSet.Apply. Please note that any filters are applied to the transcription string only, not to the aligned chunks.
+	Transcription string
+}
+
+// Graphemes returns the grapheme chunks as a slice of strings
+func (t AlignedTrans) Graphemes() []string {
+	res := []string{}
+	for _, c := range t.Chunks {
+		res = append(res, c.Graphemes)
+	}
+	return res
+}
+
+// String returns a string representation of the aligned transcription
+func (t AlignedTrans) String() string {
+	res := []string{}
+	for _, c := range t.Chunks {
+		res = append(res, fmt.Sprintf("%s:%s", c.Graphemes, strings.Join(c.Phonemes, " ")))
+	}
+	return strings.Join(res, " | ")
+}
+
+// newAlignedTrans creates an aligned transcription from an expanded transcription and its syllable boundaries. Empty phonemes are removed, and any syllable boundary is moved to the next non-empty phoneme.
+func newAlignedTrans(t sylledTrans, transcription string) AlignedTrans {
+	res := AlignedTrans{Transcription: transcription}
+	pendingBoundary := false
+	for gi, g2p := range t.trans.phonemes {
+		chunk := AlignedChunk{Graphemes: g2p.g, Phonemes: []string{}, LineNumber: g2p.lineNumber}
+		for pi, p := range g2p.p {
+			if t.isBoundary(boundary{g: gi, p: pi}) {
+				pendingBoundary = true
+			}
+			if len(p) > 0 {
+				if pendingBoundary {
+					res.SyllableBoundaries = append(res.SyllableBoundaries, SyllableBoundary{Chunk: gi, Phoneme: len(chunk.Phonemes)})
+					pendingBoundary = false
+				}
+				chunk.Phonemes = append(chunk.Phonemes, p)
+			}
+		}
+		res.Chunks = append(res.Chunks, chunk)
+	}
+	return res
+}
+
+// ApplyAligned applies the rules to an input string, and returns a slice of grapheme-phoneme aligned transcriptions (one for each variant, in the same order as for RuleSet.Apply). Errors are handled in the same way as for RuleSet.Apply.
+func (rs RuleSet) ApplyAligned(s string) ([]AlignedTrans, error) {
+	res, err := rs.apply(s, rs.newApplyOpts())
+	var aligned []AlignedTrans
+	for _, v := range res.variants {
+		aligned = append(aligned, newAlignedTrans(v.sylled, v.output))
+	}
+	if aligned == nil && err != nil {
+		return []AlignedTrans{}, err
+	}
+	return aligned, err
+}
@@ -0,0 +1,135 @@
+package rbg2p
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// BatchResult is the result of transcribing one input string in a batch
+type BatchResult struct {
+	Input   string
+	Transes []string
+	Err     error
+}
+
+type batchJob struct {
+	index int
+	input string
+}
+
+type batchOutput struct {
+	index  int
+	result BatchResult
+}
+
+func numWorkers(n int) int {
+	if n < 1 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// batchWorker transcribes the jobs it receives, and sends the results to the output function. Coverage counts are collected locally, and merged into the rule set's coverage counts when the job channel is closed. The rule application is stopped if the context is cancelled (the cancelled jobs are still sent to the output function, with the context error).
+func (rs RuleSet) batchWorker(ctx context.Context, jobs <-chan batchJob, output func(batchOutput), wg *sync.WaitGroup) {
+	defer wg.Done()
+	coverage := newLocalCoverage()
+	for job := range jobs {
+		opts := rs.newApplyOpts()
+		opts.coverage = coverage
+		opts.ctx = ctx
+		res, err := rs.apply(job.input, opts)
+		output(batchOutput{index: job.index, result: BatchResult{Input: job.input, Transes: res.transes(), Err: err}})
+	}
+	rs.mergeCoverage(coverage)
+}
+
+// ApplyBatch transcribes the input strings using nWorkers concurrent workers (if nWorkers < 1, the number of CPUs is used). The results are returned in the same order as the input.
+func (rs RuleSet) ApplyBatch(inputs []string, nWorkers int) []BatchResult {
+	res := make([]BatchResult, len(inputs))
+	jobs := make(chan batchJob)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < numWorkers(nWorkers); w++ {
+		wg.Add(1)
+		go rs.batchWorker(context.Background(), jobs, func(o batchOutput) { res[o.index] = o.result }, wg)
+	}
+	for i, s := range inputs {
+		jobs <- batchJob{index: i, input: s}
+	}
+	close(jobs)
+	wg.Wait()
+	return res
+}
+
+// ApplyStream reads input strings from the input channel, and transcribes them using nWorkers concurrent workers (if nWorkers < 1, the number of CPUs is used). The results are sent to the returned channel in the same order as the input. At most 2*nWorkers inputs are processed (or waiting to be sent) at a time, so a slow input holds up the reading of new inputs rather than the buffering of later results. The returned channel is closed when the input channel has been closed and all results have been sent, or when the context is cancelled. If the context is cancelled, the workers are stopped, and the remaining inputs (and results) are dropped, so the caller can stop reading the results by cancelling the context.
+func (rs RuleSet) ApplyStream(ctx context.Context, inputs <-chan string, nWorkers int) <-chan BatchResult {
+	res := make(chan BatchResult)
+	jobs := make(chan batchJob)
+	outputs := make(chan batchOutput)
+	n := numWorkers(nWorkers)
+	// slots limits the number of inputs in progress: a slot is taken for each input read, and released when its result has been sent
+	slots := make(chan struct{}, 2*n)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go rs.batchWorker(ctx, jobs, func(o batchOutput) {
+			select {
+			case outputs <- o:
+			case <-ctx.Done():
+			}
+		}, wg)
+	}
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(outputs)
+		}()
+		for i := 0; ; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var s string
+			var ok bool
+			select {
+			case s, ok = <-inputs:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- batchJob{index: i, input: s}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(res)
+		// re-order the results before sending them to the result channel
+		pending := make(map[int]BatchResult)
+		next := 0
+		for o := range outputs {
+			pending[o.index] = o.result
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				select {
+				case res <- r:
+				case <-ctx.Done():
+					return
+				}
+				<-slots
+				delete(pending, next)
+				next++
+			}
+		}
+	}()
+	return res
+}
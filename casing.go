@@ -0,0 +1,99 @@
+package rbg2p
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// caseInsensitivePrefix marks a rule input that matches the input string regardless of case, e.g. (?i)sch -> S
+const caseInsensitivePrefix = "(?i)"
+
+func parseLocale(value string) (string, error) {
+	tag, err := language.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid value for LOCALE: %s : %v", value, err)
+	}
+	locale := tag.String()
+	casersFor(locale)
+	return locale, nil
+}
+
+// localeCasers holds the lowercase and uppercase casers for a locale. A caser has state, so it can't be used by several goroutines at a time, and each caser is taken from a pool when used.
+type localeCasers struct {
+	lower sync.Pool
+	upper sync.Pool
+}
+
+// casers caches the casers for each locale used (locale -> *localeCasers), so that they are not created for each input string
+var casers sync.Map
+
+// casersFor returns the cached casers for the locale (the casers are created the first time a locale is used)
+func casersFor(locale string) *localeCasers {
+	if c, ok := casers.Load(locale); ok {
+		return c.(*localeCasers)
+	}
+	tag := language.Make(locale)
+	c := &localeCasers{
+		lower: sync.Pool{New: func() interface{} { return cases.Lower(tag) }},
+		upper: sync.Pool{New: func() interface{} { return cases.Upper(tag) }},
+	}
+	actual, _ := casers.LoadOrStore(locale, c)
+	return actual.(*localeCasers)
+}
+
+// convert applies a caser from the pool to the input string
+func convert(pool *sync.Pool, s string) string {
+	caser := pool.Get().(cases.Caser)
+	defer pool.Put(caser)
+	return caser.String(s)
+}
+
+// downcase lowercases the input string, using the case mapping rules of the rule set's locale (if any)
+func (rs RuleSet) downcase(s string) string {
+	if rs.Locale == "" {
+		return strings.ToLower(s)
+	}
+	return convert(&casersFor(rs.Locale).lower, s)
+}
+
+// upcase uppercases the input string, using the case mapping rules of the rule set's locale (if any)
+func (rs RuleSet) upcase(s string) string {
+	if rs.Locale == "" {
+		return strings.ToUpper(s)
+	}
+	return convert(&casersFor(rs.Locale).upper, s)
+}
+
+// caseVariants returns the input string along with its lowercase and uppercase forms (if different)
+func (rs RuleSet) caseVariants(s string) []string {
+	res := []string{s}
+	for _, v := range []string{rs.downcase(s), rs.upcase(s)} {
+		if !Contains(res, v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// inputMatches returns true if the rule input matches the start of the unprocessed input (or the end, for right-to-left rule application). Case-insensitive rule inputs are compared with the corresponding part of the input after lowercasing (using the rule set's locale).
+func (rs RuleSet) inputMatches(rule Rule, unprocessed []rune, ss string) bool {
+	if !rule.CaseInsensitive {
+		if rs.RightToLeft {
+			return strings.HasSuffix(ss, rule.Input)
+		}
+		return strings.HasPrefix(ss, rule.Input)
+	}
+	n := len([]rune(rule.Input))
+	if n > len(unprocessed) {
+		return false
+	}
+	part := unprocessed[:n]
+	if rs.RightToLeft {
+		part = unprocessed[len(unprocessed)-n:]
+	}
+	return rs.downcase(string(part)) == rs.downcase(rule.Input)
+}
@@ -29,8 +29,93 @@ type transResult struct {
 	result  bool
 }
 
+var phrase *bool
+
+// coverageCounts holds the number of rules and lexicon entries applied/not applied in a coverage check
+type coverageCounts struct {
+	rulesApplied    int
+	rulesNotApplied int
+	lexApplied      int
+	lexNotApplied   int
+
+	// overlay rules applied/not applied, for a rule set loaded from an overlay file (included in the rule counts)
+	overlayApplied    int
+	overlayNotApplied int
+}
+
+// printCoverage prints each rule (and lexicon entry) as applied or not applied according to the coverage counts, with the specified prefix (e.g. "TEST "). Phoneme rules, filters and prefilters are included in the rule counts. Each rule is printed at its position in the rule file it was read from (an included file, or the base or overlay file). For a rule set loaded from an overlay file, each rule is printed as a base or overlay rule.
+func printCoverage(ruleSet rbg2p.RuleSet, coverage rbg2p.Coverage, prefix string, quiet bool) coverageCounts {
+	res := coverageCounts{}
+	printRule := func(kind string, rs string, lineNumber int, n int) {
+		location := fmt.Sprintf("input line %v", lineNumber)
+		source := ruleSet.Source(lineNumber)
+		if source.File != "" {
+			location = source.String()
+		}
+		overlay := false
+		if ruleSet.Base != "" {
+			overlay = source.Overlay
+			if overlay {
+				kind = "OVERLAY " + kind
+			} else {
+				kind = "BASE " + kind
+			}
+		}
+		if n > 0 {
+			if !quiet {
+				l.Printf("%s%s APPLIED\t%s\tat %s\t%v", prefix, kind, rs, location, n)
+			}
+			res.rulesApplied++
+			if overlay {
+				res.overlayApplied++
+			}
+		} else {
+			if !quiet {
+				l.Printf("%s%s NOT APPLIED\t%s\tat %s", prefix, kind, rs, location)
+			}
+			res.rulesNotApplied++
+			if overlay {
+				res.overlayNotApplied++
+			}
+		}
+	}
+	for _, r := range ruleSet.Prefilters {
+		printRule("PREFILTER", r.String(), r.LineNumber, coverage.Prefilters[r.LineNumber])
+	}
+	for _, r := range ruleSet.Rules {
+		printRule("RULE", r.String(), r.LineNumber, coverage.Rules[r.LineNumber])
+	}
+	for _, r := range ruleSet.PhonemeRules {
+		printRule("RULE", r.String(), r.LineNumber, coverage.PhonemeRules[r.LineNumber])
+	}
+	for _, r := range ruleSet.Filters {
+		printRule("FILTER", r.String(), r.LineNumber, coverage.Filters[r.LineNumber])
+	}
+	for _, e := range ruleSet.LexiconEntries() {
+		es := e.String()
+		if n := coverage.Lexicon[e.Orth]; n > 0 {
+			if !quiet {
+				l.Printf("%sLEXICON ENTRY APPLIED\t%s\tat %s:%v\t%v", prefix, es, e.Source, e.LineNumber, n)
+			}
+			res.lexApplied++
+		} else {
+			if !quiet {
+				l.Printf("%sLEXICON ENTRY NOT APPLIED\t%s\tat %s:%v", prefix, es, e.Source, e.LineNumber)
+			}
+			res.lexNotApplied++
+		}
+	}
+	return res
+}
+
 func transcribe(ruleSet rbg2p.RuleSet, orth string) transResult {
-	transes, err := ruleSet.Apply(orth)
+	var transes []string
+	var err error
+	if *phrase {
+		transes, err = ruleSet.ApplyPhrase(orth)
+	} else {
+		transes, err = ruleSet.Apply(orth)
+	}
 	if err != nil {
 		l.Printf("Couldn't transcribe '%s' : %s", orth, err)
 		return transResult{orth: orth, transes: transes, result: false}
@@ -94,8 +179,11 @@ func main() {
 	var force = f.Bool("force", false, "print transcriptions even if errors are found (default: false)")
 	var column = f.Int("column", 0, "only convert specified column (default: first field)")
 	var coverageCheck = f.Bool("coverage", false, "run coverage check (rules applied/not applied) (default: false)")
+	var coverageSave = f.String("coverage:save", "", "save the coverage counts of the built-in tests and the input (and any merged coverage files) to the specified file, for use with -coverage:merge (default: none)")
+	var coverageMerge = f.String("coverage:merge", "", "comma separated list of coverage files (saved using -coverage:save) to merge into the coverage check; counts saved for rules that have since been changed are skipped (default: none)")
 	var quiet = f.Bool("quiet", false, "inhibit warnings (default: false)")
 	var test = f.Bool("test", false, "test g2p against input file; orth <tab> trans (default: false)")
+	phrase = f.Bool("phrase", false, "split input into words on whitespace, hyphens and punctuation, and transcribe each word (default: false)")
 	removeStress = f.Bool("test:removestress", false, "remove stress when comparing using the -test switch (default: false)")
 	var ssFile = f.String("symbolset", "", "use specified symbol set file for validating the symbols in the g2p rule set, one symbol per line (default: none; overrides the g2p rule file's symbolset, if any)")
 	var help = f.Bool("help", false, "print help and exit")
@@ -129,6 +217,15 @@ func main() {
 
 	rbg2p.Debug = *debug
 
+	var coverageMergeFiles []string
+	if *coverageMerge != "" {
+		coverageMergeFiles = strings.Split(*coverageMerge, ",")
+	}
+	if (*coverageSave != "" || len(coverageMergeFiles) > 0) && !*coverageCheck {
+		l.Printf("-coverage:save and -coverage:merge require -coverage")
+		os.Exit(1)
+	}
+
 	g2pFile := args[0]
 	ruleSet, err := rbg2p.LoadFile(g2pFile)
 	ruleSet.Debug = *debug
@@ -152,6 +249,7 @@ func main() {
 		ruleSet.PhonemeSet = phonemeSet
 	}
 
+	ruleSet.CollectCoverage = *coverageCheck
 	haltingError := false
 	result := ruleSet.Test()
 	for _, e := range result.Errors {
@@ -177,30 +275,21 @@ func main() {
 		l.Printf("ALL %d TESTS PASSED FOR %s\n", len(ruleSet.Tests), g2pFile)
 	}
 
-	var rulesApplied, rulesNotApplied int
+	var testCoverage rbg2p.Coverage
 	if *coverageCheck {
-		rulesApplied = 0
-		rulesNotApplied = 0
-		for _, r := range ruleSet.Rules {
-			rs := r.String()
-			ruleSet.RulesAppliedMutex.RLock()
-			if n, ok := ruleSet.RulesApplied[rs]; ok {
-				if !*quiet {
-					l.Printf("TEST RULE APPLIED\t%s\tat input line %v\t%v", rs, r.LineNumber, n)
-				}
-				rulesApplied++
-			} else {
-				if !*quiet {
-					l.Printf("TEST RULE NOT APPLIED\t%s\tat input line %v", rs, r.LineNumber)
-				}
-				rulesNotApplied++
-			}
+		testCoverage = ruleSet.Coverage()
+		counts := printCoverage(ruleSet, testCoverage, "TEST ", *quiet)
+		l.Printf("%-24s: % 7d", "TEST RULES APPLIED", counts.rulesApplied)
+		l.Printf("%-24s: % 7d", "TEST RULES NOT APPLIED", counts.rulesNotApplied)
+		if ruleSet.Base != "" {
+			l.Printf("%-24s: % 7d", "TEST OVERLAY APPLIED", counts.overlayApplied)
+			l.Printf("%-24s: % 7d", "TEST OVERLAY NOT APPLIED", counts.overlayNotApplied)
+		}
+		if len(ruleSet.Lexicon) > 0 {
+			l.Printf("%-24s: % 7d", "TEST LEXICON APPLIED", counts.lexApplied)
+			l.Printf("%-24s: % 7d", "TEST LEXICON NOT APPLIED", counts.lexNotApplied)
 		}
-		l.Printf("%-24s: % 7d", "TEST RULES APPLIED", rulesApplied)
-		l.Printf("%-24s: % 7d", "TEST RULES NOT APPLIED", rulesNotApplied)
-		rulesApplied = 0
-		rulesNotApplied = 0
-		ruleSet.RulesApplied = make(map[string]int)
+		ruleSet.ResetCoverage()
 	}
 
 	if haltingError && !*force {
@@ -352,32 +441,43 @@ func main() {
 			processString(line)
 		}
 	}
+	var counts coverageCounts
 	if *coverageCheck {
-		rulesApplied = 0
-		rulesNotApplied = 0
-		for _, r := range ruleSet.Rules {
-			rs := r.String()
-			if n, ok := ruleSet.RulesApplied[rs]; ok {
-				if !*quiet {
-					l.Printf("RULE APPLIED\t%s\tat input line %v\t%v", rs, r.LineNumber, n)
-				}
-				rulesApplied++
-			} else {
-				if !*quiet {
-					l.Printf("RULE NOT APPLIED\t%s\tat input line %v", rs, r.LineNumber)
-				}
-				rulesNotApplied++
+		coverage := ruleSet.Coverage()
+		for _, fName := range coverageMergeFiles {
+			c, err := rbg2p.LoadCoverageFile(fName)
+			if err != nil {
+				l.Printf("couldn't load coverage file : %v", err)
+				os.Exit(1)
+			}
+			coverage.Merge(c)
+		}
+		counts = printCoverage(ruleSet, coverage, "", *quiet)
+		if *coverageSave != "" {
+			total := testCoverage.Copy()
+			total.Merge(coverage)
+			if err := total.SaveFile(*coverageSave); err != nil {
+				l.Printf("couldn't save coverage file : %v", err)
+				os.Exit(1)
 			}
 		}
-		ruleSet.RulesApplied = make(map[string]int)
+		ruleSet.ResetCoverage()
 	}
 
 	l.Printf("%-21s: % 7d", "TOTAL INPUT", nTotal)
 	l.Printf("%-21s: % 7d", "ERRORS", nErrs)
 	l.Printf("%-21s: % 7d", "TRANSCRIBED", nTrans)
 	if *coverageCheck {
-		l.Printf("%-21s: % 7d", "RULES APPLIED", rulesApplied)
-		l.Printf("%-21s: % 7d", "RULES NOT APPLIED", rulesNotApplied)
+		l.Printf("%-21s: % 7d", "RULES APPLIED", counts.rulesApplied)
+		l.Printf("%-21s: % 7d", "RULES NOT APPLIED", counts.rulesNotApplied)
+		if ruleSet.Base != "" {
+			l.Printf("%-21s: % 7d", "OVERLAY APPLIED", counts.overlayApplied)
+			l.Printf("%-21s: % 7d", "OVERLAY NOT APPLIED", counts.overlayNotApplied)
+		}
+		if len(ruleSet.Lexicon) > 0 {
+			l.Printf("%-21s: % 7d", "LEXICON APPLIED", counts.lexApplied)
+			l.Printf("%-21s: % 7d", "LEXICON NOT APPLIED", counts.lexNotApplied)
+		}
 	}
 	if *test {
 		l.Printf("%-21s: % 7d", "TESTED", nTests)
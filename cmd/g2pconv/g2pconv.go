@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stts-se/rbg2p"
+)
+
+var l = log.New(os.Stderr, "", 0)
+
+func main() {
+	var f = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var help = f.Bool("help", false, "print help message")
+
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "g2pconv <FLAGS> <RULE FILE>\n")
+		fmt.Fprintf(os.Stderr, "\nConverts a g2p rule file (or syllabification rule file) to JSON, or a JSON rule file (with the extension .json) to the .g2p format. The converted file is printed to standard output.\n")
+		fmt.Fprintf(os.Stderr, "\nFLAGS:\n")
+		f.PrintDefaults()
+	}
+
+	var args = os.Args
+	if strings.HasSuffix(args[0], "g2pconv") {
+		args = args[1:] // remove first argument if it's the program name
+	}
+
+	err := f.Parse(args)
+	if err != nil {
+		os.Exit(1)
+	}
+	args = f.Args()
+
+	if *help {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if len(args) != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	inFile := args[0]
+	src, err := os.ReadFile(filepath.Clean(inFile))
+	if err != nil {
+		l.Printf("couldn't read file %s : %v", inFile, err)
+		os.Exit(1)
+	}
+	var res []byte
+	if strings.HasSuffix(strings.ToLower(inFile), ".json") {
+		res, err = rbg2p.JSONToG2P(inFile, src)
+	} else {
+		res, err = rbg2p.G2PToJSON(inFile, src)
+	}
+	if err != nil {
+		l.Printf("couldn't convert file %s : %v", inFile, err)
+		os.Exit(1)
+	}
+	fmt.Print(string(res))
+}
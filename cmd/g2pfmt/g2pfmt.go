@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stts-se/rbg2p"
+)
+
+var l = log.New(os.Stderr, "", 0)
+
+func main() {
+	var f = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var list = f.Bool("l", false, "list files whose formatting differs from the canonical format (instead of printing the formatted files)")
+	var write = f.Bool("w", false, "write the formatted output to the input file (instead of printing it)")
+	var check = f.Bool("check", false, "check mode: exit with an error code if any file is not formatted (the files are not modified)")
+	var help = f.Bool("help", false, "print help message")
+
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "g2pfmt <FLAGS> <G2P RULE FILES / SYLLABIFICATION RULE FILES>\n")
+		fmt.Fprintf(os.Stderr, "\nFormats the input files canonically. By default, the formatted files are printed to standard output.\n")
+		fmt.Fprintf(os.Stderr, "\nFLAGS:\n")
+		f.PrintDefaults()
+	}
+
+	var args = os.Args
+	if strings.HasSuffix(args[0], "g2pfmt") {
+		args = args[1:] // remove first argument if it's the program name
+	}
+
+	err := f.Parse(args)
+	if err != nil {
+		os.Exit(1)
+	}
+	args = f.Args()
+
+	if *help {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if *write && *check {
+		l.Printf("flags -w and -check cannot be combined")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, g2pFile := range args {
+		src, err := os.ReadFile(filepath.Clean(g2pFile))
+		if err != nil {
+			l.Printf("couldn't read file %s : %v", g2pFile, err)
+			failed = true
+			continue
+		}
+		formatted, err := rbg2p.Format(g2pFile, src)
+		if err != nil {
+			l.Printf("couldn't format file %s : %v", g2pFile, err)
+			failed = true
+			continue
+		}
+		changed := !bytes.Equal(src, formatted)
+		if changed && (*list || *check) {
+			fmt.Println(g2pFile)
+		}
+		if changed && *check {
+			failed = true
+		}
+		if changed && *write {
+			info, err := os.Stat(g2pFile)
+			if err != nil {
+				l.Printf("couldn't write file %s : %v", g2pFile, err)
+				failed = true
+				continue
+			}
+			if err := os.WriteFile(g2pFile, formatted, info.Mode().Perm()); err != nil {
+				l.Printf("couldn't write file %s : %v", g2pFile, err)
+				failed = true
+				continue
+			}
+		}
+		if !*list && !*check && !*write {
+			fmt.Print(string(formatted))
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
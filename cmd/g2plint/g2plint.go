@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/stts-se/rbg2p"
+)
+
+var l = log.New(os.Stderr, "", 0)
+
+func main() {
+	var f = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var minSeverity = f.String("severity", "info", "only report findings with at least the specified severity: info, warning or error")
+	var failOn = f.String("fail", "error", "exit with an error code if any finding has at least the specified severity: info, warning or error")
+	var help = f.Bool("help", false, "print help message")
+
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "g2plint <FLAGS> <G2P RULE FILES>\n")
+		fmt.Fprintf(os.Stderr, "\nFLAGS:\n")
+		f.PrintDefaults()
+	}
+
+	var args = os.Args
+	if strings.HasSuffix(args[0], "g2plint") {
+		args = args[1:] // remove first argument if it's the program name
+	}
+
+	err := f.Parse(args)
+	if err != nil {
+		os.Exit(1)
+	}
+	args = f.Args()
+
+	if *help {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	min, err := rbg2p.ParseSeverity(*minSeverity)
+	if err != nil {
+		l.Printf("%v", err)
+		os.Exit(1)
+	}
+	fail, err := rbg2p.ParseSeverity(*failOn)
+	if err != nil {
+		l.Printf("%v", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, g2pFile := range args {
+		ruleSet, err := rbg2p.LoadFile(g2pFile)
+		if err != nil {
+			l.Printf("couldn't load file %s : %v", g2pFile, err)
+			failed = true
+			continue
+		}
+		n := 0
+		for _, finding := range ruleSet.Lint() {
+			if finding.Severity < min {
+				continue
+			}
+			n++
+			// the finding may concern a line in an included file
+			source := ruleSet.Source(finding.LineNumber)
+			if source.File == "" {
+				source.File = g2pFile
+			}
+			fmt.Printf("%s: %s: %s [%s]\n", source, finding.Severity, finding.Message, finding.Check)
+			if finding.Severity >= fail {
+				failed = true
+			}
+		}
+		l.Printf("%d FINDING(S) FOR %s", n, g2pFile)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
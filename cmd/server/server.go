@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -119,7 +120,7 @@ func syllabify_Handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(res))
 }
 
-func transcribe(lang string, word string) (Word, int, error) {
+func transcribe(ctx context.Context, lang string, word string) (Word, int, error) {
 	g2pM.mutex.RLock()
 	defer g2pM.mutex.RUnlock()
 	ruleSet, ok := g2pM.g2ps[lang]
@@ -130,15 +131,90 @@ func transcribe(lang string, word string) (Word, int, error) {
 		return Word{}, http.StatusBadRequest, errors.New(msg)
 	}
 
-	transes, err := ruleSet.Apply(word)
+	transes, err := ruleSet.ApplyContext(ctx, word)
 	if err != nil {
-		msg := fmt.Sprintf("couldn't transcribe word : %v", err)
-		return Word{}, http.StatusInternalServerError, errors.New(msg)
+		// the transcriptions are returned along with unmappable symbol errors
+		return Word{word, transes}, errorStatus(err), fmt.Errorf("couldn't transcribe word : %w", err)
 	}
 	res := Word{word, transes}
 	return res, http.StatusOK, nil
 }
 
+// errorStatus returns the HTTP status code for an error returned by the rule set
+func errorStatus(err error) int {
+	var unmappableErr *rbg2p.UnmappableSymbolError
+	var timeoutErr *rbg2p.RegexpTimeoutError
+	if errors.As(err, &unmappableErr) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// UnmappableSymbol internal struct for json
+type UnmappableSymbol struct {
+	Offset int    `json:"offset"`
+	Symbol string `json:"symbol"`
+}
+
+// ErrorResponse internal struct for json error responses
+type ErrorResponse struct {
+	Error string `json:"error"`
+
+	// Type is the error type: unmappable_symbol, regexp_timeout, regexp or bad_request (empty for other errors)
+	Type string `json:"type,omitempty"`
+
+	// Symbols holds the unmappable input symbols, for unmappable_symbol errors
+	Symbols []UnmappableSymbol `json:"symbols,omitempty"`
+
+	// Transes holds the transcriptions (using the default phoneme for unmappable symbols), for unmappable_symbol errors
+	Transes []string `json:"transes,omitempty"`
+
+	// Rule and LineNumber identify the rule (or filter) in the rule file, for regexp and regexp_timeout errors
+	Rule       string `json:"rule,omitempty"`
+	LineNumber int    `json:"line_number,omitempty"`
+}
+
+func newErrorResponse(err error, status int, transes []string) ErrorResponse {
+	res := ErrorResponse{Error: err.Error()}
+	var unmappableErr *rbg2p.UnmappableSymbolError
+	var timeoutErr *rbg2p.RegexpTimeoutError
+	var regexpErr *rbg2p.RegexpError
+	if errors.As(err, &unmappableErr) {
+		res.Type = "unmappable_symbol"
+		for _, s := range unmappableErr.Symbols {
+			res.Symbols = append(res.Symbols, UnmappableSymbol{Offset: s.Offset, Symbol: s.Symbol})
+		}
+		res.Transes = transes
+	} else if errors.As(err, &timeoutErr) {
+		res.Type = "regexp_timeout"
+	} else if errors.As(err, &regexpErr) {
+		res.Type = "regexp"
+	} else if status == http.StatusBadRequest {
+		res.Type = "bad_request"
+	}
+	if errors.As(err, &regexpErr) {
+		res.Rule = regexpErr.Rule
+		res.LineNumber = regexpErr.LineNumber
+	}
+	return res
+}
+
+// jsonError writes an error response with a json body
+func jsonError(w http.ResponseWriter, err error, status int, transes []string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	j, jErr := json.Marshal(newErrorResponse(err, status, transes))
+	if jErr != nil {
+		log.Printf("failed json marshalling : %v", jErr)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", string(j))
+}
+
 func ruleContent(lang string) (string, int, error) {
 	g2pM.mutex.RLock()
 	defer g2pM.mutex.RUnlock()
@@ -160,12 +236,21 @@ func transcribe_Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	textFormat := format == "text" || format == "txt"
+	httpError := func(err error, status int, transes []string) {
+		if textFormat {
+			http.Error(w, fmt.Sprintf("%s", err), status)
+			return
+		}
+		jsonError(w, err, status, transes)
+	}
+
 	vars := mux.Vars(r)
 	lang := vars["lang"]
 	if lang == "" {
 		msg := "no value for the expected 'lang' parameter"
 		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		httpError(errors.New(msg), http.StatusBadRequest, nil)
 		return
 	}
 
@@ -173,19 +258,19 @@ func transcribe_Handler(w http.ResponseWriter, r *http.Request) {
 	if word == "" {
 		msg := "no value for the expected 'word' parameter"
 		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		httpError(errors.New(msg), http.StatusBadRequest, nil)
 		return
 	}
 	//word = strings.ToLower(word)
 
-	res, status, err := transcribe(lang, word)
+	res, status, err := transcribe(r.Context(), lang, word)
 	if err != nil {
 		log.Printf("%s\n", err)
-		http.Error(w, fmt.Sprintf("%s", err), status)
+		httpError(err, status, res.Transes)
 		return
 	}
 
-	if format == "text" || format == "txt" {
+	if textFormat {
 		res := strings.Join(res.Transes, "\n")
 		fmt.Fprintf(w, "%s\n", res)
 	} else {
@@ -232,7 +317,7 @@ func transcribe_AsXml_Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	//word = strings.ToLower(word)
-	res, status, err := transcribe(lang, word)
+	res, status, err := transcribe(r.Context(), lang, word)
 	if err != nil {
 		log.Printf("%s\n", err)
 		http.Error(w, fmt.Sprintf("%s", err), status)
@@ -357,6 +442,7 @@ func pluralS(n int) string {
 func main() {
 
 	var quiet = flag.Bool("quiet", false, "inhibit warnings (default: false)")
+	var matchTimeout = flag.Duration("matchtimeout", 0, "maximum time for a single regexp match, e.g. 500ms (default: 0, i.e., use the value in each g2p rule file, if any)")
 	var help = flag.Bool("help", false, "print help and exit")
 	flag.Parse()
 
@@ -391,6 +477,11 @@ func main() {
 					continue
 					//fmt.Fprintf(os.Stderr, "server: skipping file: '%s'\n", fn)
 				}
+				if *matchTimeout > 0 {
+					ruleSet.SetMatchTimeout(*matchTimeout)
+				}
+				// coverage counts are never read by the server
+				ruleSet.CollectCoverage = false
 				errors := 0
 				result := ruleSet.Test()
 				if len(result.Errors) > 0 {
@@ -0,0 +1,405 @@
+package rbg2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Coverage holds rule coverage counts, i.e., the number of times each rule has been applied. Rules, phoneme rules, filters and prefilters are keyed by their line number in the rule file, and lexicon entries by their orthography (lexicon entries may be loaded from separate lexicon files). A filter or prefilter is counted as applied when it changes its input.
+//
+// Since line numbers change when a rule file is edited (or formatted, or when an included file is changed), the definition of each rule, phoneme rule, filter and prefilter counted is saved along with the counts (see Definitions). Counts with a definition that doesn't match the rule at the same line are ignored by Merge and the *NotApplied methods, so that counts saved for an earlier version of a rule file are never credited to the wrong rule.
+type Coverage struct {
+	Rules        map[int]int    `json:"rules"`
+	PhonemeRules map[int]int    `json:"phoneme_rules"`
+	Filters      map[int]int    `json:"filters"`
+	Prefilters   map[int]int    `json:"prefilters"`
+	Lexicon      map[string]int `json:"lexicon"`
+
+	// Definitions holds the definitions (as returned by the String method) of the rules, phoneme rules, filters and prefilters counted, keyed by line number. Counts without a definition are not checked.
+	Definitions CoverageDefinitions `json:"definitions"`
+}
+
+// CoverageDefinitions holds the definitions of the rules, phoneme rules, filters and prefilters in a Coverage, keyed by line number
+type CoverageDefinitions struct {
+	Rules        map[int]string `json:"rules"`
+	PhonemeRules map[int]string `json:"phoneme_rules"`
+	Filters      map[int]string `json:"filters"`
+	Prefilters   map[int]string `json:"prefilters"`
+}
+
+// matchesDefinition returns true if the definition saved for the line number (if any) is the input definition
+func matchesDefinition(defs map[int]string, lineNumber int, def string) bool {
+	saved, ok := defs[lineNumber]
+	return !ok || saved == def
+}
+
+// mergeCounts adds counts2 (and the definitions defs2) to counts (and defs). Counts with a definition that doesn't match the definition for the same line in defs are skipped.
+func mergeCounts(counts map[int]int, defs map[int]string, counts2 map[int]int, defs2 map[int]string) {
+	for k, v := range counts2 {
+		if def, ok := defs2[k]; ok && !matchesDefinition(defs, k, def) {
+			continue
+		}
+		counts[k] += v
+	}
+	for k, def := range defs2 {
+		if _, ok := defs[k]; !ok {
+			defs[k] = def
+		}
+	}
+}
+
+// NewCoverage creates an empty Coverage
+func NewCoverage() Coverage {
+	return Coverage{
+		Rules:        make(map[int]int),
+		PhonemeRules: make(map[int]int),
+		Filters:      make(map[int]int),
+		Prefilters:   make(map[int]int),
+		Lexicon:      make(map[string]int),
+		Definitions: CoverageDefinitions{
+			Rules:        make(map[int]string),
+			PhonemeRules: make(map[int]string),
+			Filters:      make(map[int]string),
+			Prefilters:   make(map[int]string),
+		},
+	}
+}
+
+// coverageKind is the type of rule counted in a Coverage
+type coverageKind int
+
+const (
+	ruleCoverage coverageKind = iota
+	phonemeRuleCoverage
+	filterCoverage
+	prefilterCoverage
+	lexiconCoverage
+)
+
+// numPositionalKinds is the number of coverage kinds counted by position in the rule set (all but the lexicon entries)
+const numPositionalKinds = int(lexiconCoverage)
+
+// coverageKey identifies a rule, phoneme rule, filter, prefilter (by position in the rule set) or lexicon entry (by orthography) in the coverage counts
+type coverageKey struct {
+	kind     coverageKind
+	position int
+	orth     string
+}
+
+// Merge adds the counts of the input coverage to c, e.g., to combine the coverage of several runs. Counts of the input coverage with a definition that doesn't match the definition for the same line in c are skipped, so counts loaded from file should be merged into the current coverage of the rule set (and not the other way around), to skip counts saved for an earlier version of the rule file.
+func (c *Coverage) Merge(c2 Coverage) {
+	for _, counts := range []*map[int]int{&c.Rules, &c.PhonemeRules, &c.Filters, &c.Prefilters} {
+		if *counts == nil {
+			*counts = map[int]int{}
+		}
+	}
+	for _, defs := range []*map[int]string{&c.Definitions.Rules, &c.Definitions.PhonemeRules, &c.Definitions.Filters, &c.Definitions.Prefilters} {
+		if *defs == nil {
+			*defs = map[int]string{}
+		}
+	}
+	if c.Lexicon == nil {
+		c.Lexicon = map[string]int{}
+	}
+	mergeCounts(c.Rules, c.Definitions.Rules, c2.Rules, c2.Definitions.Rules)
+	mergeCounts(c.PhonemeRules, c.Definitions.PhonemeRules, c2.PhonemeRules, c2.Definitions.PhonemeRules)
+	mergeCounts(c.Filters, c.Definitions.Filters, c2.Filters, c2.Definitions.Filters)
+	mergeCounts(c.Prefilters, c.Definitions.Prefilters, c2.Prefilters, c2.Definitions.Prefilters)
+	for k, v := range c2.Lexicon {
+		c.Lexicon[k] += v
+	}
+}
+
+// Copy returns a copy of the coverage counts
+func (c Coverage) Copy() Coverage {
+	res := NewCoverage()
+	res.Merge(c)
+	return res
+}
+
+// RulesNotApplied returns the rules of the rule set that have never been applied, in rule order. Counts saved for another rule at the same line are ignored.
+func (c Coverage) RulesNotApplied(rs RuleSet) []Rule {
+	res := []Rule{}
+	for _, r := range rs.Rules {
+		if c.Rules[r.LineNumber] == 0 || !matchesDefinition(c.Definitions.Rules, r.LineNumber, r.String()) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// PhonemeRulesNotApplied returns the phoneme rules of the rule set that have never been applied, in rule order. Counts saved for another phoneme rule at the same line are ignored.
+func (c Coverage) PhonemeRulesNotApplied(rs RuleSet) []PhonemeRule {
+	res := []PhonemeRule{}
+	for _, r := range rs.PhonemeRules {
+		if c.PhonemeRules[r.LineNumber] == 0 || !matchesDefinition(c.Definitions.PhonemeRules, r.LineNumber, r.String()) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// FiltersNotApplied returns the filters of the rule set that have never changed their input. Counts saved for another filter at the same line are ignored.
+func (c Coverage) FiltersNotApplied(rs RuleSet) []Filter {
+	res := []Filter{}
+	for _, f := range rs.Filters {
+		if c.Filters[f.LineNumber] == 0 || !matchesDefinition(c.Definitions.Filters, f.LineNumber, f.String()) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// PrefiltersNotApplied returns the prefilters of the rule set that have never changed their input. Counts saved for another prefilter at the same line are ignored.
+func (c Coverage) PrefiltersNotApplied(rs RuleSet) []Prefilter {
+	res := []Prefilter{}
+	for _, pf := range rs.Prefilters {
+		if c.Prefilters[pf.LineNumber] == 0 || !matchesDefinition(c.Definitions.Prefilters, pf.LineNumber, pf.String()) {
+			res = append(res, pf)
+		}
+	}
+	return res
+}
+
+// LexiconEntriesNotApplied returns the lexicon entries of the rule set that have never been looked up, sorted by orthography
+func (c Coverage) LexiconEntriesNotApplied(rs RuleSet) []LexiconEntry {
+	res := []LexiconEntry{}
+	for _, e := range rs.LexiconEntries() {
+		if c.Lexicon[e.Orth] == 0 {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Write writes the coverage counts to the writer, in json format
+func (c Coverage) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// SaveFile saves the coverage counts to the specified file, in json format
+func (c Coverage) SaveFile(fName string) error {
+	fh, err := os.Create(filepath.Clean(fName))
+	if err != nil {
+		return err
+	}
+	err = c.Write(fh)
+	if cErr := fh.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// ReadCoverage reads coverage counts in json format (as written by Coverage.Write)
+func ReadCoverage(r io.Reader) (Coverage, error) {
+	var c Coverage
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return Coverage{}, fmt.Errorf("couldn't read coverage : %v", err)
+	}
+	res := NewCoverage()
+	res.Merge(c)
+	return res, nil
+}
+
+// LoadCoverageFile loads coverage counts from a file saved by Coverage.SaveFile
+func LoadCoverageFile(fName string) (Coverage, error) {
+	fh, err := os.Open(filepath.Clean(fName))
+	if err != nil {
+		return Coverage{}, err
+	}
+	/* #nosec G307 */
+	defer fh.Close()
+	return ReadCoverage(fh)
+}
+
+// lineAndDefinition returns the line number and the definition of the rule, phoneme rule, filter or prefilter at the specified position in the rule set (or -1 and an empty string if there is no such position)
+func (rs RuleSet) lineAndDefinition(kind coverageKind, position int) (int, string) {
+	switch kind {
+	case ruleCoverage:
+		if position < len(rs.Rules) {
+			return rs.Rules[position].LineNumber, rs.Rules[position].String()
+		}
+	case phonemeRuleCoverage:
+		if position < len(rs.PhonemeRules) {
+			return rs.PhonemeRules[position].LineNumber, rs.PhonemeRules[position].String()
+		}
+	case filterCoverage:
+		if position < len(rs.Filters) {
+			return rs.Filters[position].LineNumber, rs.Filters[position].String()
+		}
+	case prefilterCoverage:
+		if position < len(rs.Prefilters) {
+			return rs.Prefilters[position].LineNumber, rs.Prefilters[position].String()
+		}
+	}
+	return -1, ""
+}
+
+// addToCoverage adds the count for a coverage key to the (line number keyed) Coverage. The definition of the rule (phoneme rule, filter or prefilter) is added even if the count is zero, so that counts merged into the Coverage can be checked against all rules of the rule set.
+func (rs RuleSet) addToCoverage(c *Coverage, k coverageKey, n int) {
+	add := func(counts map[int]int, defs map[int]string) {
+		lineNo, def := rs.lineAndDefinition(k.kind, k.position)
+		if def != "" {
+			defs[lineNo] = def
+		}
+		if n > 0 {
+			counts[lineNo] += n
+		}
+	}
+	switch k.kind {
+	case ruleCoverage:
+		add(c.Rules, c.Definitions.Rules)
+	case phonemeRuleCoverage:
+		add(c.PhonemeRules, c.Definitions.PhonemeRules)
+	case filterCoverage:
+		add(c.Filters, c.Definitions.Filters)
+	case prefilterCoverage:
+		add(c.Prefilters, c.Definitions.Prefilters)
+	case lexiconCoverage:
+		if n > 0 {
+			c.Lexicon[k.orth] += n
+		}
+	}
+}
+
+// localCoverage holds coverage counts collected by a single goroutine (e.g. a batch worker), indexed by position in the rule set. The counts are merged into the rule set's counts when the goroutine is done.
+type localCoverage struct {
+	counts  [numPositionalKinds][]int
+	lexicon map[string]int
+}
+
+func newLocalCoverage() *localCoverage {
+	return &localCoverage{lexicon: make(map[string]int)}
+}
+
+func (c *localCoverage) add(k coverageKey) {
+	if k.kind == lexiconCoverage {
+		c.lexicon[k.orth]++
+		return
+	}
+	counts := c.counts[k.kind]
+	if k.position >= len(counts) {
+		counts = append(counts, make([]int, k.position+1-len(counts))...)
+		c.counts[k.kind] = counts
+	}
+	counts[k.position]++
+}
+
+// coverageCounter holds the coverage counts of a rule set. It is shared between copies of the rule set, and is safe for concurrent use without locking: rules, phoneme rules, filters and prefilters are counted using atomic counters indexed by their position in the rule set, and lexicon entries using atomic counters keyed by orthography. Rules added after the counter was created are counted in a (locked) overflow map.
+type coverageCounter struct {
+	counts  [numPositionalKinds][]atomic.Int64
+	lexicon sync.Map // orthography -> *atomic.Int64
+
+	mutex    sync.Mutex
+	overflow map[coverageKey]int
+}
+
+func newCoverageCounter(rs RuleSet) *coverageCounter {
+	res := &coverageCounter{overflow: make(map[coverageKey]int)}
+	res.counts[ruleCoverage] = make([]atomic.Int64, len(rs.Rules))
+	res.counts[phonemeRuleCoverage] = make([]atomic.Int64, len(rs.PhonemeRules))
+	res.counts[filterCoverage] = make([]atomic.Int64, len(rs.Filters))
+	res.counts[prefilterCoverage] = make([]atomic.Int64, len(rs.Prefilters))
+	return res
+}
+
+func (cc *coverageCounter) add(k coverageKey, n int) {
+	if k.kind == lexiconCoverage {
+		counter, ok := cc.lexicon.Load(k.orth)
+		if !ok {
+			counter, _ = cc.lexicon.LoadOrStore(k.orth, new(atomic.Int64))
+		}
+		counter.(*atomic.Int64).Add(int64(n))
+		return
+	}
+	if counts := cc.counts[k.kind]; k.position < len(counts) {
+		counts[k.position].Add(int64(n))
+		return
+	}
+	cc.mutex.Lock()
+	cc.overflow[k] += n
+	cc.mutex.Unlock()
+}
+
+// Coverage returns a snapshot of the coverage counts collected by Apply (and the other transcription methods) since the rule set was loaded, or since the last call to ResetCoverage. Counts are only collected if RuleSet.CollectCoverage is set.
+func (rs RuleSet) Coverage() Coverage {
+	res := NewCoverage()
+	if rs.coverage == nil {
+		return res
+	}
+	for kind, counts := range rs.coverage.counts {
+		for i := range counts {
+			rs.addToCoverage(&res, coverageKey{kind: coverageKind(kind), position: i}, int(counts[i].Load()))
+		}
+	}
+	rs.coverage.lexicon.Range(func(orth, counter any) bool {
+		rs.addToCoverage(&res, coverageKey{kind: lexiconCoverage, orth: orth.(string)}, int(counter.(*atomic.Int64).Load()))
+		return true
+	})
+	rs.coverage.mutex.Lock()
+	defer rs.coverage.mutex.Unlock()
+	for k, n := range rs.coverage.overflow {
+		rs.addToCoverage(&res, k, n)
+	}
+	return res
+}
+
+// ResetCoverage clears the coverage counts
+func (rs RuleSet) ResetCoverage() {
+	if rs.coverage == nil {
+		return
+	}
+	for _, counts := range rs.coverage.counts {
+		for i := range counts {
+			counts[i].Store(0)
+		}
+	}
+	rs.coverage.lexicon.Clear()
+	rs.coverage.mutex.Lock()
+	defer rs.coverage.mutex.Unlock()
+	rs.coverage.overflow = make(map[coverageKey]int)
+}
+
+// countApplied adds a rule (or lexicon entry) hit to the coverage counts: to the call specific counts, if set, or else to the rule set's counts. Nothing is counted if coverage collection is switched off.
+func (rs RuleSet) countApplied(k coverageKey, opts applyOpts) {
+	if !rs.CollectCoverage {
+		return
+	}
+	if k.kind == ruleCoverage && rs.RulesApplied != nil && rs.RulesAppliedMutex != nil {
+		rs.RulesAppliedMutex.Lock()
+		rs.RulesApplied[rs.Rules[k.position].String()]++
+		rs.RulesAppliedMutex.Unlock()
+	}
+	if opts.coverage != nil {
+		opts.coverage.add(k)
+		return
+	}
+	if rs.coverage == nil {
+		return
+	}
+	rs.coverage.add(k, 1)
+}
+
+// mergeCoverage adds the input coverage counts to the rule set's counts
+func (rs RuleSet) mergeCoverage(c *localCoverage) {
+	if rs.coverage == nil {
+		return
+	}
+	for kind, counts := range c.counts {
+		for i, n := range counts {
+			if n > 0 {
+				rs.coverage.add(coverageKey{kind: coverageKind(kind), position: i}, n)
+			}
+		}
+	}
+	for orth, n := range c.lexicon {
+		rs.coverage.add(coverageKey{kind: lexiconCoverage, orth: orth}, n)
+	}
+}
@@ -8,6 +8,7 @@ Each g2p rule set is defined in a .g2p file with the following content:
       - any variables for use in the context of the actual rules
     * sylldef - definitions for dividing transcriptions into syllables
     * rules - g2p rules
+    * phoneme rules - phoneme-level rewrite rules applied after the g2p rules
     * filters - transcription filters applied after the rules
     * tests - input/output tests
     * comments
@@ -20,13 +21,28 @@ Defines a set of constant variables, such as character set and phoneme delimiter
 Available variables (* means required):
      CHARACTER_SET*     (default: none)
       - used to check that each character in the character set has at least one rule
+      - the characters are extended grapheme clusters, i.e., a base character followed by combining marks is a single character
      PHONEME_SET        (default: none)
       - space separated symbol set, used to validate the phonemes in the g2p rules
      DEFAULT_PHONEME    (default: "_")
       - used for input input (orthographic) symbols
+      - an input character (grapheme cluster) not matched by any rule is mapped to a single default phoneme
      PHONEME_DELIMITER  (default: " ")
       - used to concatenate phonemes into a transcriptions
      DOWNCASE_INPUT     (default: true)
+      - if false, the case of the input is preserved, and rule inputs are case sensitive (see RULES, below)
+     LOCALE             (default: none)
+      - language tag used for case mapping when downcasing the input and matching case-insensitive rule inputs, e.g. "tr" for Turkish dotted and dotless i
+     DIRECTION          (default: "left-to-right")
+      - rule application direction, "left-to-right" or "right-to-left" (see RULES, below)
+     NORMALIZATION      (default: none)
+      - Unicode normalization form, "NFC", "NFD", "NFKC" or "NFKD", applied to the rule file (including prefilters and filters) when it is loaded, and to each input string
+     MATCH_TIMEOUT      (default: none)
+      - maximum time for a single regexp match in rule contexts, filters and prefilters, e.g. "500ms"
+     MAX_VARIANTS       (default: none)
+      - maximum number of transcription variants returned for an input string
+     WORD_BOUNDARY      (default: "#")
+      - used to join the words of a transcribed phrase (see RuleSet.ApplyPhrase)
 
 Examples:
      CHARACTER_SET "abcdefghijklmnopqrstuvwxyzåäö"
@@ -77,6 +93,10 @@ RULES
 
 Grapheme to phoneme rules written in a format loosely based on phonotactic rules. The rules are ordered, and typically the rule order is of great importance.
 
+The rules are applied left to right: at each position in the input string, the first matching rule is applied, and the input matched by the rule is consumed. If DIRECTION is set to "right-to-left", the rules are applied from the end of the input string instead, i.e., the first rule with an input ending at the current position is applied. The contexts have the same meaning in both directions.
+
+Since the first matching rule is applied, a rule placed below a more general rule may never be applied, e.g. "a -> ? a / # _" below "a -> a". Such shadowed rules are reported as warnings by the built-in tests (see RuleSet.ShadowedRules).
+
      <INPUT> -> <OUTPUT>
      <INPUT> -> <OUTPUT> / <CONTEXT>
      <INPUT> -> (<OUTPUT1>, <OUTPUT2>)
@@ -88,6 +108,12 @@ Context:
 
 <INPUT> is a string of one or more input characters. <OUTPUT> is a string representing the output (separated by the pre-defined phoneme delimiter, above). For empty output, i.e., when a character should not be pronounced, use the empty set symbol "∅" (U+2205).
 
+If DOWNCASE_INPUT is false, rule inputs only match input characters with the same case, so that uppercase graphemes (e.g., in acronyms) can have rules of their own. An input prefixed by (?i) is case-insensitive, and matches the input string in any case (using the case mapping of LOCALE, if set). A case-insensitive default rule covers the character in both cases in the CHARACTER_SET validation.
+     (?i)<INPUT> -> <OUTPUT>
+
+Variant outputs can be given weights (non-negative numbers within angle brackets), used to rank the transcription variants (see RuleSet.ApplyNBest). The score of a transcription is the product of the weights of the variant outputs used. Variants without a weight get weight 1.
+     <INPUT> -> (<OUTPUT1> <<WEIGHT1>>, <OUTPUT2> <<WEIGHT2>>)
+
 <CONTEXT> is the context in which the <INPUT> should occur for the rule to apply. Pre-defined variables (above) can be use in the context specs. # is used for anchoring (marks the start/end of the input string).
 
 Examples:
@@ -95,9 +121,19 @@ Examples:
      a -> a
      e -> e
      skt -> (s t, s k t) / _
+     ng -> (N <0.9>, n g <0.1>)
      ck -> k
      b -> p / _ VOICELESS
      h -> ∅ / # _
+     (?i)sch -> S
+
+A rule can also have a phonological context, prefixed by AFTER, which is matched against the phonemes produced so far (by the preceding rules) in the current transcription variant. The phonological context is a left context, or a right context if the rules are applied right to left. The phonological context is a space separated sequence of phonemes and phoneme variables, using the same syntax as the context of the phoneme rules (see PHONEME RULES, below). If a rule with variant outputs is followed by rules with phonological contexts, each variant is processed separately.
+     <INPUT> -> <OUTPUT> AFTER <PHONEME CONTEXT>
+     <INPUT> -> <OUTPUT> / <CONTEXT> AFTER <PHONEME CONTEXT>
+
+Examples:
+     d -> t AFTER VOICELESS
+     e -> @ / _ # AFTER LONGVOWEL CONS*
 
 
 PREFILTERS
@@ -111,6 +147,23 @@ Example:
 
 
 
+PHONEME RULES
+
+Rewrite rules operating on the phoneme sequence of a transcription, applied after the g2p rules and before the filters. The rules use the same syntax as the g2p rules, but the input, output and context are space separated sequences of phonemes, and phoneme variables (sets of phonemes) prefixed by PHONEME_VAR:
+     PHONEME_VAR <NAME> "<PHONEMES>"
+     PHONEME_RULE <INPUT> -> <OUTPUT> / <LEFT CONTEXT> _ <RIGHT CONTEXT>
+
+Rules prefixed by PHONEME_RULE are applied before syllabification, and rules prefixed by SYLL_PHONEME_RULE are applied after syllabification (and can use the syllable delimiter and stress symbols as input or context). The rules are applied left to right over the phoneme sequence, and the first matching rule is applied at each position. Contexts are matched against the phoneme sequence before the rules were applied. Phoneme variables in the context can be followed by a quantifier (*, + or ?), and # marks the word boundary. An empty input or output (insertion or deletion) is written using the empty set symbol "∅". Variant outputs are not allowed.
+
+Examples:
+     PHONEME_VAR VOWEL "a e i o u"
+     PHONEME_VAR CONS "p t k b d g m n s"
+     PHONEME_VAR LABIAL "p b m"
+     PHONEME_RULE n -> m / _ LABIAL
+     PHONEME_RULE e -> ∅ / VOWEL _ #
+     SYLL_PHONEME_RULE ∅ -> " / # CONS* _ VOWEL // place stress before the first vowel
+
+
 FILTERS
 
 Regexp replacement filters for transcriptions. The filters are applied after the g2p rules.  Pre-defined variables (above) can be use in the input regexp surrounded by curly brackets.
@@ -126,6 +179,44 @@ COMMENTS
 Comments are prefixed by // or #
 
 
+INCLUDED FILES
+
+Definitions shared by several rule files (e.g. VAR blocks, PHONEME_SET or SYLLDEF ONSETS) can be put in a separate file, and included using the INCLUDE directive:
+     INCLUDE "<PATH>"
+
+The path is relative to the including file (or an absolute path or URL). For rule files loaded from an fs.FS (see LoadFS), the included file is read from the same fs.FS. The INCLUDE directive is replaced by the lines of the included file, which may include other files (include cycles are reported as errors). Since the rules are applied in the order they are defined, the position of the INCLUDE directive matters for included rules. Errors in included files are reported with the name of the included file and the line number in that file (see also RuleSet.Source).
+
+A VAR (or PHONEME_VAR) defined in an included file doesn't have to be used by the including file, since it may be used by other files including the same file.
+
+Example:
+     INCLUDE "swedish_vars.inc"
+
+
+OVERLAY FILES
+
+A regional variant (dialect) of a rule set can be defined in an overlay file, which refers to a base rule set using the BASE directive, and lists the differences from the base rule set:
+     BASE "<PATH>"
+     INSERT BEFORE <REF> <RULE>
+     INSERT AFTER <REF> <RULE>
+     REPLACE <REF> <RULE>
+     DELETE <REF>
+
+The base path is relative to the overlay file (or an absolute path or URL). The base rule set may be an overlay file too. A rule reference (REF) is either a line number in the base file, or a rule label. Line numbers are not checked against the rule they were meant to refer to: if rules are added to or removed from the base file, or if it is reformatted (e.g. by g2pfmt, which moves definitions between sections), a line number reference will silently refer to another rule (or fail). Rules read from a file included by the base file (or from the base of the base rule set) can only be referred to by label. Labels are therefore recommended for base rule sets that may change. A rule is labelled using the LABEL directive on the line before the rule (labels can't start with a digit):
+     LABEL <NAME>
+     <RULE>
+
+In an overlay file, a LABEL directive before an INSERT definition labels the inserted rule. Apart from these definitions, an overlay file may contain VAR, PHONEME_VAR, FILTER, PREFILTER and TEST definitions (and INCLUDE directives). The FILTER (and PREFILTER) definitions of the overlay replace the base filters (and prefilters), if any are defined. A TEST in the overlay replaces the base tests for the same input. Rules inserted before a labelled rule are inserted before its label.
+
+The rule set derived from an overlay file (see RuleSet.Base) contains the base definitions, with the changes of the overlay. Line numbers in the derived rule set refer to the derived content, and RuleSet.Source returns the position of each line in the base or overlay file, along with its origin (SourceLine.Overlay). Failed tests and shadowed rules are reported with their origin by RuleSet.Test, and the coverage check of the g2p command prints base and overlay rules separately.
+
+Example:
+     BASE "swedish.g2p"
+     DELETE final_e
+     INSERT BEFORE 112 rt -> rt
+     FILTER "k k" -> "k:"
+     TEST bort -> b o rt
+
+
 TESTS
 
 Test examples prefixed by TEST:
@@ -134,9 +225,31 @@ Test examples prefixed by TEST:
 or with variants:
      TEST <INPUT> -> (<OUTPUT1>, <OUTPUT2>)
 
+or with a multi-word input (quotes required), transcribed word by word, and joined by the word boundary symbol:
+     TEST "<INPUT WORD1> <INPUT WORD2>" -> <OUTPUT1> <WORD BOUNDARY> <OUTPUT2>
+
 Examples:
      TEST hit -> h i t
      TEST kex -> (k e k s, C e k s)
+     TEST "hit kex" -> h i t # k e k s
+
+
+EXCEPTION LEXICON
+
+Irregular words can be listed in an exception lexicon, prefixed by LEXICON. The lexicon is looked up before the rules are applied, and if the input word is found, the lexicon transcriptions are returned as is (no rules, syllabification or filters are applied):
+     LEXICON <INPUT> -> <OUTPUT>
+
+or with variants:
+     LEXICON <INPUT> -> (<OUTPUT1>, <OUTPUT2>)
+
+Examples:
+     LEXICON och -> O
+     LEXICON de -> (d e:, d O m)
+
+Lexicon entries can also be read from an external lexicon file, using the LEXICON_FILE directive (relative paths are resolved relative to the g2p file). The lexicon file is tab separated, one entry per line: orthography <tab> transcription. Additional tab separated columns are treated as transcription variants.
+     LEXICON_FILE "exceptions.lex"
+
+The lexicon transcriptions are validated against the phoneme set (if defined) by the built-in tests, and lexicon entries are included in the coverage counts.
 
 
 ---
@@ -160,6 +273,22 @@ Example (for the CMU lexicon):
    SYLLDEF TEST W 1 UH D S T R 2 IY M -> W 1 UH D $ S T R 2 IY M
 
 
+JSON RULE FILES
+
+A rule file (or syllabification rule file) can also be written in JSON, using the schema in rbg2p.schema.json (see RuleSetJSON). The loaders (LoadFile, LoadURL, LoadSyllFile and LoadSyllURL) read files with the extension .json as JSON rule files. Use G2PToJSON and JSONToG2P (or cmd/g2pconv) to convert between the formats; comments are not kept in the JSON representation.
+
+   {
+     "character_set": "ab",
+     "phoneme_set": ["a", "b"],
+     "rules": [
+       {"input": "a", "output": ["a"]},
+       {"input": "b", "output": ["b", ""], "right_context": "#"},
+       {"input": "b", "output": ["b"]}
+     ],
+     "tests": [{"input": "ab", "output": ["a b", "a"]}]
+   }
+
+
 For details on the .g2p file format, check docs for the root folder of this package.
 
 
@@ -192,6 +321,20 @@ To import and use the rbg2p rule package in another go program:
 
             // Transcribe an input word
             transes, err := ruleSet.Apply(orth)
+
+            // Transcribe an input word, with grapheme-phoneme alignment
+            aligned, err := ruleSet.ApplyAligned(orth)
+            // aligned is a slice of rbg2p.AlignedTrans, one for each variant
+
+            // Trace the rule application for an input word (rules tried, filters applied, etc)
+            trace, err := ruleSet.Explain(orth)
+
+            // Transcribe a list of words concurrently (results are returned in input order)
+            results := ruleSet.ApplyBatch(words, runtime.NumCPU())
+
+            // Compile the rule set into an immutable transcriber, safe to share between goroutines
+            transcriber, err := ruleSet.Compile()
+            transes, err = transcriber.WithPhonemeDelimiter("-").Apply(orth)
     }
 
 
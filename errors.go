@@ -0,0 +1,130 @@
+package rbg2p
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dlclark/regexp2"
+)
+
+// RegexpTimeoutError is returned when a regular expression (in a rule context, filter or prefilter) could not be matched within the match timeout (see RuleSet.SetMatchTimeout)
+type RegexpTimeoutError struct {
+	Regexp  string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *RegexpTimeoutError) Error() string {
+	return fmt.Sprintf("regexp /%s/ timed out after %v", e.Regexp, e.Timeout)
+}
+
+// Unwrap returns the underlying regexp error
+func (e *RegexpTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// isMatchTimeout checks if an error returned by regexp2 is a match timeout. The regexp2 package doesn't export any error type for timeouts, so we have to check the error message.
+func isMatchTimeout(err error) bool {
+	return strings.HasPrefix(err.Error(), "match timeout")
+}
+
+// RegexpError is returned when a regular expression in a rule context, filter or prefilter couldn't be matched. If the match timed out, the underlying error is a RegexpTimeoutError.
+type RegexpError struct {
+	Regexp string
+
+	// Rule is the rule, filter or prefilter using the regexp
+	Rule string
+
+	// LineNumber is the line number of the rule, filter or prefilter in the rule set content (0 if unknown)
+	LineNumber int
+
+	// Source is the position of the rule, filter or prefilter in the rule file it was read from (see RuleSet.Source)
+	Source SourceLine
+
+	Err error
+}
+
+func (e *RegexpError) Error() string {
+	msg := fmt.Sprintf("couldn't execute regexp /%s/ : %v", e.Regexp, e.Err)
+	var timeoutErr *RegexpTimeoutError
+	if errors.As(e.Err, &timeoutErr) {
+		msg = e.Err.Error()
+	}
+	if e.Source.File != "" {
+		return fmt.Sprintf("%s (%s, %s)", msg, e.Rule, e.Source)
+	}
+	if e.LineNumber > 0 {
+		return fmt.Sprintf("%s (%s, line %d)", msg, e.Rule, e.LineNumber)
+	}
+	return fmt.Sprintf("%s (%s)", msg, e.Rule)
+}
+
+// Unwrap returns the underlying regexp error
+func (e *RegexpError) Unwrap() error {
+	return e.Err
+}
+
+// regexpError creates an error for a failed regexp match in the specified rule (or filter), wrapping a RegexpTimeoutError if the match timed out
+func (rs RuleSet) regexpError(re *regexp2.Regexp, err error, rule string, lineNumber int) error {
+	if isMatchTimeout(err) {
+		err = &RegexpTimeoutError{Regexp: re.String(), Timeout: re.MatchTimeout, Err: err}
+	}
+	res := &RegexpError{Regexp: re.String(), Rule: rule, LineNumber: lineNumber, Err: err}
+	if lineNumber > 0 {
+		res.Source = rs.Source(lineNumber)
+	}
+	return res
+}
+
+// UnmappableSymbol is an input symbol (grapheme cluster) that couldn't be mapped by any rule
+type UnmappableSymbol struct {
+	// Offset is the rune offset of the symbol in the input string, after normalization, downcasing and prefilters
+	Offset int
+	Symbol string
+}
+
+// UnmappableSymbolError is returned by Apply (along with the transcriptions, using the default phoneme for the unmappable symbols) if one or more input symbols couldn't be mapped by any rule
+type UnmappableSymbolError struct {
+	Input   string
+	Symbols []UnmappableSymbol
+}
+
+func (e *UnmappableSymbolError) Error() string {
+	symbols := []string{}
+	for _, s := range e.Symbols {
+		symbols = append(symbols, s.Symbol)
+	}
+	return fmt.Sprintf("found unmappable symbol(s) in input string: %v in %s", symbols, e.Input)
+}
+
+// ParseError is returned by the loaders for invalid rule files. Line and Column are 1-based (0 if the error doesn't concern a specific line or column).
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 && e.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+	} else if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError creates a ParseError for line n (1-based) of the input file, pointing at the first non-blank character of the line
+func parseError(file string, n int, line string, err error) error {
+	column := utf8.RuneCountInString(line) - utf8.RuneCountInString(strings.TrimLeftFunc(line, unicode.IsSpace)) + 1
+	return &ParseError{File: file, Line: n, Column: column, Err: err}
+}
@@ -0,0 +1,113 @@
+package rbg2p
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuleAttempt is a trace of a rule tested at a certain input position. The input, left context, right context and phonological context are tested in that order, and testing stops at the first mismatch: a context that was never tested is reported as not matching.
+type RuleAttempt struct {
+	Rule       Rule
+	InputMatch bool
+	LeftMatch  bool
+	RightMatch bool
+
+	// PhonemeMatch is true if the phonological left context matched the phonemes produced so far (always true for rules without a phonological context, if tested)
+	PhonemeMatch bool
+}
+
+// Matched returns true if the rule was applied
+func (a RuleAttempt) Matched() bool {
+	return a.InputMatch && a.LeftMatch && a.RightMatch && a.PhonemeMatch
+}
+
+// PositionTrace is a trace of the rules tested at a certain input position. If the rule set has rules with phonological contexts, each variant is traced separately, so that the same input position may occur more than once.
+type PositionTrace struct {
+	// Index is the (rune) index in the prefiltered input string
+	Index int
+
+	// Left is the input string to the left of Index
+	Left string
+
+	// Remaining is the input string from Index until the end of the string
+	Remaining string
+
+	// Attempts contains every rule tested, in the order they were tested. If the rule set is indexed (see RuleSet.IndexRules), only rules with matching input are tested.
+	Attempts []RuleAttempt
+
+	// Applied is the rule that was applied, or nil if no rule was applied (i.e., the default phoneme was used)
+	Applied *Rule
+}
+
+// FilterStep is a trace of a filter or prefilter being applied to a string
+type FilterStep struct {
+	Filter string
+	Before string
+	After  string
+}
+
+// Changed returns true if the filter modified its input
+func (fs FilterStep) Changed() bool {
+	return fs.Before != fs.After
+}
+
+// VariantTrace is a trace of the filters applied to one transcription variant
+type VariantTrace struct {
+	// PhonemeRules holds the phoneme rules applied to the variant (before filtering), with the rewritten phonemes
+	PhonemeRules []FilterStep
+
+	Unfiltered string
+	Filters    []FilterStep
+	Output     string
+}
+
+// Trace is a trace of the rule application for an input string, as returned by RuleSet.Explain
+type Trace struct {
+	Input       string
+	Prefilters  []FilterStep
+	Prefiltered string
+	Positions   []PositionTrace
+	Variants    []VariantTrace
+	Result      []string
+
+	// RightToLeft is true if the rules were applied right to left (see RuleSet.RightToLeft), i.e., the positions are in reverse input order
+	RightToLeft bool
+
+	// Lexicon is the exception lexicon entry used for the input, if any (if set, no rules were applied)
+	Lexicon *LexiconEntry
+
+	// Truncated is true if the variant expansion was stopped at the maximum number of variants
+	Truncated bool
+}
+
+// String returns a string representation of the Trace, one step per line
+func (t Trace) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\t%s\n", "INPUT", t.Input)
+	if t.RightToLeft {
+		fmt.Fprintf(&sb, "%s\t%s\n", "DIRECTION", "right-to-left")
+	}
+	if t.Lexicon != nil {
+		fmt.Fprintf(&sb, "%s\t%v\n", "LEXICON", *t.Lexicon)
+	}
+	for _, pf := range t.Prefilters {
+		fmt.Fprintf(&sb, "%s\t%s\t%s\t%s\n", "PREFILTER", pf.Filter, pf.Before, pf.After)
+	}
+	for _, pos := range t.Positions {
+		if pos.Applied != nil {
+			fmt.Fprintf(&sb, "%s\t%v\t%d\t%s\n", "RULE APPLIED", *pos.Applied, pos.Index, pos.Remaining)
+		} else {
+			fmt.Fprintf(&sb, "%s\t%d\t%s\n", "NO RULE APPLIED", pos.Index, pos.Remaining)
+		}
+	}
+	for _, v := range t.Variants {
+		for _, r := range v.PhonemeRules {
+			fmt.Fprintf(&sb, "%s\t%s\t%s\t%s\n", "PHONEME RULE", r.Filter, r.Before, r.After)
+		}
+		for _, f := range v.Filters {
+			fmt.Fprintf(&sb, "%s\t%s\t%s\t%s\n", "FILTER", f.Filter, f.Before, f.After)
+		}
+	}
+	fmt.Fprintf(&sb, "%s\t%s\n", "RESULT", strings.Join(t.Result, " # "))
+	return sb.String()
+}
@@ -0,0 +1,464 @@
+package rbg2p
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// fmtSection is a section of a formatted rule file. The sections are written in this order.
+type fmtSection int
+
+const (
+	fmtBase fmtSection = iota
+	fmtIncludes
+	fmtConsts
+	fmtVars
+	fmtPhonemeVars
+	fmtPrefilters
+	fmtFilters
+	fmtSyllDef
+	fmtRules
+	fmtPhonemeRules
+	fmtLexicon
+	fmtTests
+	fmtSyllTests
+	numFmtSections
+)
+
+// fmtConstOrder is the order of the constant definitions in a formatted rule file
+var fmtConstOrder = []string{"CHARACTER_SET", "PHONEME_SET", "PHONEME_DELIMITER", "DEFAULT_PHONEME", "DOWNCASE_INPUT", "LOCALE", "NORMALIZATION", "DIRECTION", "MATCH_TIMEOUT", "MAX_VARIANTS", "WORD_BOUNDARY"}
+
+// fmtQuotedConsts are the constants with string values, which are always quoted in a formatted rule file (other constants are only quoted if needed)
+var fmtQuotedConsts = map[string]bool{"CHARACTER_SET": true, "DEFAULT_PHONEME": true, "WORD_BOUNDARY": true}
+
+// fmtEntry is a definition line in a rule file to be formatted, along with its comments
+type fmtEntry struct {
+	section fmtSection
+
+	// order is the sort order within the section (only used for constants)
+	order int
+
+	// left and right are the parts of the line before and after the arrow (->), for definitions that are aligned on the arrow; otherwise, left holds the whole line
+	left, right string
+	aligned     bool
+
+	// comment is the comment at the end of the line, if any
+	comment string
+
+	// comments are the comment lines preceding the line, and commentGap is true if they were separated from the line by a blank line
+	comments   []string
+	commentGap bool
+
+	// blankBefore is true if the entry (or its comments) was preceded by a blank line
+	blankBefore bool
+}
+
+// splitComment splits a (trimmed) line into the definition and the comment at the end of the line (if any), in the same way as the rule file parser
+func splitComment(line string) (string, string) {
+	code := trimComment(line)
+	if code == line {
+		return code, ""
+	}
+	m := commentAtEndRe.FindStringSubmatch(line)
+	if m == nil {
+		return code, ""
+	}
+	return code, strings.TrimSpace(line[len(m[1]):])
+}
+
+// fmtQuoteIfNeeded returns the TEST or LEXICON input, quoted if it contains a space
+func fmtQuoteIfNeeded(s string) string {
+	if strings.Contains(s, " ") {
+		return "\"" + s + "\""
+	}
+	return s
+}
+
+// fmtVariants returns the variant outputs of a rule, TEST or LEXICON definition, as a single output or a parenthesized, comma separated list
+func fmtVariants(variants []string) string {
+	if len(variants) == 1 {
+		return variants[0]
+	}
+	return "(" + strings.Join(variants, ", ") + ")"
+}
+
+var fmtSyllDefRe = regexp.MustCompile("^SYLLDEF +([^ ]+) +(.*)$")
+
+// formatRule returns the left (input) and right (output and contexts) parts of a formatted rule
+func formatRule(l string) (string, string, error) {
+	after := ""
+	if m := rulePhonemeContextRe.FindStringSubmatch(l); m != nil {
+		after = strings.TrimSpace(m[2])
+		l = m[1]
+	}
+	m := ruleRe.FindStringSubmatch(l)
+	if m == nil {
+		return "", "", fmt.Errorf("invalid rule definition: %s", l)
+	}
+	input := m[1]
+	output := strings.TrimSpace(m[2])
+	if v := ruleOutputReVariants.FindStringSubmatch(output); v != nil {
+		output = fmtVariants(commaSplit.Split(v[1], -1))
+	}
+	right := output
+	if strings.TrimSpace(m[3]) != "" {
+		c := contextRe.FindStringSubmatch(m[3])
+		if c == nil {
+			return "", "", fmt.Errorf("invalid context definition: %s", m[3])
+		}
+		// context tokens are joined without spaces, so extra spaces can be removed
+		left := strings.Join(strings.Fields(c[1]), " ")
+		rightC := strings.Join(strings.Fields(c[2]), " ")
+		if left != "" || rightC != "" {
+			context := "_"
+			if left != "" {
+				context = left + " " + context
+			}
+			if rightC != "" {
+				context = context + " " + rightC
+			}
+			right = right + " / " + context
+		}
+	}
+	if after != "" {
+		right = right + " AFTER " + after
+	}
+	return input, right, nil
+}
+
+// formatVar returns a formatted VAR definition, with the value unquoted if it can be read back unquoted
+func formatVar(l string) (string, error) {
+	name, value, err := newVar(l)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range []string{value, "\"" + value + "\""} {
+		res := fmt.Sprintf("VAR %s %s", name, candidate)
+		if n, v, err := newVar(res); err == nil && n == name && v == value {
+			return res, nil
+		}
+	}
+	return strings.Join(strings.Fields(l)[0:2], " ") + " " + varRe.FindStringSubmatch(l)[2], nil
+}
+
+// formatConst returns a formatted constant definition, and its sort order
+func formatConst(l string) (string, int, error) {
+	m := constRe.FindStringSubmatch(l)
+	if m == nil {
+		return "", 0, fmt.Errorf("invalid const definition: %s", l)
+	}
+	name, value := m[1], m[2]
+	if value == "" {
+		value = m[3]
+	}
+	order := len(fmtConstOrder)
+	for i, c := range fmtConstOrder {
+		if c == name {
+			order = i
+		}
+	}
+	if fmtQuotedConsts[name] || strings.Contains(value, "\"") || value != strings.TrimSpace(value) {
+		return fmt.Sprintf("%s \"%s\"", name, value), order, nil
+	}
+	return fmt.Sprintf("%s %s", name, value), order, nil
+}
+
+// formatTest returns the left and right parts of a formatted TEST or LEXICON definition, using the regexps for single and variant outputs
+func formatTest(prefix string, l string, reSimple, reVariants *regexp.Regexp) (string, string, error) {
+	var outputs []string
+	m := reSimple.FindStringSubmatch(l)
+	if m != nil {
+		outputs = []string{m[2]}
+	} else {
+		m = reVariants.FindStringSubmatch(l)
+		if m == nil {
+			return "", "", fmt.Errorf("invalid %s definition: %s", prefix, l)
+		}
+		outputs = commaSplit.Split(m[2], -1)
+	}
+	input := strings.Trim(m[1], "\"")
+	return prefix + " " + fmtQuoteIfNeeded(input), fmtVariants(outputs), nil
+}
+
+// newFmtEntry parses a definition line (without comments), and returns a formatted entry
+func newFmtEntry(l string) (fmtEntry, error) {
+	var err error
+	e := fmtEntry{}
+	switch {
+	case isBase(l):
+		var p string
+		p, err = parseBase(l)
+		e.section, e.left = fmtBase, fmt.Sprintf("BASE \"%s\"", p)
+	case isLabel(l):
+		// labels are kept in the rules section, along with the rule (or overlay definition) following them
+		var name string
+		name, err = parseLabel(l)
+		e.section, e.left = fmtRules, "LABEL "+name
+	case isOverlayEdit(l):
+		var edit overlayEdit
+		if edit, err = newOverlayEdit(l); err != nil {
+			return e, err
+		}
+		prefix := edit.op + " " + edit.ref
+		if edit.op == "BEFORE" || edit.op == "AFTER" {
+			prefix = "INSERT " + prefix
+		}
+		e.section, e.left = fmtRules, prefix
+		if edit.rule != "" {
+			var left string
+			left, e.right, err = formatRule(edit.rule)
+			e.left, e.aligned = prefix+" "+left, true
+		}
+	case isInclude(l):
+		var p string
+		p, err = parseInclude(l)
+		e.section, e.left = fmtIncludes, fmt.Sprintf("INCLUDE \"%s\"", p)
+	case isPhonemeDelimiter(l):
+		m := phnDelimRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid phoneme delimiter definition: %s", l)
+		}
+		e.section, e.left, e.order = fmtConsts, fmt.Sprintf("PHONEME_DELIMITER \"%s\"", m[2]), 2
+	case isPhonemeSet(l):
+		m := phnSetRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid phoneme set definition: %s", l)
+		}
+		e.section, e.left, e.order = fmtConsts, fmt.Sprintf("PHONEME_SET \"%s\"", m[2]), 1
+	case isConst(l):
+		e.section = fmtConsts
+		e.left, e.order, err = formatConst(l)
+	case isVar(l):
+		e.section = fmtVars
+		e.left, err = formatVar(l)
+	case isPhonemeVar(l):
+		m := phonemeVarRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid PHONEME_VAR definition: %s", l)
+		}
+		e.section, e.left = fmtPhonemeVars, fmt.Sprintf("PHONEME_VAR %s \"%s\"", m[1], m[2])
+	case isPhonemeRule(l):
+		m := phonemeRuleRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid phoneme rule definition: %s", l)
+		}
+		e.section, e.aligned = fmtPhonemeRules, true
+		e.left = m[1] + " " + strings.TrimSpace(m[2])
+		e.right = strings.TrimSpace(m[3])
+		if m[4] != "" {
+			e.right = e.right + " / " + strings.TrimSpace(m[4])
+		}
+	case isSyllTest(l):
+		m := syllTestRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid SYLLDEF TEST definition: %s", l)
+		}
+		// spaces in the input and output are significant (they are compared as is), so syllabification tests are not aligned
+		e.section, e.left = fmtSyllTests, fmt.Sprintf("SYLLDEF TEST %s -> %s", m[1], m[2])
+	case isSyllDefLine(l):
+		m := fmtSyllDefRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid SYLLDEF definition: %s", l)
+		}
+		e.section, e.left = fmtSyllDef, fmt.Sprintf("SYLLDEF %s %s", m[1], m[2])
+	case isFilter(l):
+		m := filterRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid FILTER definition: %s", l)
+		}
+		e.section, e.left = fmtFilters, fmt.Sprintf("FILTER \"%s\" -> \"%s\"", m[1], m[2])
+	case isPrefilter(l):
+		m := prefilterRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid PREFILTER definition: %s", l)
+		}
+		e.section, e.left = fmtPrefilters, fmt.Sprintf("PREFILTER \"%s\" -> \"%s\"", m[1], m[2])
+	case isTest(l):
+		e.section, e.aligned = fmtTests, true
+		e.left, e.right, err = formatTest("TEST", l, testReSimple, testReVariants)
+	case isLexiconFile(l):
+		m := lexiconFileRe.FindStringSubmatch(l)
+		if m == nil {
+			return e, fmt.Errorf("invalid LEXICON_FILE definition: %s", l)
+		}
+		e.section, e.left = fmtLexicon, fmt.Sprintf("LEXICON_FILE \"%s\"", m[1])
+	case isLexiconEntry(l):
+		e.section, e.aligned = fmtLexicon, true
+		e.left, e.right, err = formatTest("LEXICON", l, lexiconReSimple, lexiconReVariants)
+	default:
+		e.section, e.aligned = fmtRules, true
+		e.left, e.right, err = formatRule(l)
+	}
+	return e, err
+}
+
+// Format parses a g2p rule file (or syllabification rule file), and returns it in canonical format:
+//
+//   - the definitions are grouped in sections (separated by a blank line): the BASE definition of an overlay file, constants, variables, phoneme variables, prefilters, filters, syllabification definitions, rules (with labels and overlay definitions), phoneme rules, lexicon files and entries, tests, and syllabification tests
+//   - INCLUDE directives are kept in place: definitions are not moved across an INCLUDE directive, since the included definitions may be order dependent (e.g. rules)
+//   - within each section, the definitions are kept in the input order (except constants, which are sorted), along with single blank lines separating paragraphs of definitions
+//   - the arrows (->) of rules, phoneme rules, tests and lexicon entries are aligned within each paragraph
+//   - redundant quotes and spaces are removed, and quotes are added where needed (e.g. CHARACTER_SET values are always quoted)
+//   - comment lines are kept with the definition following them; comments at the start of the file (separated from the first definition by a blank line) and at the end of the file are kept in place
+//
+// The file name is only used in error messages. A ParseError is returned for lines that can't be parsed.
+func Format(fileName string, src []byte) ([]byte, error) {
+	// segments are the parts of the file separated by INCLUDE directives (each segment starts with the INCLUDE directives preceding its definitions). Definitions are only moved within a segment, since the included definitions may be order dependent (e.g. rules).
+	segments := [][][]fmtEntry{make([][]fmtEntry, numFmtSections)}
+	header := []string{}
+	// comments holds the comment lines since the last definition (with empty strings for blank lines between comment lines)
+	comments := []string{}
+	// blank is true if a blank line precedes the comments (or the next definition), and gap is true if a blank line follows the comments
+	blank, gap, seenEntry := false, false, false
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		code, comment := splitComment(line)
+		if isBlankLine(code) {
+			if len(comments) == 0 {
+				blank = true
+			} else {
+				gap = true
+			}
+			continue
+		}
+		if isComment(code) {
+			if gap {
+				comments = append(comments, "")
+				gap = false
+			}
+			comments = append(comments, line)
+			continue
+		}
+		e, err := newFmtEntry(code)
+		if err != nil {
+			return nil, parseError(fileName, n, scanner.Text(), err)
+		}
+		if !seenEntry {
+			// comments at the start of the file, separated from the first definition by a blank line, are kept in place
+			if gap {
+				header, comments, gap = comments, []string{}, false
+			} else {
+				for i := len(comments) - 1; i >= 0; i-- {
+					if comments[i] == "" {
+						header, comments = comments[0:i], comments[i+1:]
+						break
+					}
+				}
+			}
+		}
+		e.comment = comment
+		e.comments = comments
+		e.commentGap = gap
+		e.blankBefore = blank
+		sections := segments[len(segments)-1]
+		if e.section == fmtIncludes && len(sections[fmtIncludes]) < fmtSegmentSize(sections) {
+			sections = make([][]fmtEntry, numFmtSections)
+			segments = append(segments, sections)
+		}
+		sections[e.section] = append(sections[e.section], e)
+		comments, blank, gap, seenEntry = []string{}, false, false, true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	trailer := comments
+
+	for _, sections := range segments {
+		consts := sections[fmtConsts]
+		sort.SliceStable(consts, func(i, j int) bool { return consts[i].order < consts[j].order })
+		for i := range consts {
+			consts[i].blankBefore = false
+		}
+	}
+
+	var out bytes.Buffer
+	separate := false
+	if len(header) > 0 {
+		out.WriteString(strings.Join(header, "\n") + "\n")
+		separate = true
+	}
+	for _, sections := range segments {
+		for _, entries := range sections {
+			if len(entries) == 0 {
+				continue
+			}
+			if separate {
+				out.WriteString("\n")
+			}
+			writeFmtSection(&out, entries)
+			separate = true
+		}
+	}
+	if len(trailer) > 0 {
+		if separate {
+			out.WriteString("\n")
+		}
+		out.WriteString(strings.Join(trailer, "\n") + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+// fmtSegmentSize returns the number of entries in a segment
+func fmtSegmentSize(sections [][]fmtEntry) int {
+	res := 0
+	for _, entries := range sections {
+		res += len(entries)
+	}
+	return res
+}
+
+// writeFmtSection writes the entries of a section, aligning the arrows within each paragraph
+func writeFmtSection(out *bytes.Buffer, entries []fmtEntry) {
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && !entries[end].blankBefore && !entries[end].commentGap {
+			end++
+		}
+		width := 0
+		for _, e := range entries[start:end] {
+			if w := uniseg.StringWidth(e.left); e.aligned && w > width {
+				width = w
+			}
+		}
+		for i, e := range entries[start:end] {
+			if start > 0 && i == 0 {
+				out.WriteString("\n")
+			}
+			for _, c := range e.comments {
+				out.WriteString(c + "\n")
+			}
+			if e.commentGap {
+				out.WriteString("\n")
+			}
+			line := e.left
+			if e.aligned {
+				line = e.left + strings.Repeat(" ", width-uniseg.StringWidth(e.left)) + " -> " + e.right
+			}
+			if e.comment != "" {
+				line = line + " " + e.comment
+			}
+			out.WriteString(line + "\n")
+		}
+		start = end
+	}
+}
+
+// FormatFile reads and formats a g2p rule file (or syllabification rule file), see Format
+func FormatFile(fName string) ([]byte, error) {
+	src, err := os.ReadFile(filepath.Clean(fName))
+	if err != nil {
+		return nil, err
+	}
+	return Format(fName, src)
+}
@@ -1,9 +1,11 @@
 module github.com/stts-se/rbg2p
 
-go 1.24
+go 1.24.0
 
 require (
 	github.com/dlclark/regexp2 v1.11.5
 	github.com/gorilla/mux v1.8.1
+	github.com/rivo/uniseg v0.4.7
 	github.com/sergi/go-diff v1.3.1
+	golang.org/x/text v0.32.0
 )
@@ -0,0 +1,52 @@
+package rbg2p
+
+import (
+	"github.com/rivo/uniseg"
+)
+
+// splitGraphemes splits the input string into extended grapheme clusters (user-perceived characters), so that a base letter and its combining marks are kept together
+func splitGraphemes(s string) []string {
+	res := []string{}
+	state := -1
+	var cluster string
+	for len(s) > 0 {
+		cluster, s, _, state = uniseg.FirstGraphemeClusterInString(s, state)
+		res = append(res, cluster)
+	}
+	return res
+}
+
+// graphemeIndex holds the grapheme clusters of an input string, indexed by the rune positions where they start and end, so that the input is only split once for each call to RuleSet.applyRules
+type graphemeIndex struct {
+	runes    []rune
+	starting []string // the cluster starting at each rune position ("" if no cluster starts at the position)
+	ending   []string // the cluster ending at each rune position ("" if no cluster ends at the position)
+}
+
+// newGraphemeIndex splits the input runes into grapheme clusters, and indexes them by start and end position
+func newGraphemeIndex(s0 []rune) graphemeIndex {
+	res := graphemeIndex{runes: s0, starting: make([]string, len(s0)+1), ending: make([]string, len(s0)+1)}
+	i := 0
+	for _, cluster := range splitGraphemes(string(s0)) {
+		res.starting[i] = cluster
+		i += len([]rune(cluster))
+		res.ending[i] = cluster
+	}
+	return res
+}
+
+// at returns the grapheme cluster starting at position i in the input runes, or (if rightToLeft is true) the grapheme cluster ending at position i. If a rule has consumed part of a cluster, so that i isn't a cluster boundary, the cluster is computed from the remaining runes instead.
+func (gi graphemeIndex) at(i int, rightToLeft bool) string {
+	if rightToLeft {
+		if cluster := gi.ending[i]; cluster != "" {
+			return cluster
+		}
+		clusters := splitGraphemes(string(gi.runes[0:i]))
+		return clusters[len(clusters)-1]
+	}
+	if cluster := gi.starting[i]; cluster != "" {
+		return cluster
+	}
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(string(gi.runes[i:]), -1)
+	return cluster
+}
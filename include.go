@@ -0,0 +1,186 @@
+package rbg2p
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SourceLine is the position of a line of a rule set in the rule file it was read from, which is an included file for lines read using the INCLUDE directive, or the base rule set for lines of an overlay file's base (see OVERLAY FILES in the package documentation)
+type SourceLine struct {
+	File string
+	Line int
+
+	// Overlay is true if the line is defined in an overlay file (or in a file included by it), and false if it is defined in the base rule set of the overlay, or if the rule set is not loaded from an overlay file
+	Overlay bool
+}
+
+// String returns the source position as file:line
+func (s SourceLine) String() string {
+	return fmt.Sprintf("%s:%d", s.File, s.Line)
+}
+
+// describe describes a line of the specified kind (e.g. "rule" or "test") by its source position, e.g. "rule at test.g2p:5". For a rule set loaded from an overlay file, the origin of the line is included, e.g. "overlay rule at north.g2p:5" or "base rule at test.g2p:5". If the source file is unknown (e.g. for rules that are not loaded from file), the line number is used, e.g. "rule on line 5".
+func (s SourceLine) describe(kind string, overlay bool) string {
+	if overlay {
+		origin := "base"
+		if s.Overlay {
+			origin = "overlay"
+		}
+		kind = origin + " " + kind
+	}
+	if s.File == "" {
+		return fmt.Sprintf("%s on line %d", kind, s.Line)
+	}
+	return fmt.Sprintf("%s at %s", kind, s)
+}
+
+// Source returns the source position of line n (1-based) of the rule set content (see RuleSet.Content), i.e., the rule file and line number in that file. Line numbers in the rule set (e.g. Rule.LineNumber) refer to the rule set content, in which each INCLUDE directive is replaced by the lines of the included file.
+func (rs RuleSet) Source(n int) SourceLine {
+	if n < 1 || n > len(rs.sources) {
+		return SourceLine{Line: n}
+	}
+	return rs.sources[n-1]
+}
+
+// describeLine describes line n of the rule set content (e.g. a rule or a test) by its source position (see SourceLine.describe)
+func (rs RuleSet) describeLine(kind string, n int) string {
+	return rs.Source(n).describe(kind, rs.Base != "")
+}
+
+// pathOpener resolves a path referenced from the file at basePath (by the INCLUDE or LEXICON_FILE directives), and opens it for reading. It returns the resolved path along with the reader.
+type pathOpener func(basePath string, p string) (string, io.ReadCloser, error)
+
+// openRelativePath resolves a path relative to the (file or URL) path of the file it was referenced from, and opens it
+func openRelativePath(basePath string, p string) (string, io.ReadCloser, error) {
+	resolved, err := resolvePath(basePath, p)
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := openPath(resolved)
+	return resolved, r, err
+}
+
+// fsOpener returns a pathOpener reading files from fsys, with paths resolved relative to the directory of the referencing file
+func fsOpener(fsys fs.FS) pathOpener {
+	return func(basePath string, p string) (string, io.ReadCloser, error) {
+		resolved := path.Join(path.Dir(basePath), p)
+		r, err := fsys.Open(resolved)
+		return resolved, r, err
+	}
+}
+
+// sourceKey returns the path used to identify a file when checking for include cycles
+func sourceKey(p string) string {
+	if isURL(p) {
+		return p
+	}
+	return filepath.Clean(p)
+}
+
+// checkCycle returns an error if the resolved path is one of the files being read (the stack), i.e., if reading it would create a cycle of INCLUDE (or BASE) directives
+func checkCycle(directive string, stack []string, resolved string) error {
+	key := sourceKey(resolved)
+	for i, s := range stack {
+		if s == key {
+			cycle := append(append([]string{}, stack[i:]...), s)
+			return fmt.Errorf("%s cycle: %s", directive, strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
+
+var includeRe = regexp.MustCompile("^INCLUDE +\"(.+)\"$")
+
+func isInclude(s string) bool {
+	return strings.HasPrefix(s, "INCLUDE ")
+}
+
+func parseInclude(s string) (string, error) {
+	matchRes := includeRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return "", fmt.Errorf("invalid INCLUDE definition: %s", s)
+	}
+	return matchRes[1], nil
+}
+
+// readSource reads the lines of a rule file, replacing each INCLUDE directive by the lines of the included file (recursively). It returns the lines and the source position of each line. The stack holds the files being read (the input file and the files including it), and is used to detect include cycles.
+func readSource(scanner *bufio.Scanner, inputPath string, open pathOpener, stack []string) ([]string, []SourceLine, error) {
+	lines := []string{}
+	sources := []SourceLine{}
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		l := trimComment(strings.TrimSpace(line))
+		if !isInclude(l) {
+			lines = append(lines, line)
+			sources = append(sources, SourceLine{File: inputPath, Line: n})
+			continue
+		}
+		p, err := parseInclude(l)
+		if err != nil {
+			return lines, sources, parseError(inputPath, n, line, err)
+		}
+		resolved, r, err := open(inputPath, p)
+		if err != nil {
+			return lines, sources, parseError(inputPath, n, line, fmt.Errorf("couldn't include file %s : %v", p, err))
+		}
+		if err := checkCycle("include", stack, resolved); err != nil {
+			r.Close()
+			return lines, sources, parseError(inputPath, n, line, err)
+		}
+		includedLines, includedSources, err := readSource(bufio.NewScanner(r), resolved, open, append(stack, sourceKey(resolved)))
+		r.Close()
+		if err != nil {
+			return lines, sources, err
+		}
+		lines = append(lines, includedLines...)
+		sources = append(sources, includedSources...)
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, sources, err
+	}
+	return lines, sources, nil
+}
+
+// LoadFS loads a g2p rule set from the named file in fsys. Included files and lexicon files are read from fsys, relative to the directory of the file referencing them. Files with the extension .json are loaded as JSON rule files (see RuleSetJSON).
+func LoadFS(fsys fs.FS, name string) (RuleSet, error) {
+	if isJSONPath(name) {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return RuleSet{}, err
+		}
+		return loadJSONFrom(name, src, fsOpener(fsys))
+	}
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return RuleSet{}, err
+	}
+	/* #nosec G307 */
+	defer fh.Close()
+	return loadFrom(bufio.NewScanner(fh), name, fsOpener(fsys))
+}
+
+// LoadSyllFS loads a syllabifier from the named file in fsys. Included files are read from fsys, relative to the directory of the file referencing them. Files with the extension .json are loaded as JSON rule files (see RuleSetJSON).
+func LoadSyllFS(fsys fs.FS, name string) (Syllabifier, error) {
+	if isJSONPath(name) {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return Syllabifier{}, err
+		}
+		return loadSyllJSONFrom(name, src, fsOpener(fsys))
+	}
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return Syllabifier{}, err
+	}
+	/* #nosec G307 */
+	defer fh.Close()
+	return loadSyllFrom(bufio.NewScanner(fh), name, fsOpener(fsys))
+}
@@ -0,0 +1,644 @@
+package rbg2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RuleSetJSON is the JSON representation of a g2p rule file (or a syllabification rule file), as documented by the JSON schema in rbg2p.schema.json. Each field corresponds to a definition type of the .g2p format (see the package documentation), and the values are kept as written in the rule file: variables are not expanded, and the rules are not validated until the rule set is loaded. Lists are kept in rule file order. Comments are not included, and INCLUDE directives are only allowed before the rules, phoneme rules, filters and prefilters (since the included definitions are read first).
+type RuleSetJSON struct {
+	// Includes are the included files (see the INCLUDE directive), which are read before the other definitions
+	Includes []string `json:"includes,omitempty"`
+
+	CharacterSet     string   `json:"character_set,omitempty"`
+	PhonemeSet       []string `json:"phoneme_set,omitempty"`
+	PhonemeDelimiter *string  `json:"phoneme_delimiter,omitempty"`
+	DefaultPhoneme   *string  `json:"default_phoneme,omitempty"`
+	DowncaseInput    *bool    `json:"downcase_input,omitempty"`
+	Locale           string   `json:"locale,omitempty"`
+	Normalization    string   `json:"normalization,omitempty"`
+	Direction        string   `json:"direction,omitempty"`
+	MatchTimeout     string   `json:"match_timeout,omitempty"`
+	MaxVariants      int      `json:"max_variants,omitempty"`
+	WordBoundary     *string  `json:"word_boundary,omitempty"`
+
+	Vars         []VarJSON         `json:"vars,omitempty"`
+	PhonemeVars  []PhonemeVarJSON  `json:"phoneme_vars,omitempty"`
+	Prefilters   []FilterJSON      `json:"prefilters,omitempty"`
+	Filters      []FilterJSON      `json:"filters,omitempty"`
+	SyllDef      *SyllDefJSON      `json:"sylldef,omitempty"`
+	Rules        []RuleJSON        `json:"rules,omitempty"`
+	PhonemeRules []PhonemeRuleJSON `json:"phoneme_rules,omitempty"`
+	LexiconFiles []string          `json:"lexicon_files,omitempty"`
+	Lexicon      []LexiconJSON     `json:"lexicon,omitempty"`
+	Tests        []TestJSON        `json:"tests,omitempty"`
+	SyllTests    []SyllTestJSON    `json:"sylldef_tests,omitempty"`
+}
+
+// VarJSON is the JSON representation of a VAR definition
+type VarJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PhonemeVarJSON is the JSON representation of a PHONEME_VAR definition
+type PhonemeVarJSON struct {
+	Name     string   `json:"name"`
+	Phonemes []string `json:"phonemes"`
+}
+
+// FilterJSON is the JSON representation of a FILTER or PREFILTER definition
+type FilterJSON struct {
+	Regexp string `json:"regexp"`
+	Output string `json:"output"`
+}
+
+// SyllDefJSON is the JSON representation of the SYLLDEF definitions
+type SyllDefJSON struct {
+	Type                    string   `json:"type,omitempty"`
+	Onsets                  []string `json:"onsets,omitempty"`
+	Syllabic                []string `json:"syllabic,omitempty"`
+	Stress                  []string `json:"stress,omitempty"`
+	Delimiter               string   `json:"delimiter,omitempty"`
+	StressPlacement         string   `json:"stress_placement,omitempty"`
+	IncludePhonemeDelimiter *bool    `json:"include_phoneme_delimiter,omitempty"`
+}
+
+// RuleJSON is the JSON representation of a g2p rule. An empty output string is the empty output (∅ in the rule file). Weights, if specified, has one weight for each output variant. Label is the name of the rule defined by a LABEL directive (if any).
+type RuleJSON struct {
+	Label           string    `json:"label,omitempty"`
+	Input           string    `json:"input"`
+	CaseInsensitive bool      `json:"case_insensitive,omitempty"`
+	Output          []string  `json:"output"`
+	Weights         []float64 `json:"weights,omitempty"`
+	LeftContext     string    `json:"left_context,omitempty"`
+	RightContext    string    `json:"right_context,omitempty"`
+	PhonemeContext  string    `json:"phoneme_context,omitempty"`
+}
+
+// PhonemeRuleJSON is the JSON representation of a PHONEME_RULE (or SYLL_PHONEME_RULE) definition. The input and output are phoneme tokens (an empty list is ∅ in the rule file).
+type PhonemeRuleJSON struct {
+	AfterSyllabification bool     `json:"after_syllabification,omitempty"`
+	Input                []string `json:"input"`
+	Output               []string `json:"output"`
+	LeftContext          string   `json:"left_context,omitempty"`
+	RightContext         string   `json:"right_context,omitempty"`
+}
+
+// LexiconJSON is the JSON representation of a LEXICON entry
+type LexiconJSON struct {
+	Orth    string   `json:"orth"`
+	Transes []string `json:"transes"`
+}
+
+// TestJSON is the JSON representation of a TEST definition
+type TestJSON struct {
+	Input  string   `json:"input"`
+	Output []string `json:"output"`
+}
+
+// SyllTestJSON is the JSON representation of a SYLLDEF TEST definition
+type SyllTestJSON struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// jsonEscapeQuotes escapes double quotes in quoted values of filter outputs, phoneme variables and syllable definitions (which are unescaped by the rule file parser)
+func jsonEscapeQuotes(s string) string {
+	return strings.Replace(s, "\"", "\\\"", -1)
+}
+
+func jsonUnescapeQuotes(s string) string {
+	return strings.Replace(s, "\\\"", "\"", -1)
+}
+
+// ParseG2P parses a g2p rule file (or syllabification rule file) into its JSON representation. Only the syntax of the definitions is checked; the rule set is validated when it is loaded. The file name is only used in error messages. A ParseError is returned for lines that can't be parsed.
+func ParseG2P(fileName string, src []byte) (RuleSetJSON, error) {
+	res := RuleSetJSON{}
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	n := 0
+	// label is the pending LABEL definition, which labels the rule on the next line
+	label, labelLine, labelN := "", "", 0
+	for scanner.Scan() {
+		n++
+		l := trimComment(strings.TrimSpace(scanner.Text()))
+		if isBlankLine(l) || isComment(l) {
+			continue
+		}
+		if label != "" && !isRuleLine(l) {
+			return res, parseError(fileName, labelN, labelLine, fmt.Errorf("LABEL %s must be followed by a rule", label))
+		}
+		if isLabel(l) {
+			name, err := parseLabel(l)
+			if err != nil {
+				return res, parseError(fileName, n, scanner.Text(), err)
+			}
+			label, labelLine, labelN = name, scanner.Text(), n
+			continue
+		}
+		if err := res.addLine(l); err != nil {
+			return res, parseError(fileName, n, scanner.Text(), err)
+		}
+		if label != "" {
+			res.Rules[len(res.Rules)-1].Label = label
+			label = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return res, err
+	}
+	if label != "" {
+		return res, parseError(fileName, labelN, labelLine, fmt.Errorf("LABEL %s must be followed by a rule", label))
+	}
+	return res, nil
+}
+
+// addLine parses a definition line (without comments), and adds it to the JSON representation
+func (doc *RuleSetJSON) addLine(l string) error {
+	switch {
+	case isBase(l), isOverlayEdit(l):
+		return fmt.Errorf("overlay files can't be represented in JSON: %s", l)
+	case isInclude(l):
+		// the included definitions are read before the definitions of the file, so an INCLUDE directive can't follow definitions where the order matters
+		if len(doc.Rules) > 0 || len(doc.PhonemeRules) > 0 || len(doc.Filters) > 0 || len(doc.Prefilters) > 0 {
+			return fmt.Errorf("INCLUDE after rule, phoneme rule, filter or prefilter definitions can't be represented in JSON: %s", l)
+		}
+		p, err := parseInclude(l)
+		if err != nil {
+			return err
+		}
+		doc.Includes = append(doc.Includes, p)
+	case isPhonemeDelimiter(l):
+		delim, err := parsePhonemeDelimiter(l)
+		if err != nil {
+			return err
+		}
+		doc.PhonemeDelimiter = &delim
+	case isPhonemeSet(l):
+		m := phnSetRe.FindStringSubmatch(l)
+		if m == nil {
+			return fmt.Errorf("invalid phoneme set definition: %s", l)
+		}
+		doc.PhonemeSet = multiSpace.Split(m[2], -1)
+	case isConst(l):
+		return doc.addConst(l)
+	case isVar(l):
+		name, value, err := newVar(l)
+		if err != nil {
+			return err
+		}
+		doc.Vars = append(doc.Vars, VarJSON{Name: name, Value: value})
+	case isPhonemeVar(l):
+		name, phonemes, err := newPhonemeVar(l)
+		if err != nil {
+			return err
+		}
+		doc.PhonemeVars = append(doc.PhonemeVars, PhonemeVarJSON{Name: name, Phonemes: phonemes})
+	case isPhonemeRule(l):
+		r, err := newPhonemeRuleJSON(l)
+		if err != nil {
+			return err
+		}
+		doc.PhonemeRules = append(doc.PhonemeRules, r)
+	case isSyllTest(l):
+		t, err := newSyllTest(l)
+		if err != nil {
+			return err
+		}
+		doc.SyllTests = append(doc.SyllTests, SyllTestJSON{Input: t.Input, Output: t.Output})
+	case isSyllDefLine(l):
+		return doc.addSyllDef(l)
+	case isFilter(l) || isPrefilter(l):
+		re := filterRe
+		if isPrefilter(l) {
+			re = prefilterRe
+		}
+		m := re.FindStringSubmatch(l)
+		if m == nil {
+			return fmt.Errorf("invalid %s definition: %s", strings.Fields(l)[0], l)
+		}
+		f := FilterJSON{Regexp: m[1], Output: jsonUnescapeQuotes(m[2])}
+		if isPrefilter(l) {
+			doc.Prefilters = append(doc.Prefilters, f)
+		} else {
+			doc.Filters = append(doc.Filters, f)
+		}
+	case isTest(l):
+		t, err := newTest(l)
+		if err != nil {
+			return err
+		}
+		doc.Tests = append(doc.Tests, TestJSON{Input: t.Input, Output: t.Output})
+	case isLexiconFile(l):
+		path, err := parseLexiconFile(l)
+		if err != nil {
+			return err
+		}
+		doc.LexiconFiles = append(doc.LexiconFiles, path)
+	case isLexiconEntry(l):
+		e, err := newLexiconEntry(l)
+		if err != nil {
+			return err
+		}
+		doc.Lexicon = append(doc.Lexicon, LexiconJSON{Orth: e.Orth, Transes: e.Transes})
+	default:
+		r, err := newRuleJSON(l)
+		if err != nil {
+			return err
+		}
+		doc.Rules = append(doc.Rules, r)
+	}
+	return nil
+}
+
+func (doc *RuleSetJSON) addConst(l string) error {
+	m := constRe.FindStringSubmatch(l)
+	if m == nil {
+		return fmt.Errorf("invalid const definition: %s", l)
+	}
+	name, value := m[1], m[2]
+	if value == "" {
+		value = m[3]
+	}
+	switch name {
+	case "CHARACTER_SET":
+		doc.CharacterSet = value
+	case "DEFAULT_PHONEME":
+		doc.DefaultPhoneme = &value
+	case "DOWNCASE_INPUT":
+		downcase := isTrueRe.MatchString(value)
+		if !downcase && !isFalseRe.MatchString(value) {
+			return fmt.Errorf("invalid boolean value for %s: %s", name, value)
+		}
+		doc.DowncaseInput = &downcase
+	case "LOCALE":
+		doc.Locale = value
+	case "NORMALIZATION":
+		doc.Normalization = value
+	case "DIRECTION":
+		doc.Direction = value
+	case "MATCH_TIMEOUT":
+		doc.MatchTimeout = value
+	case "MAX_VARIANTS":
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 0 {
+			return fmt.Errorf("invalid integer value for %s: %s", name, value)
+		}
+		doc.MaxVariants = max
+	case "WORD_BOUNDARY":
+		doc.WordBoundary = &value
+	}
+	return nil
+}
+
+func (doc *RuleSetJSON) addSyllDef(l string) error {
+	if doc.SyllDef == nil {
+		doc.SyllDef = &SyllDefJSON{}
+	}
+	def := doc.SyllDef
+	if isStressPlacement(l) {
+		m := stressPlacementRe.FindStringSubmatch(l)
+		if m == nil {
+			return fmt.Errorf("invalid stress placement definition: %s", l)
+		}
+		def.StressPlacement = m[1]
+		return nil
+	}
+	if isIncludePhnDelim(l) {
+		m := includePhnDelimRe.FindStringSubmatch(l)
+		if m == nil {
+			return fmt.Errorf("invalid sylldef definition: %s", l)
+		}
+		include := m[1] == "true"
+		def.IncludePhonemeDelimiter = &include
+		return nil
+	}
+	if m := syllDefTypeRe.FindStringSubmatch(l); m != nil {
+		def.Type = m[2]
+		return nil
+	}
+	m := syllDefRe.FindStringSubmatch(l)
+	if m == nil {
+		return fmt.Errorf("invalid sylldef definition: %s", l)
+	}
+	value := jsonUnescapeQuotes(strings.TrimSpace(m[2]))
+	switch m[1] {
+	case "ONSETS":
+		def.Onsets = commaSplit.Split(value, -1)
+	case "SYLLABIC":
+		def.Syllabic = multiSpace.Split(value, -1)
+	case "STRESS":
+		def.Stress = multiSpace.Split(value, -1)
+	case "DELIMITER":
+		def.Delimiter = value
+	}
+	return nil
+}
+
+func newRuleJSON(l string) (RuleJSON, error) {
+	res := RuleJSON{}
+	if m := rulePhonemeContextRe.FindStringSubmatch(l); m != nil {
+		res.PhonemeContext = strings.TrimSpace(m[2])
+		l = m[1]
+	}
+	m := ruleRe.FindStringSubmatch(l)
+	if m == nil {
+		return res, fmt.Errorf("invalid rule definition: %s", l)
+	}
+	res.Input = m[1]
+	if strings.HasPrefix(res.Input, caseInsensitivePrefix) && res.Input != caseInsensitivePrefix {
+		res.CaseInsensitive = true
+		res.Input = strings.TrimPrefix(res.Input, caseInsensitivePrefix)
+	}
+	output, weights, err := newRuleOutput(m[2], l)
+	if err != nil {
+		return res, err
+	}
+	res.Output, res.Weights = output, weights
+	if strings.TrimSpace(m[3]) != "" {
+		c := contextRe.FindStringSubmatch(m[3])
+		if c == nil {
+			return res, fmt.Errorf("invalid context definition: %s", m[3])
+		}
+		res.LeftContext, res.RightContext = strings.TrimSpace(c[1]), strings.TrimSpace(c[2])
+	}
+	return res, nil
+}
+
+func newPhonemeRuleJSON(l string) (PhonemeRuleJSON, error) {
+	m := phonemeRuleRe.FindStringSubmatch(l)
+	if m == nil {
+		return PhonemeRuleJSON{}, fmt.Errorf("invalid phoneme rule definition: %s", l)
+	}
+	res := PhonemeRuleJSON{AfterSyllabification: m[1] == "SYLL_PHONEME_RULE", Input: splitPhonemeRuleTokens(m[2]), Output: splitPhonemeRuleTokens(m[3])}
+	if m[4] != "" {
+		context := strings.Fields(m[4])
+		slot := -1
+		for i, t := range context {
+			if t == "_" {
+				if slot >= 0 {
+					return res, fmt.Errorf("invalid phoneme rule context definition: %s", l)
+				}
+				slot = i
+			}
+		}
+		if slot < 0 {
+			return res, fmt.Errorf("invalid phoneme rule context definition: %s", l)
+		}
+		res.LeftContext = strings.Join(context[0:slot], " ")
+		res.RightContext = strings.Join(context[slot+1:], " ")
+	}
+	return res, nil
+}
+
+// jsonContext returns the context part of a rule definition (including the leading slash), or the empty string if both contexts are empty
+func jsonContext(left, right string) string {
+	if left == "" && right == "" {
+		return ""
+	}
+	return " / " + strings.TrimSpace(left+" _ "+right)
+}
+
+func (r RuleJSON) g2pLine() string {
+	input := r.Input
+	if r.CaseInsensitive {
+		input = caseInsensitivePrefix + input
+	}
+	outputs := []string{}
+	for i, o := range r.Output {
+		if o == "" {
+			o = emptyOutput
+		}
+		if i < len(r.Weights) {
+			o = fmt.Sprintf("%s <%s>", o, strconv.FormatFloat(r.Weights[i], 'f', -1, 64))
+		}
+		outputs = append(outputs, o)
+	}
+	res := fmt.Sprintf("%s -> %s%s", input, fmtVariants(outputs), jsonContext(r.LeftContext, r.RightContext))
+	if r.PhonemeContext != "" {
+		res = res + " AFTER " + r.PhonemeContext
+	}
+	return res
+}
+
+func (r PhonemeRuleJSON) g2pLine() string {
+	prefix := "PHONEME_RULE"
+	if r.AfterSyllabification {
+		prefix = "SYLL_PHONEME_RULE"
+	}
+	tokens := func(ts []string) string {
+		if len(ts) == 0 {
+			return emptyOutput
+		}
+		return strings.Join(ts, " ")
+	}
+	return fmt.Sprintf("%s %s -> %s%s", prefix, tokens(r.Input), tokens(r.Output), jsonContext(r.LeftContext, r.RightContext))
+}
+
+// g2pLines returns the rule file definitions of the JSON representation, one per line, along with the location of each definition in the JSON representation (used in error messages)
+func (doc RuleSetJSON) g2pLines() ([]string, []string) {
+	lines := []string{}
+	locations := []string{}
+	add := func(location string, format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+		locations = append(locations, location)
+	}
+	for i, p := range doc.Includes {
+		add(fmt.Sprintf("includes[%d]", i), "INCLUDE \"%s\"", p)
+	}
+	if doc.CharacterSet != "" {
+		add("character_set", "CHARACTER_SET \"%s\"", doc.CharacterSet)
+	}
+	if len(doc.PhonemeSet) > 0 {
+		add("phoneme_set", "PHONEME_SET \"%s\"", strings.Join(doc.PhonemeSet, " "))
+	}
+	if doc.PhonemeDelimiter != nil {
+		add("phoneme_delimiter", "PHONEME_DELIMITER \"%s\"", *doc.PhonemeDelimiter)
+	}
+	if doc.DefaultPhoneme != nil {
+		add("default_phoneme", "DEFAULT_PHONEME \"%s\"", *doc.DefaultPhoneme)
+	}
+	if doc.DowncaseInput != nil {
+		add("downcase_input", "DOWNCASE_INPUT %v", *doc.DowncaseInput)
+	}
+	if doc.Locale != "" {
+		add("locale", "LOCALE %s", doc.Locale)
+	}
+	if doc.Normalization != "" {
+		add("normalization", "NORMALIZATION %s", doc.Normalization)
+	}
+	if doc.Direction != "" {
+		add("direction", "DIRECTION %s", doc.Direction)
+	}
+	if doc.MatchTimeout != "" {
+		add("match_timeout", "MATCH_TIMEOUT %s", doc.MatchTimeout)
+	}
+	if doc.MaxVariants != 0 {
+		add("max_variants", "MAX_VARIANTS %d", doc.MaxVariants)
+	}
+	if doc.WordBoundary != nil {
+		add("word_boundary", "WORD_BOUNDARY \"%s\"", *doc.WordBoundary)
+	}
+	for i, v := range doc.Vars {
+		add(fmt.Sprintf("vars[%d]", i), "VAR %s \"%s\"", v.Name, v.Value)
+	}
+	for i, v := range doc.PhonemeVars {
+		add(fmt.Sprintf("phoneme_vars[%d]", i), "PHONEME_VAR %s \"%s\"", v.Name, jsonEscapeQuotes(strings.Join(v.Phonemes, " ")))
+	}
+	for i, f := range doc.Prefilters {
+		add(fmt.Sprintf("prefilters[%d]", i), "PREFILTER \"%s\" -> \"%s\"", f.Regexp, jsonEscapeQuotes(f.Output))
+	}
+	for i, f := range doc.Filters {
+		add(fmt.Sprintf("filters[%d]", i), "FILTER \"%s\" -> \"%s\"", f.Regexp, jsonEscapeQuotes(f.Output))
+	}
+	if def := doc.SyllDef; def != nil {
+		if def.Type != "" {
+			add("sylldef.type", "SYLLDEF TYPE %s", def.Type)
+		}
+		if len(def.Onsets) > 0 {
+			add("sylldef.onsets", "SYLLDEF ONSETS \"%s\"", jsonEscapeQuotes(strings.Join(def.Onsets, ", ")))
+		}
+		if len(def.Syllabic) > 0 {
+			add("sylldef.syllabic", "SYLLDEF SYLLABIC \"%s\"", jsonEscapeQuotes(strings.Join(def.Syllabic, " ")))
+		}
+		if len(def.Stress) > 0 {
+			add("sylldef.stress", "SYLLDEF STRESS \"%s\"", jsonEscapeQuotes(strings.Join(def.Stress, " ")))
+		}
+		if def.Delimiter != "" {
+			add("sylldef.delimiter", "SYLLDEF DELIMITER \"%s\"", jsonEscapeQuotes(def.Delimiter))
+		}
+		if def.StressPlacement != "" {
+			add("sylldef.stress_placement", "SYLLDEF STRESS_PLACEMENT %s", def.StressPlacement)
+		}
+		if def.IncludePhonemeDelimiter != nil {
+			add("sylldef.include_phoneme_delimiter", "SYLLDEF INCLUDE_PHONEME_DELIMITER %v", *def.IncludePhonemeDelimiter)
+		}
+	}
+	for i, r := range doc.Rules {
+		if r.Label != "" {
+			add(fmt.Sprintf("rules[%d].label", i), "LABEL %s", r.Label)
+		}
+		add(fmt.Sprintf("rules[%d]", i), "%s", r.g2pLine())
+	}
+	for i, r := range doc.PhonemeRules {
+		add(fmt.Sprintf("phoneme_rules[%d]", i), "%s", r.g2pLine())
+	}
+	for i, path := range doc.LexiconFiles {
+		add(fmt.Sprintf("lexicon_files[%d]", i), "LEXICON_FILE \"%s\"", path)
+	}
+	for i, e := range doc.Lexicon {
+		add(fmt.Sprintf("lexicon[%d]", i), "LEXICON %s -> %s", fmtQuoteIfNeeded(e.Orth), fmtVariants(e.Transes))
+	}
+	for i, t := range doc.Tests {
+		add(fmt.Sprintf("tests[%d]", i), "TEST %s -> %s", fmtQuoteIfNeeded(t.Input), fmtVariants(t.Output))
+	}
+	for i, t := range doc.SyllTests {
+		add(fmt.Sprintf("sylldef_tests[%d]", i), "SYLLDEF TEST %s -> %s", t.Input, t.Output)
+	}
+	return lines, locations
+}
+
+// G2P returns the JSON representation as a g2p rule file, in canonical format (see Format)
+func (doc RuleSetJSON) G2P() ([]byte, error) {
+	lines, locations := doc.g2pLines()
+	res, err := Format("", []byte(strings.Join(lines, "\n")+"\n"))
+	return res, jsonLocationError(err, "", locations)
+}
+
+// jsonLocationError converts a ParseError for a line of the rule file created from the JSON representation, to an error referring to the location of the definition in the JSON representation
+func jsonLocationError(err error, fileName string, locations []string) error {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != fileName || parseErr.Line < 1 || parseErr.Line > len(locations) {
+		return err
+	}
+	return &ParseError{File: fileName, Err: fmt.Errorf("%s: %w", locations[parseErr.Line-1], parseErr.Err)}
+}
+
+// ParseJSON parses the JSON representation of a rule file. Unknown fields are not allowed. The file name is only used in error messages.
+func ParseJSON(fileName string, src []byte) (RuleSetJSON, error) {
+	res := RuleSetJSON{}
+	decoder := json.NewDecoder(bytes.NewReader(src))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&res); err != nil {
+		return res, &ParseError{File: fileName, Err: fmt.Errorf("invalid JSON rule file: %w", err)}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return res, &ParseError{File: fileName, Err: fmt.Errorf("invalid JSON rule file: unexpected data after the top-level object")}
+	}
+	return res, nil
+}
+
+// G2PToJSON converts a g2p rule file (or syllabification rule file) to its JSON representation (see RuleSetJSON). The file name is only used in error messages.
+func G2PToJSON(fileName string, src []byte) ([]byte, error) {
+	doc, err := ParseG2P(fileName, src)
+	if err != nil {
+		return nil, err
+	}
+	res, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(res, '\n'), nil
+}
+
+// JSONToG2P converts the JSON representation of a rule file to a g2p rule file, in canonical format (see Format). The file name is only used in error messages.
+func JSONToG2P(fileName string, src []byte) ([]byte, error) {
+	doc, err := ParseJSON(fileName, src)
+	if err != nil {
+		return nil, err
+	}
+	lines, locations := doc.g2pLines()
+	res, err := Format(fileName, []byte(strings.Join(lines, "\n")+"\n"))
+	return res, jsonLocationError(err, fileName, locations)
+}
+
+// isJSONPath returns true if the file (or URL) path has the extension .json, which is used by the loaders to identify JSON rule files
+func isJSONPath(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".json")
+}
+
+// jsonScanner parses the JSON representation of a rule file, and returns a scanner over the corresponding rule file definitions, one per line, along with the location of each definition in the JSON representation
+func jsonScanner(inputPath string, src []byte) (*bufio.Scanner, []string, error) {
+	doc, err := ParseJSON(inputPath, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines, locations := doc.g2pLines()
+	return bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n"))), locations, nil
+}
+
+// loadJSON loads a g2p rule set from its JSON representation. The line numbers of the rules (and RuleSet.Content) refer to the corresponding rule file, with one line per definition in the order of the JSON schema.
+func loadJSON(inputPath string, src []byte) (RuleSet, error) {
+	return loadJSONFrom(inputPath, src, openRelativePath)
+}
+
+// loadJSONFrom loads a g2p rule set from its JSON representation, using the opener to read included files and lexicon files
+func loadJSONFrom(inputPath string, src []byte, open pathOpener) (RuleSet, error) {
+	scanner, locations, err := jsonScanner(inputPath, src)
+	if err != nil {
+		return RuleSet{}, err
+	}
+	rs, err := loadFrom(scanner, inputPath, open)
+	return rs, jsonLocationError(err, inputPath, locations)
+}
+
+// loadSyllJSON loads a syllabifier from the JSON representation of a syllabification rule file
+func loadSyllJSON(inputPath string, src []byte) (Syllabifier, error) {
+	return loadSyllJSONFrom(inputPath, src, openRelativePath)
+}
+
+// loadSyllJSONFrom loads a syllabifier from the JSON representation of a syllabification rule file, using the opener to read included files
+func loadSyllJSONFrom(inputPath string, src []byte, open pathOpener) (Syllabifier, error) {
+	scanner, locations, err := jsonScanner(inputPath, src)
+	if err != nil {
+		return Syllabifier{}, err
+	}
+	syll, err := loadSyllFrom(scanner, inputPath, open)
+	return syll, jsonLocationError(err, inputPath, locations)
+}
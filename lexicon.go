@@ -0,0 +1,258 @@
+package rbg2p
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	u "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LexiconEntry is an exception lexicon entry, with one or more transcriptions for an orthographic word. Lexicon entries are looked up before the rules are applied.
+type LexiconEntry struct {
+	Orth    string
+	Transes []string
+
+	// Source is the file in which the entry was defined
+	Source string
+
+	// LineNumber is the line number of the entry in the source file
+	LineNumber int
+}
+
+// String returns a string representation of the LexiconEntry
+func (e LexiconEntry) String() string {
+	var output string
+	if len(e.Transes) == 1 {
+		output = e.Transes[0]
+	} else {
+		output = fmt.Sprintf("(%s)", strings.Join(e.Transes, ", "))
+	}
+	return fmt.Sprintf("LEXICON %s -> %s", e.Orth, output)
+}
+
+func isLexiconEntry(s string) bool {
+	return strings.HasPrefix(s, "LEXICON ")
+}
+
+func isLexiconFile(s string) bool {
+	return strings.HasPrefix(s, "LEXICON_FILE ")
+}
+
+var lexiconReSimple = regexp.MustCompile("^LEXICON +(\"[^\"]+\"|[^ \"]+) +-> +([^,()]+)$")
+var lexiconReVariants = regexp.MustCompile("^LEXICON +(\"[^\"]+\"|[^ \"]+) +-> +[(](.+,.+)[)]$")
+
+func newLexiconEntry(s string) (LexiconEntry, error) {
+	var outputS string
+	var matchRes []string
+	matchRes = lexiconReSimple.FindStringSubmatch(s)
+	if matchRes != nil {
+		outputS = matchRes[2]
+	} else {
+		matchRes = lexiconReVariants.FindStringSubmatch(s)
+		if matchRes == nil {
+			return LexiconEntry{}, fmt.Errorf("invalid LEXICON definition: %s", s)
+		}
+		outputS = matchRes[2]
+	}
+	if strings.Contains(outputS, "->") {
+		return LexiconEntry{}, fmt.Errorf("invalid LEXICON definition: %s", s)
+	}
+	input := strings.Trim(matchRes[1], "\"")
+	output := commaSplit.Split(strings.TrimSpace(outputS), -1)
+	return LexiconEntry{Orth: input, Transes: output}, nil
+}
+
+var lexiconFileRe = regexp.MustCompile("^LEXICON_FILE +\"(.+)\"$")
+
+func parseLexiconFile(s string) (string, error) {
+	matchRes := lexiconFileRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return "", fmt.Errorf("invalid LEXICON_FILE definition: %s", s)
+	}
+	return matchRes[1], nil
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// resolvePath resolves a path relative to the (file or URL) path of the file it was referenced from. A file read from an URL can only refer to other URLs (not to local files), so local absolute paths (and references resolving to other schemes than http and https) are rejected.
+func resolvePath(basePath string, path string) (string, error) {
+	if isURL(basePath) {
+		if filepath.IsAbs(path) {
+			return "", fmt.Errorf("a file read from an URL can't refer to a local file: %s", path)
+		}
+		base, err := u.Parse(basePath)
+		if err != nil {
+			return "", err
+		}
+		ref, err := u.Parse(path)
+		if err != nil {
+			return "", err
+		}
+		res := base.ResolveReference(ref).String()
+		if !isURL(res) {
+			return "", fmt.Errorf("a file read from an URL can't refer to a local file: %s", path)
+		}
+		return res, nil
+	}
+	if isURL(path) || filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Join(filepath.Dir(basePath), path), nil
+}
+
+// openPath opens a file or an URL for reading
+func openPath(path string) (io.ReadCloser, error) {
+	if isURL(path) {
+		resp, err := http.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("couldn't read %s : %s", path, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(filepath.Clean(path))
+}
+
+// readLexicon reads lexicon entries from a tab separated lexicon file: orthography <tab> transcription (additional tab separated columns are treated as transcription variants). Empty lines and lines starting with // are skipped.
+func readLexicon(r io.Reader, source string) ([]LexiconEntry, error) {
+	res := []LexiconEntry{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		l := strings.TrimSpace(scanner.Text())
+		if isBlankLine(l) || strings.HasPrefix(l, "//") {
+			continue
+		}
+		fs := strings.Split(l, "\t")
+		if len(fs) < 2 {
+			return res, &ParseError{File: source, Line: n, Column: 1, Err: fmt.Errorf("invalid lexicon entry: %s", l)}
+		}
+		entry := LexiconEntry{Orth: strings.TrimSpace(fs[0]), Source: source, LineNumber: n}
+		for _, t := range fs[1:] {
+			t = strings.TrimSpace(t)
+			if t != "" {
+				entry.Transes = append(entry.Transes, t)
+			}
+		}
+		if entry.Orth == "" || len(entry.Transes) == 0 {
+			return res, &ParseError{File: source, Line: n, Column: 1, Err: fmt.Errorf("invalid lexicon entry: %s", l)}
+		}
+		res = append(res, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// lexiconKey returns the key used to look up a word in the lexicon
+func (rs RuleSet) lexiconKey(orth string) string {
+	orth = rs.normalize(orth)
+	if rs.DowncaseInput {
+		return rs.downcase(orth)
+	}
+	return orth
+}
+
+// AddLexiconEntries adds entries to the exception lexicon. If an entry for the same word is already in the lexicon, the new transcriptions are added as variants.
+func (rs *RuleSet) AddLexiconEntries(entries []LexiconEntry) {
+	if rs.Lexicon == nil {
+		rs.Lexicon = make(map[string]LexiconEntry)
+	}
+	for _, e := range entries {
+		key := rs.lexiconKey(e.Orth)
+		if e0, ok := rs.Lexicon[key]; ok {
+			for _, t := range e.Transes {
+				if !Contains(e0.Transes, t) {
+					e0.Transes = append(e0.Transes, t)
+				}
+			}
+			rs.Lexicon[key] = e0
+			continue
+		}
+		e.Orth = key
+		rs.Lexicon[key] = e
+	}
+}
+
+// LoadLexiconFile loads entries from a tab separated lexicon file (or URL) into the exception lexicon: orthography <tab> transcription (additional tab separated columns are treated as transcription variants)
+func (rs *RuleSet) LoadLexiconFile(path string) error {
+	r, err := openPath(path)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer r.Close()
+	entries, err := readLexicon(r, path)
+	if err != nil {
+		return err
+	}
+	rs.AddLexiconEntries(entries)
+	return nil
+}
+
+// loadLexiconFile loads lexicon entries from a lexicon file referenced from the file at basePath, using the opener to resolve and read the lexicon file
+func (rs *RuleSet) loadLexiconFile(basePath string, path string, open pathOpener) error {
+	resolved, r, err := open(basePath, path)
+	if err != nil {
+		return err
+	}
+	/* #nosec G307 */
+	defer r.Close()
+	entries, err := readLexicon(r, resolved)
+	if err != nil {
+		return err
+	}
+	rs.AddLexiconEntries(entries)
+	return nil
+}
+
+// LexiconEntries returns the exception lexicon entries, sorted by orthography
+func (rs RuleSet) LexiconEntries() []LexiconEntry {
+	res := []LexiconEntry{}
+	for _, e := range rs.Lexicon {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Orth < res[j].Orth })
+	return res
+}
+
+// lookupLexicon looks up the input string in the exception lexicon
+func (rs RuleSet) lookupLexicon(s string) (LexiconEntry, bool) {
+	if len(rs.Lexicon) == 0 {
+		return LexiconEntry{}, false
+	}
+	e, ok := rs.Lexicon[rs.lexiconKey(s)]
+	return e, ok
+}
+
+// lexiconResult creates the apply result for a lexicon entry. The lexicon transcriptions are returned as is (no syllabification or filters are applied).
+func (rs RuleSet) lexiconResult(e LexiconEntry, maxVariants int) applyResult {
+	res := applyResult{}
+	for _, t := range e.Transes {
+		if maxVariants > 0 && len(res.variants) >= maxVariants {
+			res.truncated = true
+			break
+		}
+		phns, err := rs.PhonemeSet.SplitTranscription(t)
+		if err != nil || !rs.hasPhonemeSet() {
+			phns = strings.Split(t, rs.PhonemeDelimiter)
+		}
+		// the line number of a lexicon entry refers to the lexicon file, not the rule file, so it's not used for the mapping
+		tr := trans{phonemes: []g2p{{g: e.Orth, p: phns}}}
+		res.variants = append(res.variants, variant{trans: tr, sylled: rs.syllabify(tr), output: t, score: 1.0})
+	}
+	return res
+}
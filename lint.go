@@ -0,0 +1,422 @@
+package rbg2p
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Severity is the severity of a lint finding
+type Severity int
+
+const (
+	// SeverityInfo is used for findings that may be intentional
+	SeverityInfo Severity = iota
+	// SeverityWarning is used for findings that are most likely mistakes
+	SeverityWarning
+	// SeverityError is used for findings that lead to invalid output
+	SeverityError
+)
+
+// String returns a string representation of the Severity
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// ParseSeverity parses the string representation of a Severity (info, warning or error)
+func ParseSeverity(s string) (Severity, error) {
+	for _, sev := range []Severity{SeverityInfo, SeverityWarning, SeverityError} {
+		if strings.EqualFold(s, sev.String()) {
+			return sev, nil
+		}
+	}
+	return SeverityInfo, fmt.Errorf("invalid severity: %s", s)
+}
+
+// Lint check names (see RuleSet.Lint)
+const (
+	LintUnmatchableContext = "unmatchable-context"
+	LintVarOutsideCharSet  = "var-outside-character-set"
+	LintUnusedFilter       = "unused-filter"
+	LintPrefilteredInput   = "prefiltered-rule-input"
+	LintSyllDefPhonemeSet  = "sylldef-phoneme-set"
+)
+
+// lintMaxCharClassSize is the maximum size of a character class for its characters to be checked against the character set (larger classes, e.g. negated classes, are skipped)
+const lintMaxCharClassSize = 256
+
+// LintFinding is a potential problem in a rule set, as reported by RuleSet.Lint
+type LintFinding struct {
+	Severity Severity
+
+	// Check is the name of the check reporting the finding, e.g. "unmatchable-context"
+	Check string
+
+	// LineNumber is the line number in the rule file (0 if unknown)
+	LineNumber int
+
+	Message string
+}
+
+// String returns a string representation of the LintFinding
+func (f LintFinding) String() string {
+	return fmt.Sprintf("line %d: %s: %s [%s]", f.LineNumber, f.Severity, f.Message, f.Check)
+}
+
+// Lint runs static checks on the rule set, going beyond the built-in tests (see RuleSet.Test), and returns the findings sorted by line number:
+//
+//   - rule contexts that can never match, since they require characters outside the character set (unmatchable-context)
+//   - VARs used in rule contexts that match characters outside the character set (var-outside-character-set)
+//   - FILTERs that don't match any of the transcriptions produced for the TEST inputs (unused-filter)
+//   - rule inputs containing characters that are always replaced by a PREFILTER (prefiltered-rule-input)
+//   - SYLLDEF symbols missing from the PHONEME_SET (sylldef-phoneme-set)
+//
+// Regular expressions that can't be analysed (e.g. using lookarounds) are skipped. Line numbers for VARs and SYLLDEF symbols are looked up in RuleSet.Content.
+func (rs RuleSet) Lint() []LintFinding {
+	res := []LintFinding{}
+	alphabet := rs.lintAlphabet()
+	res = append(res, rs.lintContexts(alphabet)...)
+	res = append(res, rs.lintVars(alphabet)...)
+	res = append(res, rs.lintFilters()...)
+	res = append(res, rs.lintPrefilteredInputs()...)
+	res = append(res, rs.lintSyllDef()...)
+	sort.SliceStable(res, func(i, j int) bool { return res[i].LineNumber < res[j].LineNumber })
+	return res
+}
+
+// lintAlphabet returns the characters that may occur in the (prefiltered) input: the characters of the character set, and the characters inserted by the prefilters
+func (rs RuleSet) lintAlphabet() map[rune]bool {
+	res := make(map[rune]bool)
+	for _, c := range rs.CharacterSet {
+		for _, r := range c {
+			res[r] = true
+		}
+	}
+	for _, pf := range rs.Prefilters {
+		for _, r := range pf.Output {
+			res[r] = true
+		}
+	}
+	return res
+}
+
+// contentLineNumber returns the number of the first line in RuleSet.Content starting with the specified fields (0 if not found)
+func (rs RuleSet) contentLineNumber(fields ...string) int {
+	for i, l := range strings.Split(rs.Content, "\n") {
+		fs := strings.Fields(trimComment(l))
+		if len(fs) >= len(fields) && strings.Join(fs[0:len(fields)], " ") == strings.Join(fields, " ") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// parseLintRegexp parses a regexp for analysis, or returns false if the regexp can't be parsed using the Go regexp syntax
+func parseLintRegexp(re string) (*syntax.Regexp, bool) {
+	res, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	return res.Simplify(), true
+}
+
+// inAlphabet returns true if the rune (or, for case folded regexps, any of its case variants) is in the alphabet
+func inAlphabet(r rune, foldCase bool, alphabet map[rune]bool) bool {
+	if alphabet[r] {
+		return true
+	}
+	if foldCase {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if alphabet[f] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classInAlphabet returns true if any character in the alphabet is included in the character class
+func classInAlphabet(re *syntax.Regexp, alphabet map[rune]bool) bool {
+	for a := range alphabet {
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if a >= re.Rune[i] && a <= re.Rune[i+1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canMatch returns true if the regexp can match a string consisting of characters in the alphabet only
+func canMatch(re *syntax.Regexp, alphabet map[rune]bool) bool {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return false
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if !inAlphabet(r, re.Flags&syntax.FoldCase != 0, alphabet) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpCharClass:
+		return classInAlphabet(re, alphabet)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return len(alphabet) > 0
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !canMatch(sub, alphabet) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if canMatch(sub, alphabet) {
+				return true
+			}
+		}
+		return false
+	case syntax.OpCapture, syntax.OpPlus:
+		return canMatch(re.Sub[0], alphabet)
+	case syntax.OpRepeat:
+		return re.Min == 0 || canMatch(re.Sub[0], alphabet)
+	}
+	// empty matches, anchors, word boundaries, star and quest
+	return true
+}
+
+// regexpChars returns the characters explicitly matched by the regexp (literals, and character classes with at most lintMaxCharClassSize characters)
+func regexpChars(re *syntax.Regexp, res map[rune]bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			res[r] = true
+		}
+	case syntax.OpCharClass:
+		size := 0
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			size += int(re.Rune[i+1]-re.Rune[i]) + 1
+		}
+		if size > lintMaxCharClassSize {
+			return
+		}
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				res[r] = true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		regexpChars(sub, res)
+	}
+}
+
+func (rs RuleSet) lintContexts(alphabet map[rune]bool) []LintFinding {
+	res := []LintFinding{}
+	for _, r := range rs.Rules {
+		for _, c := range []struct {
+			name    string
+			context Context
+		}{{"left", r.LeftContext}, {"right", r.RightContext}} {
+			if !c.context.IsDefined() {
+				continue
+			}
+			re, ok := parseLintRegexp(c.context.Regexp.String())
+			if ok && !canMatch(re, alphabet) {
+				res = append(res, LintFinding{Severity: SeverityWarning, Check: LintUnmatchableContext, LineNumber: r.LineNumber,
+					Message: fmt.Sprintf("%s context of rule %s can never match, since it requires characters outside the character set", c.name, r)})
+			}
+		}
+	}
+	return res
+}
+
+// contextVars returns the names of the variables used in the rule contexts
+func (rs RuleSet) contextVars() map[string]bool {
+	res := make(map[string]bool)
+	for _, r := range rs.Rules {
+		for _, c := range []Context{r.LeftContext, r.RightContext} {
+			for _, s := range strings.Fields(c.Input) {
+				if _, ok := rs.Vars[s]; ok {
+					res[s] = true
+				}
+			}
+		}
+	}
+	return res
+}
+
+func (rs RuleSet) lintVars(alphabet map[rune]bool) []LintFinding {
+	res := []LintFinding{}
+	used := rs.contextVars()
+	names := []string{}
+	for name := range rs.Vars {
+		if used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, ok := parseLintRegexp(rs.Vars[name])
+		if !ok {
+			continue
+		}
+		chars := make(map[rune]bool)
+		regexpChars(re, chars)
+		outside := []string{}
+		for r := range chars {
+			if !inAlphabet(r, re.Flags&syntax.FoldCase != 0, alphabet) {
+				outside = append(outside, string(r))
+			}
+		}
+		if len(outside) > 0 {
+			sort.Strings(outside)
+			res = append(res, LintFinding{Severity: SeverityWarning, Check: LintVarOutsideCharSet, LineNumber: rs.contentLineNumber("VAR", name),
+				Message: fmt.Sprintf("VAR %s matches character(s) outside the character set: %s", name, strings.Join(outside, " "))})
+		}
+	}
+	return res
+}
+
+// lintFilters reports the filters that don't match any of the transcriptions produced for the test inputs (before the filter is applied)
+func (rs RuleSet) lintFilters() []LintFinding {
+	res := []LintFinding{}
+	if len(rs.Tests) == 0 || len(rs.Filters) == 0 {
+		return res
+	}
+	// the test inputs are not counted in the coverage counts
+	lrs := rs
+	lrs.CollectCoverage = false
+	matched := make([]bool, len(rs.Filters))
+	for _, test := range rs.Tests {
+		words := []string{test.Input}
+		if rs.isPhrase(test.Input) {
+			words = rs.Tokenize(test.Input)
+		}
+		for _, w := range words {
+			trace, err := lrs.Explain(w)
+			if err != nil && len(trace.Variants) == 0 {
+				continue
+			}
+			for _, v := range trace.Variants {
+				for i, step := range v.Filters {
+					if i >= len(rs.Filters) || matched[i] {
+						continue
+					}
+					if ok, err := rs.Filters[i].Regexp.MatchString(step.Before); err == nil && ok {
+						matched[i] = true
+					}
+				}
+			}
+		}
+	}
+	for i, f := range rs.Filters {
+		if !matched[i] {
+			res = append(res, LintFinding{Severity: SeverityInfo, Check: LintUnusedFilter, LineNumber: f.LineNumber,
+				Message: fmt.Sprintf("FILTER %s doesn't match any of the transcriptions for the TEST inputs", f)})
+		}
+	}
+	return res
+}
+
+// singleCharRegexp returns the regexp node matching a single character (possibly repeated using +), or false if the regexp is not that simple
+func singleCharRegexp(re *syntax.Regexp) (*syntax.Regexp, bool) {
+	for re.Op == syntax.OpCapture || re.Op == syntax.OpPlus {
+		re = re.Sub[0]
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		return re, len(re.Rune) == 1
+	case syntax.OpCharClass:
+		return re, true
+	}
+	return re, false
+}
+
+// replacedBy returns true if every occurrence of the character is replaced by the (single character) regexp
+func replacedBy(r rune, re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral {
+		return inAlphabet(re.Rune[0], re.Flags&syntax.FoldCase != 0, map[rune]bool{r: true})
+	}
+	return classInAlphabet(re, map[rune]bool{r: true})
+}
+
+// lintPrefilteredInputs reports rules with an input containing characters that are always replaced by a prefilter (i.e., a prefilter matching the character regardless of context, with an output that doesn't contain the character), since such rules can never match
+func (rs RuleSet) lintPrefilteredInputs() []LintFinding {
+	res := []LintFinding{}
+	for _, r := range rs.Rules {
+	rule:
+		for _, c := range r.Input {
+			for pfi, pf := range rs.Prefilters {
+				re, ok := parseLintRegexp(pf.Regexp.String())
+				if !ok {
+					continue
+				}
+				re, ok = singleCharRegexp(re)
+				if !ok || !replacedBy(c, re) || strings.ContainsRune(pf.Output, c) {
+					continue
+				}
+				reinserted := false
+				for _, pf2 := range rs.Prefilters[pfi+1:] {
+					if strings.ContainsRune(pf2.Output, c) {
+						reinserted = true
+					}
+				}
+				if reinserted {
+					continue
+				}
+				res = append(res, LintFinding{Severity: SeverityWarning, Check: LintPrefilteredInput, LineNumber: r.LineNumber,
+					Message: fmt.Sprintf("rule %s can never match, since %q is always replaced by the PREFILTER on line %d", r, c, pf.LineNumber)})
+				break rule
+			}
+		}
+	}
+	return res
+}
+
+// lintSyllDef reports the symbols of the syllable definition (onsets, syllabic phonemes and stress symbols) that are not in the phoneme set
+func (rs RuleSet) lintSyllDef() []LintFinding {
+	res := []LintFinding{}
+	if !rs.hasPhonemeSet() || !rs.Syllabifier.IsDefined() {
+		return res
+	}
+	def, ok := rs.Syllabifier.SyllDef.(MOPSyllDef)
+	if !ok {
+		return res
+	}
+	check := func(field string, symbols []string) {
+		missing := []string{}
+		for _, s := range symbols {
+			if !Contains(rs.PhonemeSet.Symbols, s) && !Contains(missing, s) {
+				missing = append(missing, s)
+			}
+		}
+		if len(missing) > 0 {
+			res = append(res, LintFinding{Severity: SeverityError, Check: LintSyllDefPhonemeSet, LineNumber: rs.contentLineNumber("SYLLDEF", field),
+				Message: fmt.Sprintf("SYLLDEF %s symbol(s) missing from the phoneme set: %s", field, strings.Join(missing, " "))})
+		}
+	}
+	onsetPhonemes := []string{}
+	for _, onset := range def.Onsets {
+		phns, err := rs.splitPhonemes(onset)
+		if err != nil {
+			phns = strings.Fields(onset)
+		}
+		onsetPhonemes = append(onsetPhonemes, phns...)
+	}
+	check("ONSETS", onsetPhonemes)
+	check("SYLLABIC", def.Syllabic)
+	check("STRESS", def.Stress)
+	return res
+}
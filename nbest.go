@@ -0,0 +1,120 @@
+package rbg2p
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// rankedState is a selection of variant outputs in the ranked variant iterator
+type rankedState struct {
+	ranks    []int // for each chunk, the index in the chunk's sorted outputs
+	selected []int // for each chunk, the index in the chunk's original outputs
+	lastInc  int
+	score    float64
+}
+
+// less is used to break ties between states with the same score (in rule output order)
+func (s rankedState) less(s2 rankedState) bool {
+	for i := range s.selected {
+		if s.selected[i] != s2.selected[i] {
+			return s.selected[i] < s2.selected[i]
+		}
+	}
+	return false
+}
+
+type rankedQueue []rankedState
+
+func (q rankedQueue) Len() int { return len(q) }
+func (q rankedQueue) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+	return q[i].less(q[j])
+}
+func (q rankedQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *rankedQueue) Push(x interface{}) { *q = append(*q, x.(rankedState)) }
+func (q *rankedQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[0 : n-1]
+	return x
+}
+
+// rankedVariantIterator generates the transcription variants lazily, in order of descending score (best first). Since each chunk's outputs are sorted by weight, a selection's score is never higher than the score of the selection it was derived from, and each selection is derived from exactly one other selection.
+type rankedVariantIterator struct {
+	chunks   []g2p
+	phnDelim string
+	sorted   [][]int // for each chunk, the output indices sorted by descending weight
+	queue    *rankedQueue
+}
+
+func newRankedVariantIterator(chunks []g2p, phnDelim string) *rankedVariantIterator {
+	it := &rankedVariantIterator{chunks: chunks, phnDelim: phnDelim, queue: &rankedQueue{}}
+	if len(chunks) == 0 {
+		return it
+	}
+	for _, c := range chunks {
+		if len(c.p) == 0 {
+			return it
+		}
+		indices := make([]int, len(c.p))
+		for i := range indices {
+			indices[i] = i
+		}
+		sort.SliceStable(indices, func(i, j int) bool {
+			return c.weight(indices[i]) > c.weight(indices[j])
+		})
+		it.sorted = append(it.sorted, indices)
+	}
+	heap.Push(it.queue, it.newState(make([]int, len(chunks)), 0))
+	return it
+}
+
+func (it *rankedVariantIterator) newState(ranks []int, lastInc int) rankedState {
+	res := rankedState{ranks: ranks, lastInc: lastInc, score: 1.0}
+	for i, r := range ranks {
+		res.selected = append(res.selected, it.sorted[i][r])
+		res.score *= it.chunks[i].weight(it.sorted[i][r])
+	}
+	return res
+}
+
+func (it *rankedVariantIterator) next() (trans, float64, bool) {
+	if it.queue.Len() == 0 {
+		return trans{}, 0, false
+	}
+	state := heap.Pop(it.queue).(rankedState)
+	for i := state.lastInc; i < len(state.ranks); i++ {
+		if state.ranks[i]+1 < len(it.sorted[i]) {
+			ranks := make([]int, len(state.ranks))
+			copy(ranks, state.ranks)
+			ranks[i]++
+			heap.Push(it.queue, it.newState(ranks, i))
+		}
+	}
+	res, score := buildVariant(it.chunks, state.selected, it.phnDelim)
+	return res, score, true
+}
+
+// ScoredTrans is a transcription with a score. The score is the product of the weights of the variant outputs used to create the transcription (see the rule syntax for weights).
+type ScoredTrans struct {
+	Trans string
+	Score float64
+}
+
+// ApplyNBest applies the rules to an input string, and returns the n best transcriptions, ranked by their score (if n < 1, all transcriptions are returned, limited by RuleSet.MaxVariants, if set). Identical transcriptions are only returned once, with the highest score. Errors are handled in the same way as for RuleSet.Apply.
+func (rs RuleSet) ApplyNBest(s string, n int) ([]ScoredTrans, error) {
+	opts := rs.newApplyOpts()
+	opts.ranked = true
+	if n > 0 {
+		opts.maxVariants = n
+	}
+	res, err := rs.apply(s, opts)
+	scored := []ScoredTrans{}
+	for _, v := range res.variants {
+		scored = append(scored, ScoredTrans{Trans: v.output, Score: v.score})
+	}
+	return scored, err
+}
@@ -0,0 +1,59 @@
+package rbg2p
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizationForms holds the supported Unicode normalization forms (see RuleSet.Normalization)
+var normalizationForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+func isNormalization(s string) bool {
+	return strings.HasPrefix(s, "NORMALIZATION ")
+}
+
+func parseNormalization(value string) (string, error) {
+	form := strings.ToUpper(value)
+	if _, ok := normalizationForms[form]; !ok {
+		forms := []string{}
+		for f := range normalizationForms {
+			forms = append(forms, f)
+		}
+		sort.Strings(forms)
+		return "", fmt.Errorf("invalid value for NORMALIZATION: %s (expected one of %s)", value, strings.Join(forms, ", "))
+	}
+	return form, nil
+}
+
+// normalize converts the input string to the normalization form of the rule set (if any)
+func (rs RuleSet) normalize(s string) string {
+	if form, ok := normalizationForms[rs.Normalization]; ok {
+		return form.String(s)
+	}
+	return s
+}
+
+// checkNormalForms returns a warning if the input lines mix precomposed characters (that would be changed by NFD normalization) and decomposed character sequences (that would be changed by NFC normalization)
+func checkNormalForms(lines []string) []string {
+	var composed, decomposed []string
+	for i, l := range lines {
+		if !norm.NFD.IsNormalString(l) {
+			composed = append(composed, fmt.Sprintf("%d", i+1))
+		}
+		if !norm.NFC.IsNormalString(l) {
+			decomposed = append(decomposed, fmt.Sprintf("%d", i+1))
+		}
+	}
+	if len(composed) > 0 && len(decomposed) > 0 {
+		return []string{fmt.Sprintf("rule file mixes Unicode normal forms: precomposed characters on line(s) %s, decomposed characters on line(s) %s", strings.Join(composed, ", "), strings.Join(decomposed, ", "))}
+	}
+	return []string{}
+}
@@ -0,0 +1,326 @@
+package rbg2p
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var baseRe = regexp.MustCompile("^BASE +\"(.+)\"$")
+
+func isBase(s string) bool {
+	return strings.HasPrefix(s, "BASE ")
+}
+
+func parseBase(s string) (string, error) {
+	matchRes := baseRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return "", fmt.Errorf("invalid BASE definition: %s", s)
+	}
+	return matchRes[1], nil
+}
+
+// labels can't start with a digit, since overlay references starting with a digit are line numbers
+var labelRe = regexp.MustCompile("^LABEL +([^ \"0-9][^ \"]*)$")
+
+func isLabel(s string) bool {
+	return strings.HasPrefix(s, "LABEL ")
+}
+
+func parseLabel(s string) (string, error) {
+	matchRes := labelRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return "", fmt.Errorf("invalid LABEL definition: %s", s)
+	}
+	return matchRes[1], nil
+}
+
+var insertRe = regexp.MustCompile("^INSERT +(BEFORE|AFTER) +([^ ]+) +([^ ].*)$")
+var replaceRe = regexp.MustCompile("^REPLACE +([^ ]+) +([^ ].*)$")
+var deleteRe = regexp.MustCompile("^DELETE +([^ ]+)$")
+
+func isOverlayEdit(s string) bool {
+	return strings.HasPrefix(s, "INSERT ") || strings.HasPrefix(s, "REPLACE ") || strings.HasPrefix(s, "DELETE ")
+}
+
+// overlayEdit is an INSERT, REPLACE or DELETE directive of an overlay file
+type overlayEdit struct {
+	// op is BEFORE or AFTER (for INSERT), REPLACE or DELETE
+	op string
+
+	// ref is the base rule referred to: a line number in the base file, or a label
+	ref string
+
+	// rule is the inserted (or replacing) rule
+	rule string
+
+	// label is the label of the inserted rule (from a LABEL directive preceding the INSERT), and labelIndex is the index of the LABEL line in the overlay
+	label      string
+	labelIndex int
+
+	// index is the index of the directive line in the overlay
+	index int
+}
+
+func newOverlayEdit(s string) (overlayEdit, error) {
+	if m := insertRe.FindStringSubmatch(s); m != nil {
+		return overlayEdit{op: m[1], ref: m[2], rule: m[3]}, nil
+	}
+	if m := replaceRe.FindStringSubmatch(s); m != nil {
+		return overlayEdit{op: "REPLACE", ref: m[1], rule: m[2]}, nil
+	}
+	if m := deleteRe.FindStringSubmatch(s); m != nil {
+		return overlayEdit{op: "DELETE", ref: m[1]}, nil
+	}
+	return overlayEdit{}, fmt.Errorf("invalid overlay definition: %s", s)
+}
+
+// readRuleSource reads the lines of a g2p rule file along with their source positions (see readSource). If the file is an overlay file (with a BASE directive), the base rule set is read (recursively, since the base may be an overlay file too), and the lines of the derived rule set are returned (see applyOverlay), along with the resolved path of the base rule set.
+func readRuleSource(scanner *bufio.Scanner, inputPath string, open pathOpener, stack []string) ([]string, []SourceLine, string, error) {
+	lines, sources, err := readSource(scanner, inputPath, open, stack)
+	if err != nil {
+		return lines, sources, "", err
+	}
+	baseIndex := -1
+	for i, line := range lines {
+		l := trimComment(strings.TrimSpace(line))
+		if !isBase(l) {
+			continue
+		}
+		if baseIndex >= 0 {
+			return lines, sources, "", parseError(sources[i].File, sources[i].Line, line, fmt.Errorf("multiple BASE definitions in overlay file %s", inputPath))
+		}
+		baseIndex = i
+	}
+	if baseIndex < 0 {
+		return lines, sources, "", nil
+	}
+	baseLine, baseSource := lines[baseIndex], sources[baseIndex]
+	baseError := func(err error) error {
+		return parseError(baseSource.File, baseSource.Line, baseLine, err)
+	}
+	p, err := parseBase(trimComment(strings.TrimSpace(baseLine)))
+	if err != nil {
+		return lines, sources, "", baseError(err)
+	}
+	resolved, r, err := open(baseSource.File, p)
+	if err != nil {
+		return lines, sources, "", baseError(fmt.Errorf("couldn't read base rule set %s : %v", p, err))
+	}
+	if err := checkCycle("base", stack, resolved); err != nil {
+		r.Close()
+		return lines, sources, "", baseError(err)
+	}
+	baseLines, baseSources, _, err := readRuleSource(bufio.NewScanner(r), resolved, open, append(stack, sourceKey(resolved)))
+	r.Close()
+	if err != nil {
+		return lines, sources, "", err
+	}
+	// lines inherited from an overlay used as base rule set are base lines of this overlay
+	for i := range baseSources {
+		baseSources[i].Overlay = false
+	}
+	for i := range sources {
+		sources[i].Overlay = true
+	}
+	resLines, resSources, err := applyOverlay(baseLines, baseSources, resolved, lines, sources)
+	return resLines, resSources, resolved, err
+}
+
+// applyOverlay returns the lines (and source positions) of the rule set derived from the base rule set lines (read from basePath) and the overlay lines:
+//
+//   - rules are inserted, replaced and deleted according to the INSERT, REPLACE and DELETE directives of the overlay
+//   - if the overlay has any FILTER (or PREFILTER) definitions, they replace the filters (or prefilters) of the base rule set
+//   - a TEST in the overlay replaces the base tests for the same input
+//   - VAR, PHONEME_VAR, FILTER, PREFILTER and TEST definitions of the overlay are added after the base lines
+func applyOverlay(base []string, baseSources []SourceLine, basePath string, overlay []string, overlaySources []SourceLine) ([]string, []SourceLine, error) {
+	overlayError := func(i int, err error) error {
+		return parseError(overlaySources[i].File, overlaySources[i].Line, overlay[i], err)
+	}
+
+	edits := []overlayEdit{}
+	added := []int{}
+	hasFilters, hasPrefilters := false, false
+	testInputs := make(map[string]bool)
+	label, labelIndex := "", -1
+	for i, line := range overlay {
+		l := trimComment(strings.TrimSpace(line))
+		if isBlankLine(l) || isComment(l) || isBase(l) {
+			continue
+		}
+		if label != "" && !isOverlayEdit(l) {
+			return nil, nil, overlayError(labelIndex, fmt.Errorf("LABEL %s must be followed by an INSERT definition", label))
+		}
+		switch {
+		case isLabel(l):
+			name, err := parseLabel(l)
+			if err != nil {
+				return nil, nil, overlayError(i, err)
+			}
+			label, labelIndex = name, i
+		case isOverlayEdit(l):
+			e, err := newOverlayEdit(l)
+			if err != nil {
+				return nil, nil, overlayError(i, err)
+			}
+			if label != "" && e.op != "BEFORE" && e.op != "AFTER" {
+				return nil, nil, overlayError(labelIndex, fmt.Errorf("LABEL %s must be followed by an INSERT definition", label))
+			}
+			e.index, e.label, e.labelIndex = i, label, labelIndex
+			edits = append(edits, e)
+			label, labelIndex = "", -1
+		case isTest(l):
+			t, err := newTest(l)
+			if err != nil {
+				return nil, nil, overlayError(i, err)
+			}
+			testInputs[t.Input] = true
+			added = append(added, i)
+		case isFilter(l), isPrefilter(l), isVar(l), isPhonemeVar(l):
+			hasFilters = hasFilters || isFilter(l)
+			hasPrefilters = hasPrefilters || isPrefilter(l)
+			added = append(added, i)
+		default:
+			return nil, nil, overlayError(i, fmt.Errorf("invalid overlay definition (only BASE, INSERT, REPLACE, DELETE, LABEL, VAR, PHONEME_VAR, FILTER, PREFILTER and TEST are allowed): %s", l))
+		}
+	}
+	if label != "" {
+		return nil, nil, overlayError(labelIndex, fmt.Errorf("LABEL %s must be followed by an INSERT definition", label))
+	}
+
+	// the base rules, and the labels of the base rules (a LABEL line labels the rule following it)
+	isRule := make(map[int]bool)
+	labels := make(map[string]int)
+	labelLines := make(map[int]int) // rule index -> label line index
+	pendingLabel, pendingLabelIndex := "", -1
+	for i, line := range base {
+		l := trimComment(strings.TrimSpace(line))
+		if isBlankLine(l) || isComment(l) {
+			continue
+		}
+		if isRuleLine(l) {
+			isRule[i] = true
+			if pendingLabel != "" {
+				if _, ok := labels[pendingLabel]; !ok {
+					labels[pendingLabel] = i
+				}
+				labelLines[i] = pendingLabelIndex
+			}
+		}
+		pendingLabel, pendingLabelIndex = "", -1
+		if isLabel(l) {
+			if name, err := parseLabel(l); err == nil {
+				pendingLabel, pendingLabelIndex = name, i
+			}
+		}
+	}
+	// refIndex returns the index of the base rule referred to by a line number (in the base file) or a label. A line number can only refer to a rule defined in the base file itself, not to a rule read from a file included by the base file (or from the base of the base rule set).
+	refIndex := func(ref string) (int, error) {
+		if lineNo, err := strconv.Atoi(ref); err == nil {
+			maxLine := 0
+			for i, s := range baseSources {
+				if s.File != basePath {
+					continue
+				}
+				if s.Line == lineNo {
+					if !isRule[i] {
+						return -1, fmt.Errorf("line %d of base rule set %s is not a rule", lineNo, basePath)
+					}
+					return i, nil
+				}
+				maxLine = max(maxLine, s.Line)
+			}
+			if lineNo > 0 && lineNo < maxLine {
+				return -1, fmt.Errorf("line %d of base rule set %s is not a rule defined in that file (rules read from files included by the base rule set, or from its base rule set, can only be referred to by label)", lineNo, basePath)
+			}
+			return -1, fmt.Errorf("no line %d in base rule set %s", lineNo, basePath)
+		}
+		if i, ok := labels[ref]; ok {
+			return i, nil
+		}
+		return -1, fmt.Errorf("undefined label %s in base rule set %s", ref, basePath)
+	}
+
+	before := make(map[int][]overlayEdit)
+	after := make(map[int][]overlayEdit)
+	replaced := make(map[int]overlayEdit)
+	deleted := make(map[int]bool)
+	for _, e := range edits {
+		i, err := refIndex(e.ref)
+		if err != nil {
+			return nil, nil, overlayError(e.index, err)
+		}
+		switch e.op {
+		case "BEFORE":
+			before[i] = append(before[i], e)
+		case "AFTER":
+			after[i] = append(after[i], e)
+		default:
+			if _, ok := replaced[i]; ok || deleted[i] {
+				return nil, nil, overlayError(e.index, fmt.Errorf("base rule %s is already replaced or deleted", e.ref))
+			}
+			if e.op == "REPLACE" {
+				replaced[i] = e
+			} else {
+				deleted[i] = true
+			}
+		}
+	}
+
+	lines := []string{}
+	sources := []SourceLine{}
+	add := func(line string, source SourceLine) {
+		lines = append(lines, line)
+		sources = append(sources, source)
+	}
+	insert := func(edits []overlayEdit) {
+		for _, e := range edits {
+			if e.label != "" {
+				add("LABEL "+e.label, overlaySources[e.labelIndex])
+			}
+			add(e.rule, overlaySources[e.index])
+		}
+	}
+	labelled := make(map[int]int) // label line index -> rule index
+	for r, i := range labelLines {
+		labelled[i] = r
+	}
+	for i, line := range base {
+		l := trimComment(strings.TrimSpace(line))
+		switch {
+		case hasFilters && isFilter(l), hasPrefilters && isPrefilter(l):
+			continue
+		case isTest(l):
+			if t, err := newTest(l); err == nil && testInputs[t.Input] {
+				continue
+			}
+		}
+		// rules inserted before a labelled rule are inserted before its label
+		if r, ok := labelled[i]; ok {
+			insert(before[r])
+			if !deleted[r] {
+				add(line, baseSources[i])
+			}
+			continue
+		}
+		if !isRule[i] {
+			add(line, baseSources[i])
+			continue
+		}
+		if _, ok := labelLines[i]; !ok {
+			insert(before[i])
+		}
+		if e, ok := replaced[i]; ok {
+			add(e.rule, overlaySources[e.index])
+		} else if !deleted[i] {
+			add(line, baseSources[i])
+		}
+		insert(after[i])
+	}
+	for _, i := range added {
+		add(overlay[i], overlaySources[i])
+	}
+	return lines, sources, nil
+}
@@ -0,0 +1,486 @@
+package rbg2p
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+)
+
+// PhonemeRule is a rewrite rule operating on the phoneme tokens of a transcription (after the g2p rules have been applied), using the same "A -> B / L _ R" syntax as the g2p rules. The input, output and context are space separated sequences of phonemes and phoneme variables (see PHONEME_VAR). If the rule is defined with the SYLL_PHONEME_RULE prefix, it is applied after syllabification, and may refer to syllable delimiters and stress symbols.
+type PhonemeRule struct {
+	// Input is the sequence of input phonemes (or phoneme variables), as written in the rule (empty for insertion rules)
+	Input []string
+
+	// Output is the sequence of output phonemes (empty for deletion rules)
+	Output []string
+
+	LeftContext  Context
+	RightContext Context
+
+	// AfterSyllabification is true if the rule is applied to the syllabified transcription
+	AfterSyllabification bool
+
+	LineNumber int
+
+	// input is the set of phonemes matched by each input token
+	input []map[string]bool
+}
+
+// String returns a string representation of the PhonemeRule
+func (r PhonemeRule) String() string {
+	prefix := "PHONEME_RULE"
+	if r.AfterSyllabification {
+		prefix = "SYLL_PHONEME_RULE"
+	}
+	input := emptyOutput
+	if len(r.Input) > 0 {
+		input = strings.Join(r.Input, " ")
+	}
+	output := emptyOutput
+	if len(r.Output) > 0 {
+		output = strings.Join(r.Output, " ")
+	}
+	return fmt.Sprintf("%s %s -> %s / %s _ %s", prefix, input, output, r.LeftContext, r.RightContext)
+}
+
+// matchInput returns true if the input tokens match the rule input
+func (r PhonemeRule) matchInput(tokens []string) bool {
+	if len(tokens) < len(r.input) {
+		return false
+	}
+	for i, set := range r.input {
+		if !set[tokens[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+func isPhonemeRule(s string) bool {
+	return strings.HasPrefix(s, "PHONEME_RULE ") || strings.HasPrefix(s, "SYLL_PHONEME_RULE ")
+}
+
+func isPhonemeVar(s string) bool {
+	return strings.HasPrefix(s, "PHONEME_VAR ")
+}
+
+var phonemeVarRe = regexp.MustCompile("^PHONEME_VAR +([^ \"]+) +\"(.+)\"$")
+
+// newPhonemeVar parses a phoneme variable definition: PHONEME_VAR NAME "<space separated phonemes>"
+func newPhonemeVar(s string) (string, []string, error) {
+	matchRes := phonemeVarRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return "", nil, fmt.Errorf("invalid PHONEME_VAR definition: %s", s)
+	}
+	name := matchRes[1]
+	if strings.Contains(name, "_") {
+		return "", nil, fmt.Errorf("invalid PHONEME_VAR input - var names cannot contain underscore: %s", s)
+	}
+	value := strings.Fields(strings.Replace(matchRes[2], "\\\"", "\"", -1))
+	if len(value) == 0 {
+		return "", nil, fmt.Errorf("invalid PHONEME_VAR definition: %s", s)
+	}
+	return name, value, nil
+}
+
+// phonemeTokenDelimiter is used to delimit the phoneme tokens when a phoneme sequence is matched against a context regexp
+const phonemeTokenDelimiter = "\u001f"
+
+func encodePhonemeTokens(tokens []string) string {
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteString(t)
+		sb.WriteString(phonemeTokenDelimiter)
+	}
+	return sb.String()
+}
+
+// phonemeSetRegexp returns a regexp matching any of the phonemes in the input set
+func phonemeSetRegexp(phonemes []string) string {
+	alts := []string{}
+	for _, p := range phonemes {
+		alts = append(alts, regexp2.Escape(p)+phonemeTokenDelimiter)
+	}
+	return "(?:" + strings.Join(alts, "|") + ")"
+}
+
+var phonemeContextQuantifierRe = regexp.MustCompile("^(.+)([*+?])$")
+
+// newPhonemeContext converts a phoneme rule context to a regexp over the encoded phoneme tokens. Context tokens are phonemes, phoneme variables (optionally followed by a quantifier *, + or ?), or # for word boundary.
+func newPhonemeContext(s string, isLeft bool, vars map[string][]string) (Context, usedVars, error) {
+	usedVars := usedVars{}
+	if s == "" {
+		return Context{}, usedVars, nil
+	}
+	var res []string
+	for _, t := range strings.Fields(s) {
+		if t == "#" {
+			if isLeft {
+				res = append(res, "^")
+			} else {
+				res = append(res, "$")
+			}
+			continue
+		}
+		quantifier := ""
+		if m := phonemeContextQuantifierRe.FindStringSubmatch(t); m != nil {
+			if _, ok := vars[m[1]]; ok {
+				t = m[1]
+				quantifier = m[2]
+			}
+		}
+		if val, ok := vars[t]; ok {
+			res = append(res, phonemeSetRegexp(val)+quantifier)
+			usedVars[t]++
+		} else {
+			res = append(res, phonemeSetRegexp([]string{t}))
+		}
+	}
+	reS := strings.Join(res, "")
+	if isLeft {
+		reS += "$"
+	} else {
+		reS = "^" + reS
+	}
+	re, err := regexp2.Compile(reS, regexp2.None)
+	if err != nil {
+		return Context{}, usedVars, err
+	}
+	return Context{Input: s, Regexp: re}, usedVars, nil
+}
+
+// anchorPhonemeContexts recompiles the phonological contexts of the rules, if they were compiled for the other rule application direction (a phonological context is a left context for left-to-right rule application, and a right context for right-to-left rule application; see RuleSet.RightToLeft). The rules are copied before they are modified, since they are shared between copies of the rule set.
+func (rs *RuleSet) anchorPhonemeContexts() error {
+	if rs.phonemeContextsRightToLeft == rs.RightToLeft {
+		return nil
+	}
+	if rs.hasPhonemeContexts() {
+		reTimeout := rs.MatchTimeout
+		if reTimeout <= 0 {
+			reTimeout = regexp2.DefaultMatchTimeout
+		}
+		rules := make([]Rule, 0, len(rs.Rules))
+		for _, r := range rs.Rules {
+			if r.PhonemeContext.IsDefined() {
+				c, _, err := newPhonemeContext(r.PhonemeContext.Input, !rs.RightToLeft, rs.PhonemeVars)
+				if err != nil {
+					return fmt.Errorf("invalid phonological context definition %s : %v", r, err)
+				}
+				c.Regexp.MatchTimeout = reTimeout
+				r.PhonemeContext = c
+			}
+			rules = append(rules, r)
+		}
+		rs.Rules = rules
+	}
+	rs.phonemeContextsRightToLeft = rs.RightToLeft
+	return nil
+}
+
+var phonemeRuleRe = regexp.MustCompile("^(PHONEME_RULE|SYLL_PHONEME_RULE) +(.+?) +-> +(.+?)(?: +/ +(.*))?$")
+
+func splitPhonemeRuleTokens(s string) []string {
+	if s == emptyOutput {
+		return []string{}
+	}
+	return strings.Fields(s)
+}
+
+func newPhonemeRule(s string, vars map[string][]string) (PhonemeRule, usedVars, error) {
+	usedVars := usedVars{}
+	matchRes := phonemeRuleRe.FindStringSubmatch(s)
+	if matchRes == nil {
+		return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule definition: %s", s)
+	}
+	res := PhonemeRule{AfterSyllabification: matchRes[1] == "SYLL_PHONEME_RULE"}
+	res.Input = splitPhonemeRuleTokens(matchRes[2])
+	res.Output = splitPhonemeRuleTokens(matchRes[3])
+	if strings.Contains(matchRes[3], "->") || strings.ContainsAny(matchRes[3], "(),") {
+		return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule output definition (variants are not allowed): %s", s)
+	}
+	for _, t := range res.Input {
+		if val, ok := vars[t]; ok {
+			set := make(map[string]bool)
+			for _, p := range val {
+				set[p] = true
+			}
+			res.input = append(res.input, set)
+			usedVars[t]++
+		} else {
+			res.input = append(res.input, map[string]bool{t: true})
+		}
+	}
+	if len(res.Input) == 0 && len(res.Output) == 0 {
+		return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule definition (both input and output are empty): %s", s)
+	}
+	if matchRes[4] != "" {
+		context := strings.Fields(matchRes[4])
+		slot := -1
+		for i, t := range context {
+			if t == "_" {
+				if slot >= 0 {
+					return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule context definition: %s", s)
+				}
+				slot = i
+			}
+		}
+		if slot < 0 {
+			return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule context definition: %s", s)
+		}
+		left, usedVarsTmp, err := newPhonemeContext(strings.Join(context[0:slot], " "), true, vars)
+		if err != nil {
+			return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule context definition %s : %v", s, err)
+		}
+		for k, v := range usedVarsTmp {
+			usedVars[k] += v
+		}
+		right, usedVarsTmp, err := newPhonemeContext(strings.Join(context[slot+1:], " "), false, vars)
+		if err != nil {
+			return PhonemeRule{}, usedVars, fmt.Errorf("invalid phoneme rule context definition %s : %v", s, err)
+		}
+		for k, v := range usedVarsTmp {
+			usedVars[k] += v
+		}
+		res.LeftContext = left
+		res.RightContext = right
+	}
+	return res, usedVars, nil
+}
+
+// phonemeRules returns the positions (in RuleSet.PhonemeRules) of the phoneme rules applied before (or after) syllabification
+func (rs RuleSet) phonemeRules(afterSyllabification bool) []int {
+	res := []int{}
+	for i, r := range rs.PhonemeRules {
+		if r.AfterSyllabification == afterSyllabification {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// matchPhonemeRule checks if the phoneme rule applies at position i of the input tokens
+func (rs RuleSet) matchPhonemeRule(r PhonemeRule, tokens []string, i int) (bool, error) {
+	if !r.matchInput(tokens[i:]) {
+		return false, nil
+	}
+	left, err := r.LeftContext.Matches(encodePhonemeTokens(tokens[0:i]))
+	if err != nil {
+		return false, rs.regexpError(r.LeftContext.Regexp, err, r.String(), r.LineNumber)
+	}
+	if !left {
+		return false, nil
+	}
+	right, err := r.RightContext.Matches(encodePhonemeTokens(tokens[i+len(r.input):]))
+	if err != nil {
+		return false, rs.regexpError(r.RightContext.Regexp, err, r.String(), r.LineNumber)
+	}
+	return right, nil
+}
+
+// rewritePhonemes applies the phoneme rules (at the specified positions in RuleSet.PhonemeRules) to the input tokens, left to right. At each position, the first matching rule (if any) is applied. Insertion rules (with empty input) are tried before the rules consuming the phoneme at the current position, and at most one insertion is made at each position. Contexts are always matched against the input tokens. Each rule application is added to the trace, if non-nil. For each output token, the returned origin slice holds the index of the input token it was derived from (for insertions, the following input token, or the last one at the end of the input).
+func (rs RuleSet) rewritePhonemes(rules []int, tokens []string, opts applyOpts, trace *[]FilterStep) ([]string, []int, error) {
+	res := []string{}
+	origin := []int{}
+	originFor := func(i int) int {
+		if i >= len(tokens) {
+			return len(tokens) - 1
+		}
+		return i
+	}
+	for i := 0; i <= len(tokens); {
+		// insertion rules
+		for _, ri := range rules {
+			r := rs.PhonemeRules[ri]
+			if len(r.input) > 0 {
+				continue
+			}
+			ok, err := rs.matchPhonemeRule(r, tokens, i)
+			if err != nil {
+				return res, origin, err
+			}
+			if ok {
+				rs.countApplied(coverageKey{kind: phonemeRuleCoverage, position: ri}, opts)
+				if trace != nil {
+					*trace = append(*trace, FilterStep{Filter: r.String(), Before: "", After: strings.Join(r.Output, rs.PhonemeDelimiter)})
+				}
+				for _, p := range r.Output {
+					res = append(res, p)
+					origin = append(origin, originFor(i))
+				}
+				break
+			}
+		}
+		if i == len(tokens) {
+			break
+		}
+		// rewrite rules
+		applied := false
+		for _, ri := range rules {
+			r := rs.PhonemeRules[ri]
+			if len(r.input) == 0 {
+				continue
+			}
+			ok, err := rs.matchPhonemeRule(r, tokens, i)
+			if err != nil {
+				return res, origin, err
+			}
+			if ok {
+				rs.countApplied(coverageKey{kind: phonemeRuleCoverage, position: ri}, opts)
+				if trace != nil {
+					*trace = append(*trace, FilterStep{Filter: r.String(), Before: strings.Join(tokens[i:i+len(r.input)], rs.PhonemeDelimiter), After: strings.Join(r.Output, rs.PhonemeDelimiter)})
+				}
+				for _, p := range r.Output {
+					res = append(res, p)
+					origin = append(origin, i)
+				}
+				i += len(r.input)
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			res = append(res, tokens[i])
+			origin = append(origin, i)
+			i++
+		}
+	}
+	return res, origin, nil
+}
+
+// applyPhonemeRules applies the phoneme rules defined for the unsyllabified transcription. The rewritten phonemes are kept in the grapheme-phoneme chunk of the input phoneme they were derived from.
+func (rs RuleSet) applyPhonemeRules(t trans, opts applyOpts, trace *[]FilterStep) (trans, error) {
+	rules := rs.phonemeRules(false)
+	if len(rules) == 0 {
+		return t, nil
+	}
+	tokens := []string{}
+	chunkIndex := []int{}
+	for ci, c := range t.phonemes {
+		for _, p := range c.p {
+			if len(p) > 0 {
+				tokens = append(tokens, p)
+				chunkIndex = append(chunkIndex, ci)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return t, nil
+	}
+	rewritten, origin, err := rs.rewritePhonemes(rules, tokens, opts, trace)
+	if err != nil {
+		return t, err
+	}
+	res := trans{}
+	for _, c := range t.phonemes {
+		res.phonemes = append(res.phonemes, g2p{g: c.g, lineNumber: c.lineNumber})
+	}
+	for i, p := range rewritten {
+		ci := chunkIndex[origin[i]]
+		res.phonemes[ci].p = append(res.phonemes[ci].p, p)
+	}
+	for i := range res.phonemes {
+		if len(res.phonemes[i].p) == 0 {
+			res.phonemes[i].p = []string{""}
+		}
+	}
+	return res, nil
+}
+
+// splitPhonemes splits a transcription string into phoneme tokens
+func (rs RuleSet) splitPhonemes(s string) ([]string, error) {
+	if rs.PhonemeDelimiter == "" {
+		return rs.PhonemeSet.SplitTranscription(s)
+	}
+	res := []string{}
+	for _, p := range strings.Split(s, rs.PhonemeDelimiter) {
+		if len(p) > 0 {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// applySyllPhonemeRules applies the phoneme rules defined for the syllabified transcription
+func (rs RuleSet) applySyllPhonemeRules(s string, opts applyOpts, trace *[]FilterStep) (string, error) {
+	rules := rs.phonemeRules(true)
+	if len(rules) == 0 {
+		return s, nil
+	}
+	tokens, err := rs.splitPhonemes(s)
+	if err != nil {
+		return s, err
+	}
+	rewritten, _, err := rs.rewritePhonemes(rules, tokens, opts, trace)
+	if err != nil {
+		return s, err
+	}
+	return strings.Join(rewritten, rs.PhonemeDelimiter), nil
+}
+
+// phonemeRuleSymbols returns the phonemes used in the phoneme rules and the phonological contexts of the g2p rules, mapped to the rules using them (for validation)
+func (rs RuleSet) phonemeRuleSymbols() map[string][]string {
+	res := make(map[string][]string)
+	add := func(t string, r string) {
+		if t == "#" {
+			return
+		}
+		if m := phonemeContextQuantifierRe.FindStringSubmatch(t); m != nil {
+			if _, ok := rs.PhonemeVars[m[1]]; ok {
+				t = m[1]
+			}
+		}
+		if val, ok := rs.PhonemeVars[t]; ok {
+			for _, p := range val {
+				res[p] = append(res[p], r)
+			}
+			return
+		}
+		res[t] = append(res[t], r)
+	}
+	for _, r := range rs.PhonemeRules {
+		tokens := append([]string{}, r.Input...)
+		tokens = append(tokens, r.Output...)
+		tokens = append(tokens, strings.Fields(r.LeftContext.Input)...)
+		tokens = append(tokens, strings.Fields(r.RightContext.Input)...)
+		for _, t := range tokens {
+			add(t, fmt.Sprintf("phoneme rule %s", r))
+		}
+	}
+	for _, r := range rs.Rules {
+		for _, t := range strings.Fields(r.PhonemeContext.Input) {
+			add(t, fmt.Sprintf("rule context %s", r))
+		}
+	}
+	return res
+}
+
+// isValidPhonemeRuleSymbol returns true if the input symbol is defined in the phoneme set, or is a syllable delimiter or stress symbol
+func (rs RuleSet) isValidPhonemeRuleSymbol(p string) bool {
+	if rs.PhonemeSet.validPhoneme(p) {
+		return true
+	}
+	if rs.Syllabifier.IsDefined() {
+		return p == rs.SyllableDelimiter || rs.Syllabifier.SyllDef.IsStress(p)
+	}
+	return false
+}
+
+// validatePhonemeRules checks that the symbols used in the phoneme rules and phonological contexts are defined in the phoneme set
+func (rs RuleSet) validatePhonemeRules() []string {
+	res := []string{}
+	symbols := rs.phonemeRuleSymbols()
+	keys := []string{}
+	for p := range symbols {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+	for _, p := range keys {
+		if !rs.isValidPhonemeRuleSymbol(p) {
+			res = append(res, fmt.Sprintf("invalid symbol in %s: %s", symbols[p][0], p))
+		}
+	}
+	return res
+}
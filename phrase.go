@@ -0,0 +1,67 @@
+package rbg2p
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// DefaultWordBoundary is the default symbol used to join the words of a transcribed phrase
+const DefaultWordBoundary = "#"
+
+// isWordSeparator returns true if the input rune separates words in a phrase: whitespace, or hyphens and punctuation not included in the character set
+func (rs RuleSet) isWordSeparator(r rune) bool {
+	if unicode.IsSpace(r) {
+		return true
+	}
+	if r == '-' || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+		return !Contains(rs.CharacterSet, string(r))
+	}
+	return false
+}
+
+// Tokenize splits an input phrase into words, using whitespace, hyphens and punctuation as word separators. Hyphens and punctuation characters that are included in the character set are kept as part of the words.
+func (rs RuleSet) Tokenize(s string) []string {
+	return strings.FieldsFunc(s, rs.isWordSeparator)
+}
+
+func (rs RuleSet) isPhrase(s string) bool {
+	return len(rs.Tokenize(s)) > 1
+}
+
+func (rs RuleSet) wordBoundary() string {
+	return rs.PhonemeDelimiter + rs.WordBoundary + rs.PhonemeDelimiter
+}
+
+// ApplyPhrase splits the input string into words (see Tokenize), transcribes each word, and joins the transcriptions using the word boundary symbol (RuleSet.WordBoundary). If any of the words have variants, all combinations are returned (limited by RuleSet.MaxVariants, if set). Errors for the individual words are joined, and returned along with the transcriptions.
+func (rs RuleSet) ApplyPhrase(s string) ([]string, error) {
+	tokens := rs.Tokenize(s)
+	var errs []error
+	res := []string{}
+	for i, token := range tokens {
+		transes, err := rs.Apply(token)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if i == 0 {
+			res = transes
+			continue
+		}
+		joined := []string{}
+		seen := make(map[string]bool)
+		for _, prefix := range res {
+			for _, t := range transes {
+				if rs.MaxVariants > 0 && len(joined) >= rs.MaxVariants {
+					break
+				}
+				j := prefix + rs.wordBoundary() + t
+				if !seen[j] {
+					seen[j] = true
+					joined = append(joined, j)
+				}
+			}
+		}
+		res = joined
+	}
+	return res, errors.Join(errs...)
+}
@@ -1,12 +1,15 @@
 package rbg2p
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dlclark/regexp2"
 )
@@ -63,6 +66,8 @@ func (c Context) equals(c2 Context) bool {
 type Filter struct {
 	Regexp *regexp2.Regexp
 	Output string
+
+	LineNumber int // for debugging
 }
 
 // Apply is used to apply the filter to an input string
@@ -71,10 +76,17 @@ func (f Filter) Apply(s string) (string, error) {
 	return f.Regexp.Replace(s, f.Output, -1, -1)
 }
 
+// String returns a string representation of the Filter
+func (f Filter) String() string {
+	return fmt.Sprintf("\"%s\" -> \"%s\"", f.Regexp, f.Output)
+}
+
 // Prefilter is a regexp filter
 type Prefilter struct {
 	Regexp *regexp2.Regexp
 	Output string
+
+	LineNumber int // for debugging
 }
 
 // Apply is used to apply the prefilter to an input string
@@ -83,45 +95,89 @@ func (pf Prefilter) Apply(s string) (string, error) {
 	return pf.Regexp.Replace(s, pf.Output, -1, -1)
 }
 
+// String returns a string representation of the Prefilter
+func (pf Prefilter) String() string {
+	return fmt.Sprintf("\"%s\" -> \"%s\"", pf.Regexp, pf.Output)
+}
+
 // Rule is a g2p rule representation
 type Rule struct {
-	Input        string
-	Output       []string
+	Input  string
+	Output []string
+
+	// Weights holds the weight of each variant output, in the same order as Output (nil if no weights are specified in the rule)
+	Weights []float64
+
 	LeftContext  Context
 	RightContext Context
-	LineNumber   int // for debugging
+
+	// PhonemeContext is the (optional) phonological left context, matched against the phonemes produced so far in the current variant
+	PhonemeContext Context
+
+	// CaseInsensitive is true if the rule input matches the input string regardless of case (written with the prefix (?i) in the rule file)
+	CaseInsensitive bool
+
+	// Label is the (optional) name of the rule, defined by a LABEL directive on the line before the rule, used to refer to the rule from overlay files
+	Label string
+
+	LineNumber int // for debugging
 }
 
 // String returns a string representation of the Rule
 func (r Rule) String() string {
 	var output string
-	if len(r.Output) == 1 {
-		output = r.Output[0]
+	outputs := r.Output
+	if r.hasWeights() {
+		outputs = []string{}
+		for i, o := range r.Output {
+			outputs = append(outputs, fmt.Sprintf("%s <%s>", o, strconv.FormatFloat(r.Weights[i], 'g', -1, 64)))
+		}
+	}
+	if len(outputs) == 1 {
+		output = outputs[0]
 	} else {
-		output = fmt.Sprintf("(%s)", strings.Join(r.Output, ", "))
+		output = fmt.Sprintf("(%s)", strings.Join(outputs, ", "))
+	}
+	input := r.Input
+	if r.CaseInsensitive {
+		input = caseInsensitivePrefix + input
 	}
-	return fmt.Sprintf("%s -> %s / %s _ %s", r.Input, output, r.LeftContext, r.RightContext)
+	if r.PhonemeContext.IsDefined() {
+		return fmt.Sprintf("%s -> %s / %s _ %s AFTER %s", input, output, r.LeftContext, r.RightContext, r.PhonemeContext)
+	}
+	return fmt.Sprintf("%s -> %s / %s _ %s", input, output, r.LeftContext, r.RightContext)
 }
 
 // equals: checks for equality (including underlying slices and regexps); used for unit tests
 func (r Rule) equals(r2 Rule) bool {
 	return r.Input == r2.Input &&
+		r.CaseInsensitive == r2.CaseInsensitive &&
 		reflect.DeepEqual(r.Output, r2.Output) &&
+		reflect.DeepEqual(r.Weights, r2.Weights) &&
 		r.LeftContext.equals(r2.LeftContext) &&
-		r.RightContext.equals(r2.RightContext)
+		r.RightContext.equals(r2.RightContext) &&
+		r.PhonemeContext.equals(r2.PhonemeContext)
+}
+
+func (r Rule) hasWeights() bool {
+	return len(r.Weights) > 0
 }
 
 // equalsExceptOutput: checks for equality except for output (including underlying slices and regexps); used for unit tests
 func (r Rule) equalsExceptOutput(r2 Rule) bool {
 	return r.Input == r2.Input &&
+		r.CaseInsensitive == r2.CaseInsensitive &&
 		r.LeftContext.equals(r2.LeftContext) &&
-		r.RightContext.equals(r2.RightContext)
+		r.RightContext.equals(r2.RightContext) &&
+		r.PhonemeContext.equals(r2.PhonemeContext)
 }
 
 // Test defines a rule test (input -> output)
 type Test struct {
 	Input  string
 	Output []string
+
+	LineNumber int // for debugging
 }
 
 // equals checks for equality (including underlying slices); used for unit tests
@@ -139,24 +195,154 @@ type RuleSet struct {
 	DowncaseInput     bool
 	Vars              map[string]string
 	Rules             []Rule
-	RulesAppliedMutex *sync.RWMutex
-	RulesApplied      map[string]int // for coverage checks
 	Tests             []Test
 	Filters           []Filter
 	Prefilters        []Prefilter
 	Syllabifier       Syllabifier
 	Content           string
 	Debug             bool
+
+	// RulesApplied counts the rules applied, keyed by rule string (see Rule.String). It is nil when a rule set is loaded, and is only updated if the caller assigns a map to it (and CollectCoverage is set), since updating it requires locking RulesAppliedMutex for each rule applied.
+	//
+	// Deprecated: Use RuleSet.Coverage instead.
+	RulesApplied map[string]int
+
+	// RulesAppliedMutex guards RulesApplied. It is created when a rule set is loaded.
+	//
+	// Deprecated: Use RuleSet.Coverage instead.
+	RulesAppliedMutex *sync.RWMutex
+
+	// WordBoundary is the symbol used to join the words of a transcribed phrase (see ApplyPhrase)
+	WordBoundary string
+
+	// MaxVariants is the maximum number of transcription variants returned by Apply (0 means no limit)
+	MaxVariants int
+
+	// CollectCoverage is true if the rules applied should be counted (see RuleSet.Coverage). It is set by default when a rule set is loaded. Switch it off to avoid the counting overhead, e.g. in a server where no one reads the coverage counts. Since the coverage counts are shared between copies of a rule set, counting can be switched off for a single call by calling Apply on a copy with CollectCoverage set to false.
+	CollectCoverage bool
+
+	// Locale is the BCP 47 language tag (e.g. "tr") used for case mapping when downcasing the input (see DowncaseInput) and when matching case-insensitive rule inputs (empty means no language specific case mapping)
+	Locale string
+
+	// Normalization is the Unicode normalization form (NFC, NFD, NFKC or NFKD) applied to the rule file when it is loaded, and to each input string (empty means no normalization). Changing the normalization form after the rule set has been loaded only affects the input strings.
+	Normalization string
+
+	// RightToLeft is true if the rules are applied right to left, i.e., starting at the end of the input string. Rule contexts have the same meaning in both directions (the left context is matched against the input to the left of the rule input), and at each position, the first matching rule (in rule order) is applied. Phonological contexts are matched against the phonemes produced so far, i.e., to the right of the rule input. If the direction is changed after the rule set has been loaded, use IndexRules to rebuild the rule index and recompile the phonological contexts for the new direction (otherwise, the phonological contexts are recompiled each time the rules are applied).
+	RightToLeft bool
+
+	// phonemeContextsRightToLeft is the rule application direction that the phonological contexts of the rules were compiled for (see anchorPhonemeContexts)
+	phonemeContextsRightToLeft bool
+
+	// MatchTimeout is the maximum time allowed for a single regexp match (0 means no timeout). Use SetMatchTimeout to change the timeout after the rule set has been loaded (setting the field has no effect on the compiled regexps).
+	MatchTimeout time.Duration
+
+	// PhonemeVars holds the phoneme variables used in the phoneme rules (sets of phonemes)
+	PhonemeVars map[string][]string
+
+	// PhonemeRules is the phoneme-level rewrite rule block, applied to the phoneme tokens after the g2p rules (before or after syllabification)
+	PhonemeRules []PhonemeRule
+
+	// Lexicon is the exception lexicon, keyed by orthography (lowercased if DowncaseInput is set). Lexicon entries are looked up before the rules are applied.
+	Lexicon map[string]LexiconEntry
+
+	// Base is the resolved path of the base rule set, for a rule set loaded from an overlay file (see OVERLAY FILES in the package documentation); otherwise empty. Use RuleSet.Source to tell the base lines from the overlay lines.
+	Base string
+
+	ruleIndex *ruleIndex
+
+	// coverage holds the coverage counts (see RuleSet.Coverage)
+	coverage *coverageCounter
+
+	// sources holds the source position of each line of the content (see RuleSet.Source)
+	sources []SourceLine
+}
+
+// SetMatchTimeout sets the maximum time allowed for a single regexp match in rule contexts (including phoneme rule contexts), filters and prefilters (0 means no timeout). If the timeout is exceeded, Apply returns a RegexpTimeoutError. The compiled regexps are copied before the timeout is set, since they are shared between copies of the rule set, so other copies of the rule set are not affected. SetMatchTimeout must not be called while Apply (or any other transcription method) is running on the same rule set.
+func (rs *RuleSet) SetMatchTimeout(timeout time.Duration) {
+	rs.copyRegexps()
+	rs.MatchTimeout = timeout
+	rs.setRegexpTimeouts()
+}
+
+// copyRegexps replaces the rules, phoneme rules, filters and prefilters with copies using separate compiled regexps (see cloneRegexp), so that the regexps can be modified without affecting other copies of the rule set
+func (rs *RuleSet) copyRegexps() {
+	rules := make([]Rule, 0, len(rs.Rules))
+	for _, r := range rs.Rules {
+		r.LeftContext = r.LeftContext.clone()
+		r.RightContext = r.RightContext.clone()
+		r.PhonemeContext = r.PhonemeContext.clone()
+		rules = append(rules, r)
+	}
+	rs.Rules = rules
+	phonemeRules := make([]PhonemeRule, 0, len(rs.PhonemeRules))
+	for _, r := range rs.PhonemeRules {
+		r.LeftContext = r.LeftContext.clone()
+		r.RightContext = r.RightContext.clone()
+		phonemeRules = append(phonemeRules, r)
+	}
+	rs.PhonemeRules = phonemeRules
+	filters := make([]Filter, 0, len(rs.Filters))
+	for _, f := range rs.Filters {
+		f.Regexp = cloneRegexp(f.Regexp)
+		filters = append(filters, f)
+	}
+	rs.Filters = filters
+	prefilters := make([]Prefilter, 0, len(rs.Prefilters))
+	for _, pf := range rs.Prefilters {
+		pf.Regexp = cloneRegexp(pf.Regexp)
+		prefilters = append(prefilters, pf)
+	}
+	rs.Prefilters = prefilters
+}
+
+// setRegexpTimeouts sets the match timeout of the compiled regexps (in place) to RuleSet.MatchTimeout
+func (rs *RuleSet) setRegexpTimeouts() {
+	reTimeout := rs.MatchTimeout
+	if reTimeout <= 0 {
+		reTimeout = regexp2.DefaultMatchTimeout
+	}
+	for _, r := range rs.Rules {
+		if r.LeftContext.IsDefined() {
+			r.LeftContext.Regexp.MatchTimeout = reTimeout
+		}
+		if r.RightContext.IsDefined() {
+			r.RightContext.Regexp.MatchTimeout = reTimeout
+		}
+		if r.PhonemeContext.IsDefined() {
+			r.PhonemeContext.Regexp.MatchTimeout = reTimeout
+		}
+	}
+	for _, r := range rs.PhonemeRules {
+		if r.LeftContext.IsDefined() {
+			r.LeftContext.Regexp.MatchTimeout = reTimeout
+		}
+		if r.RightContext.IsDefined() {
+			r.RightContext.Regexp.MatchTimeout = reTimeout
+		}
+	}
+	for _, f := range rs.Filters {
+		f.Regexp.MatchTimeout = reTimeout
+	}
+	for _, pf := range rs.Prefilters {
+		pf.Regexp.MatchTimeout = reTimeout
+	}
 }
 
 func (rs RuleSet) isInitialized() bool {
 	return len(rs.Rules) > 0
 }
 
+// checkForUnusedChars checks that each character in the character set has a default (context free) rule. The individualChars map holds the inputs of the default rules, with the value true for case-insensitive rules, which cover the input character in both cases.
 func (rs RuleSet) checkForUnusedChars(coveredChars map[string]bool, individualChars map[string]bool, validation *TestResult) {
 	var errors = []string{}
+	var caseInsensitiveChars = make(map[string]bool)
+	for char, caseInsensitive := range individualChars {
+		if caseInsensitive {
+			caseInsensitiveChars[rs.downcase(char)] = true
+		}
+	}
 	for _, char := range rs.CharacterSet {
-		if _, ok := individualChars[char]; !ok {
+		if _, ok := individualChars[char]; !ok && !caseInsensitiveChars[rs.downcase(char)] {
 			errors = append(errors, char)
 		}
 	}
@@ -172,9 +358,19 @@ func (rs RuleSet) checkForUndefinedChars(coveredChars map[string]bool, individua
 	for _, char := range rs.CharacterSet {
 		definedChars[char] = true
 	}
-	for char := range individualChars {
-		for _, ch := range strings.Split(char, "") {
-			if _, ok := definedChars[ch]; !ok {
+	for char, caseInsensitive := range individualChars {
+		for _, ch := range splitGraphemes(char) {
+			if _, ok := definedChars[ch]; ok {
+				continue
+			}
+			// a case-insensitive rule input is defined if the character set contains it in either case
+			defined := false
+			if caseInsensitive {
+				for _, v := range rs.caseVariants(ch) {
+					defined = defined || definedChars[v]
+				}
+			}
+			if !defined {
 				errors = append(errors, ch)
 			}
 		}
@@ -189,22 +385,28 @@ func (rs RuleSet) hasPhonemeSet() bool {
 	return len(rs.PhonemeSet.Symbols) > 0
 }
 
-// Test runs the built-in tests. Returns a test result with errors and warnings, if any.
+// Test runs the built-in tests. Returns a test result with errors and warnings, if any. Failed tests and shadowed rules are reported with their position in the rule file they were read from, and, for a rule set loaded from an overlay file, with their origin (base or overlay).
 func (rs RuleSet) Test() TestResult {
 	var result = TestResult{}
 	var coveredChars = map[string]bool{}
 	var individualChars = map[string]bool{}
 	for _, rule := range rs.Rules {
-		for _, char := range strings.Split(rule.Input, "") {
+		for _, char := range splitGraphemes(rule.Input) {
 			coveredChars[char] = true
 		}
 		coveredChars[rule.Input] = true
 		if !rule.LeftContext.IsDefined() && !rule.RightContext.IsDefined() {
-			individualChars[rule.Input] = true
+			individualChars[rule.Input] = individualChars[rule.Input] || rule.CaseInsensitive
 		}
 	}
+	if rs.Content != "" {
+		result.Warnings = append(result.Warnings, checkNormalForms(strings.Split(rs.Content, "\n"))...)
+	}
 	rs.checkForUnusedChars(coveredChars, individualChars, &result)
 	rs.checkForUndefinedChars(coveredChars, individualChars, &result)
+	for _, sr := range rs.ShadowedRules() {
+		result.Warnings = append(result.Warnings, sr.String())
+	}
 
 	if rs.hasPhonemeSet() {
 		validation, err := compareToPhonemeSet(rs)
@@ -219,158 +421,451 @@ func (rs RuleSet) Test() TestResult {
 		input := test.Input
 		expect := test.Output
 		if rs.DowncaseInput {
-			input = strings.ToLower(input)
+			input = rs.downcase(input)
+		}
+		var res []string
+		var err error
+		if rs.isPhrase(input) {
+			res, err = rs.ApplyPhrase(input)
+		} else {
+			res, err = rs.Apply(input)
 		}
-		res, err := rs.Apply(input)
 		if err != nil {
 			result.Errors = append(result.Errors, fmt.Sprintf("%v", err))
 		}
 		//delim := rs.PhonemeDelimiter
 		if !reflect.DeepEqual(expect, res) {
-			result.FailedTests = append(result.FailedTests, fmt.Sprintf("for '%s', expected /%s/, got /%s/", input, strings.Join(expect, "/ + /"), strings.Join(res, "/ + /")))
+			msg := fmt.Sprintf("for '%s', expected /%s/, got /%s/", input, strings.Join(expect, "/ + /"), strings.Join(res, "/ + /"))
+			if test.LineNumber > 0 {
+				msg = rs.describeLine("test", test.LineNumber) + ": " + msg
+			}
+			result.FailedTests = append(result.FailedTests, msg)
 		}
 	}
 	return result
 }
 
-func (rs RuleSet) expandLoop(head g2p, tail []g2p, acc []trans) []trans {
-	res := []trans{}
-	for i := 0; i < len(acc); i++ {
-		for _, add := range head.p {
-			appendRange := []g2p{}
-			// build prefix from previous rounds
-			appendRange = append(appendRange, acc[i].phonemes...)
-			// append current phonemes
-			g2p := g2p{g: head.g, p: strings.Split(add, rs.PhonemeDelimiter)}
-			appendRange = append(appendRange, g2p)
-			res = append(res, trans{phonemes: appendRange})
-		}
-
-	}
-	if len(tail) == 0 {
-		return res
-	}
-	return rs.expandLoop(tail[0], tail[1:], res)
-}
-
+// expand returns all variants of the input chunks (the full Cartesian product of the variant outputs)
 func (rs RuleSet) expand(phonemes []g2p) []trans {
-	if len(phonemes) > 1 {
-		return rs.expandLoop(phonemes[0], phonemes[1:], []trans{{}})
-	} else if len(phonemes) == 1 {
-		return rs.expandLoop(phonemes[0], []g2p{}, []trans{{}})
+	res := []trans{}
+	it := newVariantIterator(phonemes, rs.PhonemeDelimiter)
+	for t, _, ok := it.next(); ok; t, _, ok = it.next() {
+		res = append(res, t)
 	}
-	// empty trans
-	return []trans{}
+	return res
 }
 
-func (rs RuleSet) applyFilters(trans string) (string, error) {
+func (rs RuleSet) applyFilters(trans string, opts applyOpts, trace *[]FilterStep) (string, error) {
 	res := trans
 	var err error
-	for _, f := range rs.Filters {
+	for fi, f := range rs.Filters {
 		input := res
 		res, err = f.Apply(res)
 		if err != nil {
-			return res, fmt.Errorf("couldn't execute regexp : %v", err)
+			return res, rs.regexpError(f.Regexp, err, "FILTER "+f.String(), f.LineNumber)
+		}
+		if res != input {
+			rs.countApplied(coverageKey{kind: filterCoverage, position: fi}, opts)
 		}
-		if rs.Debug {
-			fmt.Fprintf(os.Stderr, "FILTER\t%s\t%s\t%s\n", f, input, res)
+		if trace != nil {
+			*trace = append(*trace, FilterStep{Filter: f.String(), Before: input, After: res})
 		}
 	}
 	return res, nil
 }
 
-func (rs RuleSet) applyPrefilters(trans string) (string, error) {
+func (rs RuleSet) applyPrefilters(trans string, opts applyOpts, trace *[]FilterStep) (string, error) {
 	res := trans
 	var err error
-	for _, pf := range rs.Prefilters {
+	for pfi, pf := range rs.Prefilters {
+		input := res
 		res, err = pf.Apply(res)
 		if err != nil {
-			return res, fmt.Errorf("couldn't execute regexp : %v", err)
+			return res, rs.regexpError(pf.Regexp, err, "PREFILTER "+pf.String(), pf.LineNumber)
+		}
+		if res != input {
+			rs.countApplied(coverageKey{kind: prefilterCoverage, position: pfi}, opts)
+		}
+		if trace != nil {
+			*trace = append(*trace, FilterStep{Filter: pf.String(), Before: input, After: res})
 		}
 	}
 	return res, nil
 }
 
-// Apply applies the rules to an input string, returns a slice of transcriptions. If unknown input characters are found, an error will be created, and an underscore will be appended to the transcription. Even if an error is returned, the loop will continue until the end of the input string.
-func (rs RuleSet) Apply(s string) ([]string, error) {
-	if !rs.isInitialized() {
-		return []string{}, fmt.Errorf("RuleSet is not initialized")
+// applyOpts holds per-call settings for the rule application
+type applyOpts struct {
+	// trace, if non-nil, receives each step of the rule application
+	trace *Trace
+
+	// coverage, if non-nil, is used to count the rules applied instead of the rule set's coverage counts, so that the caller can collect the counts locally and merge them when done
+	coverage *localCoverage
+
+	// ctx, if non-nil, is checked for cancellation between each step of the rule application
+	ctx context.Context
+
+	// maxVariants is the maximum number of variants to return (0 means no limit)
+	maxVariants int
+
+	// ranked, if true, generates the variants in order of descending score (instead of rule output order)
+	ranked bool
+}
+
+// newApplyOpts returns the default settings for the rule set
+func (rs RuleSet) newApplyOpts() applyOpts {
+	return applyOpts{maxVariants: rs.MaxVariants}
+}
+
+// ctxErr returns the context error, if any
+func (opts applyOpts) ctxErr() error {
+	if opts.ctx == nil {
+		return nil
 	}
+	return opts.ctx.Err()
+}
 
-	var i = 0
-	if rs.DowncaseInput {
-		s = strings.ToLower(s)
+// hasPhonemeContexts returns true if any of the rules has a phonological left context
+func (rs RuleSet) hasPhonemeContexts() bool {
+	for _, r := range rs.Rules {
+		if r.PhonemeContext.IsDefined() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRule returns the position (in the rule set) of the first rule matching the input at position i, or -1 if no rule matches. For right-to-left rule application, i is the end position of the rule input. The phonemes produced so far are only used for rules with a phonological context. The rule index is used if indexed is set (see candidateRules). The rules tested are added to the position trace, if non-nil.
+func (rs RuleSet) matchRule(s0 []rune, i int, phonemes []string, indexed bool, pos *PositionTrace) (int, error) {
+	unprocessed := s0[i:]
+	if rs.RightToLeft {
+		unprocessed = s0[0:i]
+	}
+	ss := string(unprocessed)
+	var encodedPhonemes *string
+	for _, ri := range rs.candidateRules(unprocessed, indexed) {
+		rule := rs.Rules[ri]
+		attempt := RuleAttempt{Rule: rule}
+		ruleInputLen := len([]rune(rule.Input))
+		start, end := i, i+ruleInputLen
+		if rs.RightToLeft {
+			start, end = i-ruleInputLen, i
+		}
+		attempt.InputMatch = rs.inputMatches(rule, unprocessed, ss)
+		if attempt.InputMatch {
+			leftMatch, err := rule.LeftContext.Matches(string(s0[0:start]))
+			if err != nil {
+				return -1, rs.regexpError(rule.LeftContext.Regexp, err, rule.String(), rule.LineNumber)
+			}
+			attempt.LeftMatch = leftMatch
+		}
+		if attempt.LeftMatch {
+			rightMatch, err := rule.RightContext.Matches(string(s0[end:]))
+			if err != nil {
+				return -1, rs.regexpError(rule.RightContext.Regexp, err, rule.String(), rule.LineNumber)
+			}
+			attempt.RightMatch = rightMatch
+		}
+		if attempt.RightMatch {
+			if encodedPhonemes == nil && rule.PhonemeContext.IsDefined() {
+				e := encodePhonemeTokens(phonemes)
+				encodedPhonemes = &e
+			}
+			phnMatch := true
+			if rule.PhonemeContext.IsDefined() {
+				var err error
+				phnMatch, err = rule.PhonemeContext.Matches(*encodedPhonemes)
+				if err != nil {
+					return -1, rs.regexpError(rule.PhonemeContext.Regexp, err, rule.String(), rule.LineNumber)
+				}
+			}
+			attempt.PhonemeMatch = phnMatch
+		}
+		if pos != nil {
+			pos.Attempts = append(pos.Attempts, attempt)
+		}
+		if attempt.Matched() {
+			return ri, nil
+		}
+	}
+	return -1, nil
+}
+
+// ruleHypothesis is a partial rule application: the input position, the chunks produced so far, and (if phonemes are tracked) the phonemes produced so far
+type ruleHypothesis struct {
+	i          int
+	chunks     []g2p
+	phonemes   []string
+	couldntMap []UnmappableSymbol
+}
+
+// with returns the hypothesis with the input chunk added. If trackPhonemes is true, a copy is returned, and the chunk is expected to have a single output, which is added to the phonemes produced so far.
+func (h ruleHypothesis) with(rs RuleSet, c g2p, inputLen int, trackPhonemes bool) ruleHypothesis {
+	if rs.RightToLeft {
+		inputLen = -inputLen
+	}
+	if !trackPhonemes { // no branching, so the slices can be shared
+		h.i += inputLen
+		h.chunks = append(h.chunks, c)
+		return h
 	}
+	res := ruleHypothesis{i: h.i + inputLen, couldntMap: h.couldntMap}
+	res.chunks = append(append(make([]g2p, 0, len(h.chunks)+1), h.chunks...), c)
+	phns, err := rs.splitPhonemes(c.p[0])
+	if err != nil {
+		phns = strings.Split(c.p[0], rs.PhonemeDelimiter)
+	}
+	// the phonemes are kept in input order, also for right-to-left rule application
+	if rs.RightToLeft {
+		res.phonemes = append(append(make([]string, 0, len(h.phonemes)+len(phns)), phns...), h.phonemes...)
+	} else {
+		res.phonemes = append(append(make([]string, 0, len(h.phonemes)+len(phns)), h.phonemes...), phns...)
+	}
+	return res
+}
+
+// done returns true if the whole input has been processed
+func (h ruleHypothesis) done(rs RuleSet, inputLen int) bool {
+	if rs.RightToLeft {
+		return h.i <= 0
+	}
+	return h.i >= inputLen
+}
+
+// reverse reverses the order of the chunks (and unmappable symbols) of a hypothesis processed right-to-left
+func (h ruleHypothesis) reverse() ruleHypothesis {
+	res := ruleHypothesis{i: h.i, phonemes: h.phonemes}
+	for i := len(h.chunks) - 1; i >= 0; i-- {
+		res.chunks = append(res.chunks, h.chunks[i])
+	}
+	for i := len(h.couldntMap) - 1; i >= 0; i-- {
+		res.couldntMap = append(res.couldntMap, h.couldntMap[i])
+	}
+	return res
+}
+
+// variantChunk returns a chunk with only the output (and weight) with index i
+func (g g2p) variantChunk(i int) g2p {
+	res := g2p{g: g.g, p: []string{g.p[i]}, lineNumber: g.lineNumber}
+	if len(g.w) > 0 {
+		res.w = []float64{g.weight(i)}
+	}
+	return res
+}
+
+// applyRules applies the prefilters and the g2p rules to the input string (left to right, or right to left if RuleSet.RightToLeft is set). It returns the grapheme-phoneme chunks (before variant expansion), and the input symbols that couldn't be mapped by any rule (if any). If the rule set has rules with phonological contexts, a rule's variant outputs may lead to different rules being applied later on, so each variant is processed separately, and one chunk sequence is returned for each variant (in variant order). Otherwise, a single chunk sequence is returned.
+func (rs RuleSet) applyRules(s string, opts applyOpts) ([][]g2p, []UnmappableSymbol, error) {
+	trace := opts.trace
 	var prefiltered string
-	pfted, pferr := rs.applyPrefilters(s)
+	var pfTrace *[]FilterStep
+	if trace != nil {
+		pfTrace = &trace.Prefilters
+	}
+	pfted, pferr := rs.applyPrefilters(s, opts, pfTrace)
 	if pferr != nil {
-		return []string{}, fmt.Errorf("couldn't apply prefilter: %s", s)
+		return [][]g2p{}, []UnmappableSymbol{}, fmt.Errorf("couldn't apply prefilter: %s : %w", s, pferr)
 	}
 	prefiltered = pfted
+	if trace != nil {
+		trace.Prefiltered = prefiltered
+	}
 	var s0 = []rune(prefiltered)
-	res := []g2p{}
-	var couldntMap = []string{}
-	for i < len(s0) {
-		ss := string(s0[i:])
-		thisChar := string(s0[i : i+1])
-		left := string(s0[0:i])
-		var matchFound = false
-		for _, rule := range rs.Rules {
-			leftMatch, err := rule.LeftContext.Matches(left)
+	graphemes := newGraphemeIndex(s0)
+	if err := rs.anchorPhonemeContexts(); err != nil {
+		return [][]g2p{}, []UnmappableSymbol{}, err
+	}
+	branching := rs.hasPhonemeContexts()
+	indexed := rs.ruleIndex.validFor(rs.Rules, rs.RightToLeft)
+	res := [][]g2p{}
+	var couldntMap []UnmappableSymbol
+	initial := ruleHypothesis{chunks: []g2p{}, couldntMap: []UnmappableSymbol{}}
+	if rs.RightToLeft {
+		initial.i = len(s0)
+	}
+	stack := []ruleHypothesis{initial}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for !h.done(rs, len(s0)) {
+			if err := opts.ctxErr(); err != nil {
+				return [][]g2p{}, []UnmappableSymbol{}, err
+			}
+			var pos *PositionTrace
+			if trace != nil {
+				pos = &PositionTrace{Index: h.i, Left: string(s0[0:h.i]), Remaining: string(s0[h.i:])}
+			}
+			ri, err := rs.matchRule(s0, h.i, h.phonemes, indexed, pos)
 			if err != nil {
-				return []string{}, fmt.Errorf("couldn't execute regexp /%s/ : %s", rule.LeftContext.Regexp, err)
+				return [][]g2p{}, []UnmappableSymbol{}, err
 			}
-			if strings.HasPrefix(ss, rule.Input) && leftMatch {
-				ruleInputLen := len([]rune(rule.Input))
-				right := string(s0[i+ruleInputLen:])
-				rightMatch, err := rule.RightContext.Matches(right)
-				if err != nil {
-					return []string{}, fmt.Errorf("couldn't execute regexp /%s/ : %s", rule.RightContext.Regexp, err)
+			if ri < 0 {
+				// a base character and its combining marks are mapped to a single default phoneme
+				thisChar := graphemes.at(h.i, rs.RightToLeft)
+				offset := h.i
+				if rs.RightToLeft {
+					offset = h.i - len([]rune(thisChar))
 				}
-				if rightMatch {
-					i = i + ruleInputLen
-					res = append(res, g2p{g: rule.Input, p: rule.Output})
-					matchFound = true
-					ruleString := rule.String()
-					rs.RulesAppliedMutex.Lock()
-					rs.RulesApplied[ruleString]++
-					rs.RulesAppliedMutex.Unlock()
-					if Debug {
-						fmt.Fprintf(os.Stderr, "%s\t%v\t%v\t%v\t%v\n", "RULE APPLIED", rule, s, ss, res)
+				h.couldntMap = append(append(make([]UnmappableSymbol, 0, len(h.couldntMap)+1), h.couldntMap...), UnmappableSymbol{Offset: offset, Symbol: thisChar})
+				h = h.with(rs, g2p{g: thisChar, p: []string{rs.DefaultPhoneme}}, len([]rune(thisChar)), branching)
+			} else {
+				rule := rs.Rules[ri]
+				rs.countApplied(coverageKey{kind: ruleCoverage, position: ri}, opts)
+				if pos != nil {
+					pos.Applied = &rule
+				}
+				c := g2p{g: rule.Input, p: rule.Output, w: rule.Weights, lineNumber: rule.LineNumber}
+				inputLen := len([]rune(rule.Input))
+				if branching {
+					// the remaining variants are processed later, in variant order
+					for vi := len(rule.Output) - 1; vi > 0; vi-- {
+						stack = append(stack, h.with(rs, c.variantChunk(vi), inputLen, branching))
 					}
-					break
+					c = c.variantChunk(0)
 				}
+				h = h.with(rs, c, inputLen, branching)
+			}
+			if pos != nil {
+				trace.Positions = append(trace.Positions, *pos)
 			}
 		}
-		if !matchFound {
-			res = append(res, g2p{g: thisChar, p: []string{rs.DefaultPhoneme}})
-			i = i + 1
-			couldntMap = append(couldntMap, thisChar)
+		if rs.RightToLeft {
+			h = h.reverse()
+		}
+		if len(res) == 0 {
+			couldntMap = h.couldntMap
 		}
+		res = append(res, h.chunks)
 	}
-	expanded := rs.expand(res)
+	return res, couldntMap, nil
+}
 
-	transes := []string{}
-	for _, t := range expanded {
-		if rs.Syllabifier.IsDefined() {
-			s := rs.Syllabifier.syllabifyToString(t)
-			transes = append(transes, s)
-		} else {
-			transes = append(transes, t.string(rs.PhonemeDelimiter))
+// syllabify returns the syllabified transcription, if the rule set has a syllabifier (otherwise, the transcription without syllable boundaries)
+func (rs RuleSet) syllabify(t trans) sylledTrans {
+	if rs.Syllabifier.IsDefined() {
+		return rs.Syllabifier.syllabify(t)
+	}
+	return sylledTrans{trans: t}
+}
+
+// transString returns the string representation of a transcription, with syllable boundaries if the rule set has a syllabifier
+func (rs RuleSet) transString(t sylledTrans) string {
+	if rs.Syllabifier.IsDefined() {
+		res := rs.Syllabifier.stringWithStressPlacement(t)
+		if rs.Syllabifier.Debug {
+			fmt.Fprintf(os.Stderr, "%s\t%v\t%v\t%s\n", "SYLLABIFY", t.trans, t, res)
 		}
+		return res
+	}
+	return t.trans.string(rs.PhonemeDelimiter)
+}
+
+// Apply applies the rules to an input string, returns a slice of transcriptions. If unknown input characters are found, an UnmappableSymbolError will be returned, and the default phoneme will be appended to the transcription. If a regexp match fails, a RegexpError is returned. Even if an UnmappableSymbolError is returned, the loop will continue until the end of the input string. Identical transcription variants are only returned once, and the number of variants is limited by RuleSet.MaxVariants (if set).
+func (rs RuleSet) Apply(s string) ([]string, error) {
+	res, err := rs.apply(s, rs.newApplyOpts())
+	return res.transes(), err
+}
+
+// ApplyContext is like Apply, but returns the context error if the context is cancelled or its deadline is exceeded before the rule application is done. The context is checked between each step of the rule application; a single regexp match is bounded by the match timeout instead (see RuleSet.SetMatchTimeout).
+func (rs RuleSet) ApplyContext(ctx context.Context, s string) ([]string, error) {
+	opts := rs.newApplyOpts()
+	opts.ctx = ctx
+	res, err := rs.apply(s, opts)
+	return res.transes(), err
+}
+
+// Explain applies the rules to an input string, and returns a trace of the rule application, along with the resulting transcriptions. Errors are handled in the same way as for RuleSet.Apply.
+func (rs RuleSet) Explain(s string) (Trace, error) {
+	trace := Trace{}
+	opts := rs.newApplyOpts()
+	opts.trace = &trace
+	_, err := rs.apply(s, opts)
+	return trace, err
+}
+
+func (rs RuleSet) apply(s string, opts applyOpts) (applyResult, error) {
+	res := applyResult{}
+	if !rs.isInitialized() {
+		return res, fmt.Errorf("RuleSet is not initialized")
+	}
+	if opts.trace == nil && (Debug || rs.Debug) {
+		opts.trace = &Trace{}
+		defer func() { fmt.Fprint(os.Stderr, opts.trace.String()) }()
+	}
+	trace := opts.trace
+	if trace != nil {
+		trace.Input = s
+		trace.RightToLeft = rs.RightToLeft
+	}
+	s = rs.normalize(s)
+	if rs.DowncaseInput {
+		s = rs.downcase(s)
+	}
+	if entry, ok := rs.lookupLexicon(s); ok {
+		rs.countApplied(coverageKey{kind: lexiconCoverage, orth: entry.Orth}, opts)
+		res = rs.lexiconResult(entry, opts.maxVariants)
+		if trace != nil {
+			trace.Lexicon = &entry
+			trace.Result = res.transes()
+			trace.Truncated = res.truncated
+		}
+		return res, nil
+	}
+	chunkSeqs, couldntMap, err := rs.applyRules(s, opts)
+	if err != nil {
+		return res, err
 	}
-	var filtered []string
-	for _, t := range transes {
-		fted, err := rs.applyFilters(t)
+	seen := make(map[string]bool)
+	it := newVariantGenerator(chunkSeqs, rs.PhonemeDelimiter, opts.ranked)
+	for t, score, ok := it.next(); ok; t, score, ok = it.next() {
+		if err := opts.ctxErr(); err != nil {
+			return res, err
+		}
+		var fTrace, prTrace *[]FilterStep
+		if trace != nil {
+			trace.Variants = append(trace.Variants, VariantTrace{})
+			fTrace = &trace.Variants[len(trace.Variants)-1].Filters
+			prTrace = &trace.Variants[len(trace.Variants)-1].PhonemeRules
+		}
+		t, err = rs.applyPhonemeRules(t, opts, prTrace)
+		if err != nil {
+			return res, err
+		}
+		sylled := rs.syllabify(t)
+		unfiltered, err := rs.applySyllPhonemeRules(rs.transString(sylled), opts, prTrace)
+		if err != nil {
+			return res, err
+		}
+		if trace != nil {
+			trace.Variants[len(trace.Variants)-1].Unfiltered = unfiltered
+		}
+		fted, err := rs.applyFilters(unfiltered, opts, fTrace)
 		if err != nil {
-			return filtered, err
+			return res, err
 		}
-		filtered = append(filtered, fted)
+		if trace != nil {
+			trace.Variants[len(trace.Variants)-1].Output = fted
+		}
+		if seen[fted] {
+			continue
+		}
+		// only a new distinct output after the limit has been reached means that a variant is dropped
+		if opts.maxVariants > 0 && len(res.variants) >= opts.maxVariants {
+			if trace != nil {
+				trace.Variants = trace.Variants[:len(trace.Variants)-1]
+			}
+			res.truncated = true
+			break
+		}
+		seen[fted] = true
+		res.variants = append(res.variants, variant{trans: t, sylled: sylled, output: fted, score: score})
+	}
+	if trace != nil {
+		trace.Result = res.transes()
+		trace.Truncated = res.truncated
 	}
 	if len(couldntMap) > 0 {
-		return filtered, fmt.Errorf("found unmappable symbol(s) in input string: %v in %s", couldntMap, s)
+		return res, &UnmappableSymbolError{Input: s, Symbols: couldntMap}
 	}
-	return filtered, nil
+	return res, nil
 }
 
 // compareToPhonemeSet validates the phonemes in the g2p rule set against the specified phonemeset. Returns an array of invalid phonemes, if any; or if errors are found, this is returned instead.
@@ -397,10 +892,35 @@ func compareToPhonemeSet(ruleSet RuleSet) (TestResult, error) {
 		}
 	}
 	for _, test := range ruleSet.Tests {
-		for _, output := range test.Output {
+		for _, output0 := range test.Output {
+			outputs := []string{output0}
+			if ruleSet.WordBoundary != "" && ruleSet.isPhrase(test.Input) {
+				outputs = strings.Split(output0, ruleSet.wordBoundary())
+			}
+			for _, output := range outputs {
+				invalid, err := ruleSet.PhonemeSet.validate(output)
+				if err != nil {
+					return TestResult{}, fmt.Errorf("found error in test output /%s/ : %s", output, err)
+				}
+				splitted, err := ruleSet.PhonemeSet.SplitTranscription(output)
+				if err != nil {
+					return TestResult{}, err
+				}
+				for _, symbol := range splitted {
+					usedSymbols[symbol] = true
+				}
+				for _, symbol := range invalid {
+					// the fields are formatted explicitly, since the line number of the test is not part of the message
+					validation.Errors = append(validation.Errors, fmt.Sprintf("invalid symbol in test output {%s %s}: %s", test.Input, test.Output, symbol))
+				}
+			}
+		}
+	}
+	for _, entry := range ruleSet.LexiconEntries() {
+		for _, output := range entry.Transes {
 			invalid, err := ruleSet.PhonemeSet.validate(output)
 			if err != nil {
-				return TestResult{}, fmt.Errorf("found error in test output /%s/ : %s", output, err)
+				return TestResult{}, fmt.Errorf("found error in lexicon entry /%s/ : %s", output, err)
 			}
 			splitted, err := ruleSet.PhonemeSet.SplitTranscription(output)
 			if err != nil {
@@ -410,11 +930,14 @@ func compareToPhonemeSet(ruleSet RuleSet) (TestResult, error) {
 				usedSymbols[symbol] = true
 			}
 			for _, symbol := range invalid {
-				validation.Errors = append(validation.Errors, fmt.Sprintf("invalid symbol in test output %s: %s", test, symbol))
+				validation.Errors = append(validation.Errors, fmt.Sprintf("invalid symbol in lexicon entry %s: %s", entry, symbol))
 			}
-
 		}
 	}
+	validation.Errors = append(validation.Errors, ruleSet.validatePhonemeRules()...)
+	for p := range ruleSet.phonemeRuleSymbols() {
+		usedSymbols[p] = true
+	}
 	validation.Warnings = append(validation.Warnings, checkForUnusedSymbols(usedSymbols, ruleSet.PhonemeSet)...)
 	return validation, nil
 }
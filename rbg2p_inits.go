@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	u "net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dlclark/regexp2"
 )
@@ -33,15 +36,20 @@ func isPrefilter(s string) bool {
 }
 
 // var g2pLineRe = regexp.MustCompile("^(CHARACTER_SET|TEST|DEFAULT_PHONEME|FILTER|VAR|) .*")
-var g2pLineRe = regexp.MustCompile("^(CHARACTER_SET|TEST|DEFAULT_PHONEME|FILTER|PREFILTER|VAR|DOWNCASE_INPUT) .*")
+var g2pLineRe = regexp.MustCompile("^(CHARACTER_SET|TEST|DEFAULT_PHONEME|FILTER|PREFILTER|VAR|DOWNCASE_INPUT|LOCALE|DIRECTION|NORMALIZATION|MATCH_TIMEOUT|MAX_VARIANTS|WORD_BOUNDARY|LEXICON|LEXICON_FILE|PHONEME_VAR|PHONEME_RULE|SYLL_PHONEME_RULE|LABEL) .*")
 
 func isG2PLine(s string) bool {
 	return g2pLineRe.MatchString(s) || ruleRe.MatchString(s)
 }
 
+// isRuleLine returns true if the (trimmed) line is a g2p rule, i.e., not a blank line, a comment or any other type of definition
+func isRuleLine(s string) bool {
+	return !isBlankLine(s) && !isComment(s) && !isPhonemeDelimiter(s) && !isPhonemeSet(s) && !isConst(s) && !isVar(s) && !isPhonemeVar(s) && !isPhonemeRule(s) && !isSyllDefLine(s) && !isFilter(s) && !isPrefilter(s) && !isTest(s) && !isLexiconFile(s) && !isLexiconEntry(s) && !isLabel(s) && !isInclude(s) && !isBase(s) && !isOverlayEdit(s)
+}
+
 type usedVars map[string]int
 
-// LoadURL loads a g2p rule set from an URL
+// LoadURL loads a g2p rule set from an URL. URLs with the extension .json are loaded as JSON rule files (see RuleSetJSON).
 func LoadURL(url string) (RuleSet, error) {
 	urlP, err := u.Parse(url)
 	if err != nil {
@@ -52,12 +60,26 @@ func LoadURL(url string) (RuleSet, error) {
 		return RuleSet{}, err
 	}
 	defer resp.Body.Close()
+	if isJSONPath(urlP.Path) {
+		src, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return RuleSet{}, err
+		}
+		return loadJSON(url, src)
+	}
 	scanner := bufio.NewScanner(resp.Body)
 	return load(scanner, url)
 }
 
-// LoadFile loads a g2p rule set from the specified file
+// LoadFile loads a g2p rule set from the specified file. Files with the extension .json are loaded as JSON rule files (see RuleSetJSON).
 func LoadFile(fName string) (RuleSet, error) {
+	if isJSONPath(fName) {
+		src, err := os.ReadFile(filepath.Clean(fName))
+		if err != nil {
+			return RuleSet{}, err
+		}
+		return loadJSON(fName, src)
+	}
 	fh, err := os.Open(filepath.Clean(fName))
 	if err != nil {
 		return RuleSet{}, err
@@ -69,14 +91,19 @@ func LoadFile(fName string) (RuleSet, error) {
 }
 
 func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
+	return loadFrom(scanner, inputPath, openRelativePath)
+}
+
+// loadFrom loads a g2p rule set, using the opener to read included files and lexicon files
+func loadFrom(scanner *bufio.Scanner, inputPath string, open pathOpener) (RuleSet, error) {
 	var err error
 	usedVars := usedVars{}
-	ruleSet := RuleSet{Vars: map[string]string{}}
-	//log.Println("[rbg2p] New ruleset created with new mutex instance")
-	ruleSet.RulesApplied = make(map[string]int)
+	ruleSet := RuleSet{Vars: map[string]string{}, PhonemeVars: map[string][]string{}}
+	ruleSet.CollectCoverage = true
 	ruleSet.RulesAppliedMutex = &sync.RWMutex{}
 	ruleSet.DefaultPhoneme = "_"
 	ruleSet.PhonemeDelimiter = " "
+	ruleSet.WordBoundary = DefaultWordBoundary
 	ruleSet.DowncaseInput = true // Default, might be changed by value in rule file
 	syllDefLines := []string{}
 	var inputLines []string
@@ -85,64 +112,150 @@ func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
 	var filterLines []string
 	var prefilterLines []string
 	var phonemeSetLine string
-	var n = 0
-	for scanner.Scan() {
-		if err = scanner.Err(); err != nil {
-			return ruleSet, err
+	var lexiconEntries []LexiconEntry
+	var lexiconFiles []string
+	var phonemeRuleLines []string
+	rawLines, sources, base, err := readRuleSource(scanner, inputPath, open, []string{sourceKey(inputPath)})
+	if err != nil {
+		return ruleSet, err
+	}
+	ruleSet.sources = sources
+	ruleSet.Base = base
+	// lineError creates a ParseError for line n of the input (after includes), reported at its position in the file it was read from
+	lineError := func(n int, err error) error {
+		if n < 1 || n > len(rawLines) {
+			return &ParseError{File: inputPath, Err: err}
 		}
+		return parseError(sources[n-1].File, sources[n-1].Line, rawLines[n-1], err)
+	}
+	// the normalization form applies to the whole file, so it is parsed before the other lines
+	for i, line := range rawLines {
+		l := trimComment(strings.TrimSpace(line))
+		if isNormalization(l) {
+			err = parseConst(l, &ruleSet)
+			if err != nil {
+				return ruleSet, lineError(i+1, err)
+			}
+		}
+	}
+	var varLineNumbers = make(map[string]int)
+	// includedVars holds the variables (and phoneme variables) defined in included files, which may be used by other files including them
+	var includedVars = make(map[string]bool)
+	var phonemeSetLineNumber int
+	var lexiconFileLineNumbers []int
+	// ruleLabels holds the labels of the labelled rules, keyed by line number
+	var ruleLabels = make(map[int]string)
+	var labelLineNumbers = make(map[string]int)
+	var label string
+	var n = 0
+	for _, line := range rawLines {
 		n++
-		lOrig := strings.TrimSpace(scanner.Text())
-		l := trimComment(lOrig)
+		lOrig := strings.TrimSpace(line)
+		l := trimComment(ruleSet.normalize(lOrig))
 		inputLines = append(inputLines, lOrig)
+		if label != "" && !isBlankLine(l) && !isComment(l) && !isRuleLine(l) {
+			return ruleSet, lineError(labelLineNumbers[label], fmt.Errorf("LABEL %s must be followed by a rule", label))
+		}
 		if isBlankLine(l) || isComment(l) {
+		} else if isLabel(l) {
+			name, err := parseLabel(l)
+			if err != nil {
+				return ruleSet, lineError(n, err)
+			}
+			if _, ok := labelLineNumbers[name]; ok {
+				return ruleSet, lineError(n, fmt.Errorf("duplicate LABEL %s", name))
+			}
+			labelLineNumbers[name] = n
+			label = name
+		} else if isOverlayEdit(l) {
+			return ruleSet, lineError(n, fmt.Errorf("overlay definition in a rule file without a BASE definition: %s", l))
 		} else if isPhonemeDelimiter(l) {
 			delim, err := parsePhonemeDelimiter(l)
 			if err != nil {
-				return ruleSet, err
+				return ruleSet, lineError(n, err)
 			}
 			ruleSet.PhonemeDelimiter = delim
 		} else if isPhonemeSet(l) {
 			phonemeSetLine = l
+			phonemeSetLineNumber = n
 		} else if isConst(l) {
 			err = parseConst(l, &ruleSet)
 			if err != nil {
-				return ruleSet, err
+				return ruleSet, lineError(n, err)
 			}
 		} else if isVar(l) {
 			name, value, err := newVar(l)
 			if err != nil {
-				return ruleSet, err
+				return ruleSet, lineError(n, err)
 			}
 			ruleSet.Vars[name] = value
+			varLineNumbers[name] = n
+			includedVars[name] = sources[n-1].File != inputPath
+		} else if isPhonemeVar(l) {
+			name, value, err := newPhonemeVar(l)
+			if err != nil {
+				return ruleSet, lineError(n, err)
+			}
+			varLineNumbers[name] = n
+			includedVars[name] = sources[n-1].File != inputPath
+			ruleSet.PhonemeVars[name] = value
+		} else if isPhonemeRule(l) {
+			phonemeRuleLines = append(phonemeRuleLines, l)
+			ruleLinesWithLineNumber[l] = n
 		} else if isSyllDefLine(l) {
 			syllDefLines = append(syllDefLines, l)
 		} else if isFilter(l) {
 			filterLines = append(filterLines, l)
+			ruleLinesWithLineNumber[l] = n
 		} else if isPrefilter(l) {
 			prefilterLines = append(prefilterLines, l)
+			ruleLinesWithLineNumber[l] = n
 		} else if isTest(l) {
 			t, err := newTest(l)
 			if err != nil {
-				return ruleSet, err
+				return ruleSet, lineError(n, err)
 			}
+			t.LineNumber = n
 			ruleSet.Tests = append(ruleSet.Tests, t)
+		} else if isLexiconFile(l) {
+			path, err := parseLexiconFile(l)
+			if err != nil {
+				return ruleSet, lineError(n, err)
+			}
+			lexiconFiles = append(lexiconFiles, path)
+			lexiconFileLineNumbers = append(lexiconFileLineNumbers, n)
+		} else if isLexiconEntry(l) {
+			e, err := newLexiconEntry(l)
+			if err != nil {
+				return ruleSet, lineError(n, err)
+			}
+			e.Source = sources[n-1].File
+			e.LineNumber = sources[n-1].Line
+			lexiconEntries = append(lexiconEntries, e)
 		} else { // is a rule
 			ruleLines = append(ruleLines, l)
 			ruleLinesWithLineNumber[l] = n
+			if label != "" {
+				ruleLabels[n] = label
+				label = ""
+			}
 		}
 
 	}
+	if label != "" {
+		return ruleSet, lineError(labelLineNumbers[label], fmt.Errorf("LABEL %s must be followed by a rule", label))
+	}
 	for k, v := range ruleSet.Vars {
 		v, _, err := expandVarsWithBrackets(v, ruleSet.Vars)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, lineError(varLineNumbers[k], err)
 		}
 		ruleSet.Vars[k] = v
 	}
 	if len(syllDefLines) > 0 {
 		syllDef, stressPlacement, err := loadSyllDef(syllDefLines, ruleSet.PhonemeDelimiter)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, &ParseError{File: inputPath, Err: err}
 		}
 		ruleSet.Syllabifier = Syllabifier{}
 		ruleSet.SyllableDelimiter = syllDef.SyllableDelimiter()
@@ -153,7 +266,7 @@ func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
 	if len(phonemeSetLine) > 0 {
 		phnSet, err := parsePhonemeSet(phonemeSetLine, ruleSet.Syllabifier.SyllDef, ruleSet.PhonemeDelimiter)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, lineError(phonemeSetLineNumber, err)
 		}
 		ruleSet.PhonemeSet = phnSet
 	}
@@ -161,8 +274,9 @@ func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
 	for _, l := range filterLines {
 		t, usedVarsTmp, err := newFilter(l, ruleSet.Vars)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, lineError(ruleLinesWithLineNumber[l], err)
 		}
+		t.LineNumber = ruleLinesWithLineNumber[l]
 		ruleSet.Filters = append(ruleSet.Filters, t)
 		for k, v := range usedVarsTmp {
 			usedVars[k] += v
@@ -171,27 +285,33 @@ func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
 	for _, l := range prefilterLines {
 		t, usedVarsTmp, err := newPrefilter(l, ruleSet.Vars)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, lineError(ruleLinesWithLineNumber[l], err)
 		}
+		t.LineNumber = ruleLinesWithLineNumber[l]
 		ruleSet.Prefilters = append(ruleSet.Prefilters, t)
 		for k, v := range usedVarsTmp {
 			usedVars[k] += v
 		}
 	}
 	//ruleSet.Rules = append(ruleSet.Rules, Rule{Input: " ", Output: []string{" "}})
+	usedPhonemeVars := make(map[string]int)
 	for _, l := range ruleLines {
-		r, usedVarsTmp, err := newRule(l, ruleSet.Vars)
+		r, usedVarsTmp, usedPhonemeVarsTmp, err := newRuleWithPhonemeVars(l, ruleSet.Vars, ruleSet.PhonemeVars, ruleSet.RightToLeft)
 		if err != nil {
-			return ruleSet, err
+			return ruleSet, lineError(ruleLinesWithLineNumber[l], err)
+		}
+		for k, v := range usedPhonemeVarsTmp {
+			usedPhonemeVars[k] += v
 		}
 		lineNo, ok := ruleLinesWithLineNumber[l]
 		if !ok {
 			return ruleSet, fmt.Errorf("no line number for rule %s", r)
 		}
 		r.LineNumber = lineNo
+		r.Label = ruleLabels[lineNo]
 		for _, r0 := range ruleSet.Rules {
 			if r0.equalsExceptOutput(r) {
-				return ruleSet, fmt.Errorf("duplicate rules for input file %s: %s vs. %s", inputPath, r0, r)
+				return ruleSet, lineError(r.LineNumber, fmt.Errorf("duplicate rules for input file %s: %s vs. %s", inputPath, r0, r))
 			}
 		}
 		for k, v := range usedVarsTmp {
@@ -199,29 +319,66 @@ func load(scanner *bufio.Scanner, inputPath string) (RuleSet, error) {
 		}
 		ruleSet.Rules = append(ruleSet.Rules, r)
 	}
+	ruleSet.phonemeContextsRightToLeft = ruleSet.RightToLeft
+	for _, l := range phonemeRuleLines {
+		r, usedVarsTmp, err := newPhonemeRule(l, ruleSet.PhonemeVars)
+		if err != nil {
+			return ruleSet, lineError(ruleLinesWithLineNumber[l], err)
+		}
+		r.LineNumber = ruleLinesWithLineNumber[l]
+		for k, v := range usedVarsTmp {
+			usedPhonemeVars[k] += v
+		}
+		ruleSet.PhonemeRules = append(ruleSet.PhonemeRules, r)
+	}
+	ruleSet.IndexRules()
+	ruleSet.coverage = newCoverageCounter(ruleSet)
+	ruleSet.AddLexiconEntries(lexiconEntries)
+	for i, path := range lexiconFiles {
+		n := lexiconFileLineNumbers[i]
+		err := ruleSet.loadLexiconFile(sources[n-1].File, path, open)
+		if err != nil {
+			return ruleSet, lineError(n, fmt.Errorf("couldn't load lexicon file for input file %s: %w", inputPath, err))
+		}
+	}
+	// the regexps were compiled for this rule set, so the timeout is set in place
+	ruleSet.setRegexpTimeouts()
 	if ruleSet.CharacterSet == nil || len(ruleSet.CharacterSet) == 0 {
-		return ruleSet, fmt.Errorf("no character set defined for input file %s", inputPath)
+		return ruleSet, &ParseError{File: inputPath, Err: fmt.Errorf("no character set defined for input file %s", inputPath)}
 	}
 	ruleSet.Content = strings.Join(inputLines, "\n")
 
 	unusedVars := []string{}
 	for vName := range ruleSet.Vars {
-		if _, ok := usedVars[vName]; !ok {
+		if _, ok := usedVars[vName]; !ok && !includedVars[vName] {
 			unusedVars = append(unusedVars, vName)
 		}
 	}
 	if len(unusedVars) > 0 {
 		sort.Strings(unusedVars)
-		return ruleSet, fmt.Errorf("unused variable(s) %s in %s", strings.Join(unusedVars, ", "), inputPath)
+		return ruleSet, lineError(varLineNumbers[unusedVars[0]], fmt.Errorf("unused variable(s) %s in %s", strings.Join(unusedVars, ", "), inputPath))
+	}
+
+	unusedPhonemeVars := []string{}
+	for vName := range ruleSet.PhonemeVars {
+		if _, ok := usedPhonemeVars[vName]; !ok && !includedVars[vName] {
+			unusedPhonemeVars = append(unusedPhonemeVars, vName)
+		}
+	}
+	if len(unusedPhonemeVars) > 0 {
+		sort.Strings(unusedPhonemeVars)
+		return ruleSet, lineError(varLineNumbers[unusedPhonemeVars[0]], fmt.Errorf("unused phoneme variable(s) %s in %s", strings.Join(unusedPhonemeVars, ", "), inputPath))
 	}
 
 	return ruleSet, nil
 }
 
-var constRe = regexp.MustCompile("^(CHARACTER_SET|DEFAULT_PHONEME|DOWNCASE_INPUT) (?:\"(.+)\"|([^\"]+))$")
-var isConstRe = regexp.MustCompile("^(CHARACTER_SET|DEFAULT_PHONEME|DOWNCASE_INPUT) .*")
+var constRe = regexp.MustCompile("^(CHARACTER_SET|DEFAULT_PHONEME|DOWNCASE_INPUT|LOCALE|DIRECTION|NORMALIZATION|MATCH_TIMEOUT|MAX_VARIANTS|WORD_BOUNDARY) (?:\"(.+)\"|([^\"]+))$")
+var isConstRe = regexp.MustCompile("^(CHARACTER_SET|DEFAULT_PHONEME|DOWNCASE_INPUT|LOCALE|DIRECTION|NORMALIZATION|MATCH_TIMEOUT|MAX_VARIANTS|WORD_BOUNDARY) .*")
 var isTrueRe = regexp.MustCompile("^(true|TRUE|1)$")
 var isFalseRe = regexp.MustCompile("^(false|FALSE|0)$")
+var isLeftToRightRe = regexp.MustCompile("^(left-to-right|LEFT_TO_RIGHT|ltr|LTR)$")
+var isRightToLeftRe = regexp.MustCompile("^(right-to-left|RIGHT_TO_LEFT|rtl|RTL)$")
 
 func isConst(s string) bool {
 	return isConstRe.MatchString(s)
@@ -239,7 +396,7 @@ func parseConst(s string, ruleSet *RuleSet) error {
 			value = matchRes[3]
 		}
 		if name == "CHARACTER_SET" {
-			ruleSet.CharacterSet = strings.Split(value, "")
+			ruleSet.CharacterSet = splitGraphemes(value)
 		} else if name == "DEFAULT_PHONEME" {
 			ruleSet.DefaultPhoneme = value
 		} else if name == "DOWNCASE_INPUT" {
@@ -255,6 +412,40 @@ func parseConst(s string, ruleSet *RuleSet) error {
 			} else {
 				return fmt.Errorf("invalid boolean value for %s: %s", name, value)
 			}
+		} else if name == "DIRECTION" {
+			if isLeftToRightRe.MatchString(value) {
+				ruleSet.RightToLeft = false
+			} else if isRightToLeftRe.MatchString(value) {
+				ruleSet.RightToLeft = true
+			} else {
+				return fmt.Errorf("invalid direction value for %s: %s", name, value)
+			}
+		} else if name == "LOCALE" {
+			locale, err := parseLocale(value)
+			if err != nil {
+				return err
+			}
+			ruleSet.Locale = locale
+		} else if name == "NORMALIZATION" {
+			form, err := parseNormalization(value)
+			if err != nil {
+				return err
+			}
+			ruleSet.Normalization = form
+		} else if name == "MATCH_TIMEOUT" {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration value for %s: %s", name, value)
+			}
+			ruleSet.MatchTimeout = timeout
+		} else if name == "MAX_VARIANTS" {
+			max, err := strconv.Atoi(value)
+			if err != nil || max < 0 {
+				return fmt.Errorf("invalid integer value for %s: %s", name, value)
+			}
+			ruleSet.MaxVariants = max
+		} else if name == "WORD_BOUNDARY" {
+			ruleSet.WordBoundary = value
 		} else {
 			return fmt.Errorf("invalid const definition: %s", s)
 		}
@@ -299,8 +490,8 @@ func newVar(s string) (string, string, error) {
 	return name, value, nil
 }
 
-var testReSimple = regexp.MustCompile("^TEST +([^ ]+) +-> +([^,()]+)$")
-var testReVariants = regexp.MustCompile("^TEST +([^ ]+) +-> +[(](.+,.+)[)]$")
+var testReSimple = regexp.MustCompile("^TEST +(\"[^\"]+\"|[^ \"]+) +-> +([^,()]+)$")
+var testReVariants = regexp.MustCompile("^TEST +(\"[^\"]+\"|[^ \"]+) +-> +[(](.+,.+)[)]$")
 
 func newTest(s string) (Test, error) {
 	var outputS string
@@ -318,7 +509,7 @@ func newTest(s string) (Test, error) {
 	if strings.Contains(outputS, "->") {
 		return Test{}, fmt.Errorf("invalid TEST definition: %s", s)
 	}
-	input := matchRes[1]
+	input := strings.Trim(matchRes[1], "\"")
 	output := commaSplit.Split(outputS, -1)
 	return Test{Input: input, Output: output}, nil
 }
@@ -464,8 +655,38 @@ var ruleRe = regexp.MustCompile("^([^ ]+) +-> +([^/]+)( +/.*$|$)")
 var ruleOutputReSimple = regexp.MustCompile("^([^,()]+)$")
 var ruleOutputReVariants = regexp.MustCompile("^[(](.+,.+)[)]$")
 var emptyOutput = "∅"
+var ruleOutputWeightRe = regexp.MustCompile(`^(.*[^ ]|) *<([0-9]*[.]?[0-9]+)>$`)
+
+// splitRuleOutputWeights splits the weights from the rule output variants. If no weights are specified, the returned weights slice is nil. Variants without a specified weight get weight 1.
+func splitRuleOutputWeights(outputs []string, l string) ([]string, []float64, error) {
+	res := []string{}
+	weights := []float64{}
+	hasWeights := false
+	for _, o := range outputs {
+		matchRes := ruleOutputWeightRe.FindStringSubmatch(o)
+		if matchRes == nil {
+			if strings.ContainsAny(o, "<>") {
+				return []string{}, nil, fmt.Errorf("invalid rule output weight definition: %s", l)
+			}
+			res = append(res, o)
+			weights = append(weights, 1.0)
+			continue
+		}
+		w, err := strconv.ParseFloat(matchRes[2], 64)
+		if err != nil {
+			return []string{}, nil, fmt.Errorf("invalid rule output weight definition: %s", l)
+		}
+		hasWeights = true
+		res = append(res, matchRes[1])
+		weights = append(weights, w)
+	}
+	if !hasWeights {
+		return res, nil, nil
+	}
+	return res, weights, nil
+}
 
-func newRuleOutput(s string, l string) ([]string, error) {
+func newRuleOutput(s string, l string) ([]string, []float64, error) {
 	s = strings.TrimSpace(s)
 	var outputS string
 	var matchRes []string
@@ -475,18 +696,44 @@ func newRuleOutput(s string, l string) ([]string, error) {
 	} else {
 		matchRes = ruleOutputReVariants.FindStringSubmatch(s)
 		if matchRes == nil {
-			return []string{}, fmt.Errorf("invalid rule output definition: %s", l)
+			return []string{}, nil, fmt.Errorf("invalid rule output definition: %s", l)
 		}
 		outputS = matchRes[1]
 	}
 	if strings.Contains(outputS, "->") {
-		return []string{}, fmt.Errorf("invalid rule output definition: %s", l)
+		return []string{}, nil, fmt.Errorf("invalid rule output definition: %s", l)
 	}
 	outputS = strings.Replace(outputS, emptyOutput, "", -1)
-	return commaSplit.Split(outputS, -1), nil
+	return splitRuleOutputWeights(commaSplit.Split(outputS, -1), l)
 }
 
 func newRule(s string, vars map[string]string) (Rule, usedVars, error) {
+	r, usedVars, _, err := newRuleWithPhonemeVars(s, vars, map[string][]string{}, false)
+	return r, usedVars, err
+}
+
+var rulePhonemeContextRe = regexp.MustCompile("^(.*[^ ]) +AFTER +(.+)$")
+
+// newRuleWithPhonemeVars creates a rule, with an optional phonological context (using the phoneme variables). The phonological context is a left context, or a right context for right-to-left rule application. It returns the rule, and the variables and phoneme variables used.
+func newRuleWithPhonemeVars(s string, vars map[string]string, phonemeVars map[string][]string, rightToLeft bool) (Rule, usedVars, usedVars, error) {
+	// INPUT -> OUTPUT AFTER PHONEMECONTEXT
+	// INPUT -> OUTPUT / LEFTCONTEXT _ RIGHTCONTEXT AFTER PHONEMECONTEXT
+	var phonemeContext = Context{}
+	usedPhonemeVars := usedVars{}
+	if matchRes := rulePhonemeContextRe.FindStringSubmatch(s); matchRes != nil {
+		var err error
+		phonemeContext, usedPhonemeVars, err = newPhonemeContext(strings.TrimSpace(matchRes[2]), !rightToLeft, phonemeVars)
+		if err != nil {
+			return Rule{}, usedVars{}, usedPhonemeVars, fmt.Errorf("invalid phonological context definition %s : %v", s, err)
+		}
+		s = matchRes[1]
+	}
+	r, usedVars, err := newRuleWithoutPhonemeContext(s, vars)
+	r.PhonemeContext = phonemeContext
+	return r, usedVars, usedPhonemeVars, err
+}
+
+func newRuleWithoutPhonemeContext(s string, vars map[string]string) (Rule, usedVars, error) {
 	usedVars := usedVars{}
 	// INPUT -> OUTPUT
 	// INPUT -> OUTPUT / LEFTCONTEXT _ RIGHTCONTEXT
@@ -495,10 +742,15 @@ func newRule(s string, vars map[string]string) (Rule, usedVars, error) {
 		return Rule{}, usedVars, fmt.Errorf("invalid rule definition: %s", s)
 	}
 	input := matchRes[1]
+	caseInsensitive := false
+	if strings.HasPrefix(input, caseInsensitivePrefix) && input != caseInsensitivePrefix {
+		caseInsensitive = true
+		input = strings.TrimPrefix(input, caseInsensitivePrefix)
+	}
 	if input == "\u00a0" { // nbsp
 		input = " "
 	}
-	output, err := newRuleOutput(matchRes[2], s)
+	output, weights, err := newRuleOutput(matchRes[2], s)
 	if err != nil {
 		return Rule{}, usedVars, err
 	}
@@ -506,5 +758,5 @@ func newRule(s string, vars map[string]string) (Rule, usedVars, error) {
 	if err != nil {
 		return Rule{}, usedVars, err
 	}
-	return Rule{Input: input, Output: output, LeftContext: left, RightContext: right}, usedVars, nil
+	return Rule{Input: input, Output: output, Weights: weights, LeftContext: left, RightContext: right, CaseInsensitive: caseInsensitive}, usedVars, nil
 }
@@ -1,10 +1,24 @@
 package rbg2p
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dlclark/regexp2"
 )
@@ -734,3 +748,2196 @@ func TestFailForUnusedVar(t *testing.T) {
 		t.Errorf("expected error: %s, found: %s", expectErr, err)
 	}
 }
+
+func TestApplyAligned(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	res, err := rs.ApplyAligned("hanna")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	expect := []AlignedChunk{
+		{Graphemes: "h", Phonemes: []string{}, LineNumber: 44},
+		{Graphemes: "a", Phonemes: []string{"a"}, LineNumber: 17},
+		{Graphemes: "nn", Phonemes: []string{"n"}, LineNumber: 15},
+		{Graphemes: "a", Phonemes: []string{"a"}, LineNumber: 17},
+	}
+	if len(res) != 1 {
+		t.Errorf("expected 1 variant, got %d", len(res))
+		return
+	}
+	if !reflect.DeepEqual(expect, res[0].Chunks) {
+		t.Errorf(fsExpGot, expect, res[0].Chunks)
+	}
+	if res[0].Transcription != "a n a" {
+		t.Errorf(fsExpGot, "a n a", res[0].Transcription)
+	}
+
+	res, err = rs.ApplyAligned("busktdusch")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	transes, _ := rs.Apply("busktdusch")
+	if len(res) != len(transes) {
+		t.Errorf("expected %d variants, got %d", len(transes), len(res))
+		return
+	}
+	for i, a := range res {
+		if a.Transcription != transes[i] {
+			t.Errorf(fsExpGot, transes[i], a.Transcription)
+		}
+		if strings.Join(a.Graphemes(), "") != "busktdusch" {
+			t.Errorf(fsExpGot, "busktdusch", strings.Join(a.Graphemes(), ""))
+		}
+	}
+}
+
+func TestApplyAlignedWithSyllabifier(t *testing.T) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	res, err := rs.ApplyAligned("banan")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	expect := []SyllableBoundary{{Chunk: 2, Phoneme: 0}}
+	if len(res) != 1 {
+		t.Errorf("expected 1 variant, got %d", len(res))
+		return
+	}
+	if !reflect.DeepEqual(expect, res[0].SyllableBoundaries) {
+		t.Errorf(fsExpGot, expect, res[0].SyllableBoundaries)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	trace, err := rs.Explain("пanan")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	if trace.Prefiltered != "panan" {
+		t.Errorf(fsExpGot, "panan", trace.Prefiltered)
+	}
+	if len(trace.Prefilters) != len(rs.Prefilters) {
+		t.Errorf(fsExpGot, len(rs.Prefilters), len(trace.Prefilters))
+	}
+	if len(trace.Positions) != 5 {
+		t.Errorf(fsExpGot, 5, len(trace.Positions))
+		return
+	}
+	for _, pos := range trace.Positions {
+		if pos.Applied == nil {
+			t.Errorf("expected a rule to be applied at position %d", pos.Index)
+			continue
+		}
+		last := pos.Attempts[len(pos.Attempts)-1]
+		if !last.Matched() || !last.Rule.equals(*pos.Applied) {
+			t.Errorf("expected last attempt to be the applied rule %s, got %s", *pos.Applied, last.Rule)
+		}
+		for _, a := range pos.Attempts[:len(pos.Attempts)-1] {
+			if a.Matched() {
+				t.Errorf("expected no match for attempted rule %s", a.Rule)
+			}
+		}
+	}
+	if len(trace.Variants) != 1 || len(trace.Variants[0].Filters) != len(rs.Filters) {
+		t.Errorf("expected one variant with %d filter steps, got %v", len(rs.Filters), trace.Variants)
+		return
+	}
+	transes, _ := rs.Apply("пanan")
+	if !reflect.DeepEqual(transes, trace.Result) {
+		t.Errorf(fsExpGot, transes, trace.Result)
+	}
+	if trace.Variants[0].Output != trace.Result[0] {
+		t.Errorf(fsExpGot, trace.Result[0], trace.Variants[0].Output)
+	}
+}
+
+var indexTestFiles = []string{
+	"test_data/test.g2p",
+	"test_data/test_specs.g2p",
+	"test_data/sws_test.g2p",
+	"test_data/ipa_test.g2p",
+	"test_data/sws_test_vertical_bar_nosyll.g2p",
+	"test_data/sws_test_vertical_bar_withsyll.g2p",
+}
+
+func TestRuleIndexIdenticalOutput(t *testing.T) {
+	for _, fName := range indexTestFiles {
+		rs, err := LoadFile(fName)
+		if err != nil {
+			t.Errorf("didn't expect error for input file %s : %s", fName, err)
+			continue
+		}
+		linear := rs
+		linear.ruleIndex = nil
+		for _, test := range rs.Tests {
+			for _, input := range []string{test.Input, test.Input + test.Input, "x" + test.Input} {
+				expect, expectErr := linear.Apply(input)
+				result, resultErr := rs.Apply(input)
+				if !reflect.DeepEqual(expect, result) {
+					t.Errorf("%s: "+fsExpGot, fName, expect, result)
+				}
+				if fmt.Sprintf("%v", expectErr) != fmt.Sprintf("%v", resultErr) {
+					t.Errorf("%s: "+fsExpGot, fName, expectErr, resultErr)
+				}
+			}
+		}
+	}
+}
+
+func TestRuleIndexInvalidated(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	if !rs.ruleIndex.validFor(rs.Rules, rs.RightToLeft) {
+		t.Errorf("expected valid rule index after load")
+	}
+	rs.Rules = append([]Rule{{Input: "hann", Output: []string{"H"}}}, rs.Rules...)
+	if rs.ruleIndex.validFor(rs.Rules, rs.RightToLeft) {
+		t.Errorf("expected invalid rule index after modifying rules")
+	}
+	res, _ := rs.Apply("hanna")
+	if !reflect.DeepEqual(res, []string{"H a"}) {
+		t.Errorf(fsExpGot, []string{"H a"}, res)
+	}
+
+	// rules edited in place
+	rs, err = LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	rs.Rules[0].Input, rs.Rules[0].Output = "hann", []string{"H"}
+	if rs.ruleIndex.validFor(rs.Rules, rs.RightToLeft) {
+		t.Errorf("expected invalid rule index after editing a rule input")
+	}
+	res, _ = rs.Apply("hanna")
+	if !reflect.DeepEqual(res, []string{"H a"}) {
+		t.Errorf(fsExpGot, []string{"H a"}, res)
+	}
+}
+
+func benchmarkApply(b *testing.B, indexed bool) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		b.Fatalf("didn't expect error for input file %s : %s", fName, err)
+	}
+	if !indexed {
+		rs.ruleIndex = nil
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, test := range rs.Tests {
+			_, _ = rs.Apply(test.Input)
+		}
+	}
+}
+
+func BenchmarkApplyIndexed(b *testing.B) {
+	benchmarkApply(b, true)
+}
+
+func BenchmarkApplyLinear(b *testing.B) {
+	benchmarkApply(b, false)
+}
+
+func benchmarkApplyParallel(b *testing.B, collectCoverage bool, rulesApplied bool) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		b.Fatalf("didn't expect error for input file %s : %s", fName, err)
+	}
+	rs.CollectCoverage = collectCoverage
+	if rulesApplied {
+		rs.RulesApplied = make(map[string]int)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, test := range rs.Tests {
+				_, _ = rs.Apply(test.Input)
+			}
+		}
+	})
+}
+
+func BenchmarkApplyParallel(b *testing.B) {
+	benchmarkApplyParallel(b, true, false)
+}
+
+func BenchmarkApplyParallelNoCoverage(b *testing.B) {
+	benchmarkApplyParallel(b, false, false)
+}
+
+// BenchmarkApplyParallelRulesApplied counts the rules applied using the deprecated (locked) RulesApplied map, as before the Coverage counters were introduced
+func BenchmarkApplyParallelRulesApplied(b *testing.B) {
+	benchmarkApplyParallel(b, true, true)
+}
+
+func TestApplyBatch(t *testing.T) {
+	fName := "test_data/sws_test.g2p"
+	seq, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	batch, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	inputs := []string{}
+	for i := 0; i < 20; i++ {
+		for _, test := range seq.Tests {
+			inputs = append(inputs, test.Input)
+		}
+	}
+	inputs = append(inputs, "hiß")
+
+	expect := []BatchResult{}
+	for _, s := range inputs {
+		transes, err := seq.Apply(s)
+		expect = append(expect, BatchResult{Input: s, Transes: transes, Err: err})
+	}
+
+	compare := func(result []BatchResult) {
+		if len(result) != len(expect) {
+			t.Errorf(fsExpGot, len(expect), len(result))
+			return
+		}
+		for i, e := range expect {
+			r := result[i]
+			if e.Input != r.Input || !reflect.DeepEqual(e.Transes, r.Transes) || fmt.Sprintf("%v", e.Err) != fmt.Sprintf("%v", r.Err) {
+				t.Errorf(fsExpGot, e, r)
+			}
+		}
+	}
+
+	compare(batch.ApplyBatch(inputs, 4))
+	if !reflect.DeepEqual(seq.Coverage(), batch.Coverage()) {
+		t.Errorf(fsExpGot, seq.Coverage(), batch.Coverage())
+	}
+
+	in := make(chan string)
+	go func() {
+		for _, s := range inputs {
+			in <- s
+		}
+		close(in)
+	}()
+	result := []BatchResult{}
+	for r := range batch.ApplyStream(context.Background(), in, 3) {
+		result = append(result, r)
+	}
+	compare(result)
+
+	// the number of inputs in progress is limited, and the stream is stopped when the context is cancelled
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	buffered := make(chan string, len(inputs))
+	for _, s := range inputs {
+		buffered <- s
+	}
+	close(buffered)
+	stream := batch.ApplyStream(ctx, buffered, 1)
+	if r := <-stream; r.Input != inputs[0] {
+		t.Errorf(fsExpGot, inputs[0], r.Input)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(inputs) - len(buffered); n > 3 {
+		t.Errorf("expected at most 3 inputs read, got %d", n)
+	}
+	cancel()
+	for range stream {
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected the stream goroutines to stop, got %d goroutines (%d before)", n, goroutines)
+	}
+}
+
+func TestMatchTimeout(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	rs.Prefilters = append(rs.Prefilters, Prefilter{Regexp: regexp2.MustCompile("(a+)+b", regexp2.None), Output: "b"})
+	rs.SetMatchTimeout(10 * time.Millisecond)
+	_, err = rs.Apply(strings.Repeat("a", 40) + "c")
+	var timeoutErr *RegexpTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Errorf("expected RegexpTimeoutError, got %v", err)
+	} else if timeoutErr.Timeout != 10*time.Millisecond {
+		t.Errorf(fsExpGot, 10*time.Millisecond, timeoutErr.Timeout)
+	}
+
+	// setting the timeout of a copy doesn't affect the original rule set
+	cp := rs
+	cp.SetMatchTimeout(time.Second)
+	if rs.MatchTimeout != 10*time.Millisecond {
+		t.Errorf(fsExpGot, 10*time.Millisecond, rs.MatchTimeout)
+	}
+	last := len(rs.Prefilters) - 1
+	if rs.Prefilters[last].Regexp == cp.Prefilters[last].Regexp {
+		t.Errorf("expected SetMatchTimeout to copy the regexps")
+	}
+	if got := rs.Prefilters[last].Regexp.MatchTimeout; got != 10*time.Millisecond {
+		t.Errorf(fsExpGot, 10*time.Millisecond, got)
+	}
+}
+
+func TestParseMatchTimeout(t *testing.T) {
+	rs := RuleSet{}
+	err := parseConst(`MATCH_TIMEOUT "250ms"`, &rs)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if rs.MatchTimeout != 250*time.Millisecond {
+		t.Errorf(fsExpGot, 250*time.Millisecond, rs.MatchTimeout)
+	}
+	err = parseConst(`MATCH_TIMEOUT "soon"`, &rs)
+	if err == nil {
+		t.Errorf("expected error here")
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	res, err := rs.ApplyContext(context.Background(), "hanna")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	} else if !reflect.DeepEqual(res, []string{"a n a"}) {
+		t.Errorf(fsExpGot, []string{"a n a"}, res)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rs.ApplyContext(ctx, "hanna")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf(fsExpGot, context.Canceled, err)
+	}
+}
+
+func TestApplyBounded(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	all, err := rs.Apply("busktdusch")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+
+	res, err := rs.ApplyBounded("busktdusch", 2)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if !res.Truncated {
+		t.Errorf("expected truncated result")
+	}
+	if !reflect.DeepEqual(all[0:2], res.Transes) {
+		t.Errorf(fsExpGot, all[0:2], res.Transes)
+	}
+
+	res, _ = rs.ApplyBounded("busktdusch", 4)
+	if res.Truncated {
+		t.Errorf("expected non-truncated result")
+	}
+	if !reflect.DeepEqual(all, res.Transes) {
+		t.Errorf(fsExpGot, all, res.Transes)
+	}
+
+	rs.MaxVariants = 3
+	limited, _ := rs.Apply("busktdusch")
+	if !reflect.DeepEqual(all[0:3], limited) {
+		t.Errorf(fsExpGot, all[0:3], limited)
+	}
+}
+
+func TestApplyDeduplicatesVariants(t *testing.T) {
+	fName := "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	rs.Filters = append(rs.Filters, Filter{Regexp: regexp2.MustCompile("k ", regexp2.None), Output: ""})
+	res, err := rs.Apply("busktdusch")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expect := []string{"b u0 s t d u0 S", "b u0 s t d u0 x"}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	// the variants left after the limit are filtered into outputs already kept, so nothing is dropped
+	bounded, err := rs.ApplyBounded("busktdusch", 2)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if expectBounded := (ApplyResult{Transes: expect}); !reflect.DeepEqual(expectBounded, bounded) {
+		t.Errorf(fsExpGot, expectBounded, bounded)
+	}
+	bounded, _ = rs.ApplyBounded("busktdusch", 1)
+	if expectBounded := (ApplyResult{Transes: expect[0:1], Truncated: true}); !reflect.DeepEqual(expectBounded, bounded) {
+		t.Errorf(fsExpGot, expectBounded, bounded)
+	}
+}
+
+func TestNewRuleWithWeights(t *testing.T) {
+	vars := map[string]string{}
+	validLines := map[string]Rule{
+		"skt -> (s t <0.7>, s k t <0.3>)": {Input: "skt",
+			Output:  []string{"s t", "s k t"},
+			Weights: []float64{0.7, 0.3}},
+		"skt -> (s t <2>, s k t)": {Input: "skt",
+			Output:  []string{"s t", "s k t"},
+			Weights: []float64{2, 1}},
+		"h -> (∅ <.5>, h)": {Input: "h",
+			Output:  []string{"", "h"},
+			Weights: []float64{0.5, 1}},
+	}
+	failLines := []string{
+		"skt -> (s t <x>, s k t)",
+		"skt -> (s t <-1>, s k t)",
+	}
+	for l, expect := range validLines {
+		result, _, err := newRule(l, vars)
+		if err != nil {
+			t.Errorf("didn't expect error for input rule line %s : %s", l, err)
+		} else if !expect.equals(result) {
+			t.Errorf(fsExpGot, expect, result)
+		}
+	}
+	for _, l := range failLines {
+		_, _, err := newRule(l, vars)
+		if err == nil {
+			t.Errorf("expected error for input rule line %s", l)
+		}
+	}
+}
+
+func TestApplyNBest(t *testing.T) {
+	rs, err := loadAndTest(t, "test_data/test_weights.g2p")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	res, err := rs.ApplyNBest("bungskt", 0)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	expect := []string{"b u N s t", "b u N s k t", "b u n g s t", "b u n g s k t"}
+	expectScores := []float64{0.63, 0.27, 0.07, 0.03}
+	if len(res) != len(expect) {
+		t.Errorf(fsExpGot, expect, res)
+		return
+	}
+	for i, r := range res {
+		if r.Trans != expect[i] {
+			t.Errorf(fsExpGot, expect[i], r.Trans)
+		}
+		if math.Abs(r.Score-expectScores[i]) > 1e-9 {
+			t.Errorf(fsExpGot, expectScores[i], r.Score)
+		}
+	}
+
+	res, _ = rs.ApplyNBest("bortskt", 2)
+	expect = []string{"b o r t s t", "b o rt s t"}
+	if len(res) != len(expect) {
+		t.Errorf(fsExpGot, expect, res)
+		return
+	}
+	for i, r := range res {
+		if r.Trans != expect[i] {
+			t.Errorf(fsExpGot, expect[i], r.Trans)
+		}
+	}
+}
+
+func TestNewTestPhrase(t *testing.T) {
+	validLines := map[string]Test{
+		`TEST "hit dusch" -> I t # d u0 S`:                 {Input: "hit dusch", Output: []string{"I t # d u0 S"}},
+		`TEST "hit dusch" -> (I t # d u0 S, I t # d u0 x)`: {Input: "hit dusch", Output: []string{"I t # d u0 S", "I t # d u0 x"}},
+		`TEST "anka" -> AnkA`:                              {Input: "anka", Output: []string{"AnkA"}},
+	}
+	failLines := []string{
+		`TEST hit dusch -> I t # d u0 S`,
+		`TEST "hit dusch -> I t # d u0 S`,
+	}
+	for l, expect := range validLines {
+		result, err := newTest(l)
+		if err != nil {
+			t.Errorf("didn't expect error for input test line %s : %s", l, err)
+		} else if !expect.equals(result) {
+			t.Errorf(fsExpGot, expect, result)
+		}
+	}
+	for _, l := range failLines {
+		_, err := newTest(l)
+		if err == nil {
+			t.Errorf("expected error for input test line %s", l)
+		}
+	}
+}
+
+func TestApplyPhrase(t *testing.T) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	tokens := rs.Tokenize("hej, banan-kaka  'n")
+	expectTokens := []string{"hej", "banan", "kaka", "'n"}
+	if !reflect.DeepEqual(expectTokens, tokens) {
+		t.Errorf(fsExpGot, expectTokens, tokens)
+	}
+
+	rs.WordBoundary = "|"
+	res, err := rs.ApplyPhrase("hej banan")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expect := []string{`h " e: j | b " a . n A: n`}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	_, err = rs.ApplyPhrase("hej ß")
+	if err == nil {
+		t.Errorf("expected error here")
+	}
+}
+
+func TestNewLexiconEntry(t *testing.T) {
+	validLines := map[string]LexiconEntry{
+		`LEXICON och -> O k`:               {Orth: "och", Transes: []string{"O k"}},
+		`LEXICON "bok" -> (b u0 k, b o k)`: {Orth: "bok", Transes: []string{"b u0 k", "b o k"}},
+	}
+	failLines := []string{
+		`LEXICON och`,
+		`LEXICON och -> `,
+		`LEXICON och -> (O k`,
+	}
+	for l, expect := range validLines {
+		result, err := newLexiconEntry(l)
+		if err != nil {
+			t.Errorf("didn't expect error for input lexicon line %s : %s", l, err)
+		} else if !reflect.DeepEqual(expect, result) {
+			t.Errorf(fsExpGot, expect, result)
+		}
+	}
+	for _, l := range failLines {
+		_, err := newLexiconEntry(l)
+		if err == nil {
+			t.Errorf("expected error for input lexicon line %s", l)
+		}
+	}
+}
+
+func TestLexicon(t *testing.T) {
+	fName := "test_data/test_lexicon.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	result := rs.Test()
+	if len(result.Errors) > 0 || len(result.FailedTests) > 0 {
+		t.Errorf("didn't expect errors or failed tests for input file %s : %v", fName, result)
+	}
+
+	res, err := rs.Apply("Tyst")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expect := []string{"t y s t", "S y s t"}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	entry := rs.Lexicon["dusch"]
+	if entry.Source != "test_data/test_lexicon.lex" || entry.LineNumber != 2 {
+		t.Errorf(fsExpGot, "test_data/test_lexicon.lex:2", fmt.Sprintf("%s:%d", entry.Source, entry.LineNumber))
+	}
+	if n := rs.Coverage().Lexicon[entry.Orth]; n != 1 {
+		t.Errorf(fsExpGot, 1, n)
+	}
+
+	trace, err := rs.Explain("och")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if trace.Lexicon == nil || len(trace.Positions) > 0 {
+		t.Errorf("expected lexicon entry and no rules in trace, got %v", trace)
+	}
+
+	aligned, err := rs.ApplyAligned("dusch")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expectAligned := []AlignedChunk{{Graphemes: "dusch", Phonemes: []string{"d", "u0", "S"}}}
+	if len(aligned) != 1 || !reflect.DeepEqual(expectAligned, aligned[0].Chunks) {
+		t.Errorf(fsExpGot, expectAligned, aligned)
+	}
+
+	rs.AddLexiconEntries([]LexiconEntry{{Orth: "Bat", Transes: []string{"b a t", "b x t"}}})
+	result = rs.Test()
+	expectErr := "invalid symbol in lexicon entry LEXICON bat -> (b a t, b x t): x"
+	if !reflect.DeepEqual([]string{expectErr}, result.Errors) {
+		t.Errorf(fsExpGot, []string{expectErr}, result.Errors)
+	}
+}
+
+func TestReadLexicon(t *testing.T) {
+	_, err := readLexicon(strings.NewReader("och O k\n"), "test")
+	if err == nil {
+		t.Errorf("expected error for lexicon line without tab")
+	}
+	res, err := readLexicon(strings.NewReader("\n// comment\nbok\tb u0 k\tb o k\n"), "test")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expect := []LexiconEntry{{Orth: "bok", Transes: []string{"b u0 k", "b o k"}, Source: "test", LineNumber: 3}}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+}
+
+func TestNewPhonemeRule(t *testing.T) {
+	vars := map[string][]string{"VOWEL": {"a", "e"}, "CONS": {"p", "t"}}
+	validLines := map[string]string{
+		`PHONEME_RULE n -> m / _ p`:                    `PHONEME_RULE n -> m /  _ p`,
+		`PHONEME_RULE t s -> s`:                        `PHONEME_RULE t s -> s /  _ `,
+		`PHONEME_RULE e -> ∅ / VOWEL _ #`:              `PHONEME_RULE e -> ∅ / VOWEL _ #`,
+		`SYLL_PHONEME_RULE ∅ -> " / # CONS* _ VOWEL`:   `SYLL_PHONEME_RULE ∅ -> " / # CONS* _ VOWEL`,
+		`SYLL_PHONEME_RULE VOWEL -> "" VOWEL / # _ . `: `SYLL_PHONEME_RULE VOWEL -> "" VOWEL / # _ .`,
+	}
+	failLines := []string{
+		`PHONEME_RULE n -> (m, n)`,
+		`PHONEME_RULE n -> m / p`,
+		`PHONEME_RULE n -> m / _ p _`,
+		`PHONEME_RULE ∅ -> ∅`,
+	}
+	for l, expect := range validLines {
+		result, _, err := newPhonemeRule(l, vars)
+		if err != nil {
+			t.Errorf("didn't expect error for input phoneme rule line %s : %s", l, err)
+		} else if result.String() != expect {
+			t.Errorf(fsExpGot, expect, result)
+		}
+	}
+	for _, l := range failLines {
+		_, _, err := newPhonemeRule(l, vars)
+		if err == nil {
+			t.Errorf("expected error for input phoneme rule line %s", l)
+		}
+	}
+}
+
+func TestPhonemeRules(t *testing.T) {
+	for _, fName := range []string{"test_data/test_phoneme_rules.g2p", "test_data/sws_test_phoneme_rules.g2p"} {
+		_, err := loadAndTest(t, fName)
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	fName := "test_data/test_phoneme_rules.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+
+	// the rewritten phonemes are kept in the chunk of the input phoneme
+	aligned, err := rs.ApplyAligned("akka")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	expect := []string{"k", "@", "k"}
+	if got := aligned[0].Chunks[1].Phonemes; !reflect.DeepEqual([]string{"k"}, got) {
+		t.Errorf(fsExpGot, []string{"k"}, got)
+	}
+	if got := append(aligned[0].Chunks[1].Phonemes, aligned[0].Chunks[2].Phonemes...); !reflect.DeepEqual(expect, got) {
+		t.Errorf(fsExpGot, expect, got)
+	}
+
+	trace, err := rs.Explain("anpa")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expectStep := FilterStep{Filter: "PHONEME_RULE n -> m /  _ LABIAL", Before: "n", After: "m"}
+	if len(trace.Variants) != 1 || !reflect.DeepEqual([]FilterStep{expectStep}, trace.Variants[0].PhonemeRules) {
+		t.Errorf(fsExpGot, expectStep, trace.Variants)
+	}
+
+	rs.PhonemeRules = append(rs.PhonemeRules, PhonemeRule{Input: []string{"x"}, Output: []string{"y"}, input: []map[string]bool{{"x": true}}})
+	result := rs.Test()
+	expectErrs := []string{"invalid symbol in phoneme rule PHONEME_RULE x -> y /  _ : x", "invalid symbol in phoneme rule PHONEME_RULE x -> y /  _ : y"}
+	if !reflect.DeepEqual(expectErrs, result.Errors) {
+		t.Errorf(fsExpGot, expectErrs, result.Errors)
+	}
+}
+
+func TestNewRuleWithPhonemeContext(t *testing.T) {
+	phonemeVars := map[string][]string{"VOICELESS": {"p", "t", "k", "s"}}
+	r, _, used, err := newRuleWithPhonemeVars("d -> t / _ # AFTER VOICELESS", map[string]string{}, phonemeVars, false)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	expect := "d -> t /  _ # AFTER VOICELESS"
+	if r.String() != expect {
+		t.Errorf(fsExpGot, expect, r.String())
+	}
+	if used["VOICELESS"] != 1 {
+		t.Errorf(fsExpGot, 1, used["VOICELESS"])
+	}
+	for _, phns := range [][]string{{"a", "s"}, {"s"}} {
+		if ok, _ := r.PhonemeContext.Matches(encodePhonemeTokens(phns)); !ok {
+			t.Errorf("expected phonological context to match %v", phns)
+		}
+	}
+	for _, phns := range [][]string{{"s", "a"}, {}} {
+		if ok, _ := r.PhonemeContext.Matches(encodePhonemeTokens(phns)); ok {
+			t.Errorf("expected phonological context not to match %v", phns)
+		}
+	}
+}
+
+func TestPhonemeContext(t *testing.T) {
+	fName := "test_data/test_phoneme_context.g2p"
+	rs, err := loadAndTest(t, fName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	res, err := rs.ApplyNBest("axd", 0)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expect := []ScoredTrans{{Trans: "a g z d", Score: 0.7}, {Trans: "a k s t", Score: 0.3}}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	bounded, err := rs.ApplyBounded("axd", 1)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expectBounded := ApplyResult{Transes: []string{"a k s t"}, Truncated: true}
+	if !reflect.DeepEqual(expectBounded, bounded) {
+		t.Errorf(fsExpGot, expectBounded, bounded)
+	}
+
+	trace, err := rs.Explain("pd")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	last := trace.Positions[len(trace.Positions)-1]
+	if last.Applied == nil || last.Applied.String() != "d -> t /  _  AFTER VOICELESS" {
+		t.Errorf(fsExpGot, "d -> t /  _  AFTER VOICELESS", last.Applied)
+	}
+}
+
+func TestRightToLeft(t *testing.T) {
+	fName := "test_data/test_rtl.g2p"
+	rs, err := loadAndTest(t, fName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !rs.RightToLeft {
+		t.Errorf("expected right-to-left rule set for input file %s", fName)
+	}
+
+	// same rules, applied left to right (the index is rebuilt for the new direction)
+	ltr := rs
+	ltr.RightToLeft = false
+	for _, index := range []bool{false, true} {
+		if index {
+			ltr.IndexRules()
+		}
+		res, err := ltr.Apply("aaa")
+		if err != nil {
+			t.Errorf("didn't expect error here : %v", err)
+		}
+		expect := []string{"A a"}
+		if !reflect.DeepEqual(expect, res) {
+			t.Errorf(fsExpGot, expect, res)
+		}
+		// the phonological context is a left context for left-to-right rule application
+		for input, expect := range map[string]string{"sad": "s a d", "tda": "t t a"} {
+			res, err := ltr.Apply(input)
+			if err != nil {
+				t.Errorf("didn't expect error here : %v", err)
+			}
+			if !reflect.DeepEqual([]string{expect}, res) {
+				t.Errorf(fsExpGot, expect, res)
+			}
+		}
+	}
+
+	res, err := rs.Apply("axa")
+	if err == nil {
+		t.Errorf("expected error here")
+	}
+	expect := []string{"a _ a"}
+	if !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	trace, err := rs.Explain("adt")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	expectIndices := []int{3, 2, 1}
+	indices := []int{}
+	for _, pos := range trace.Positions {
+		indices = append(indices, pos.Index)
+	}
+	if !trace.RightToLeft || !reflect.DeepEqual(expectIndices, indices) {
+		t.Errorf(fsExpGot, expectIndices, indices)
+	}
+	if applied := trace.Positions[1].Applied; applied == nil || applied.Input != "d" || applied.Output[0] != "t" {
+		t.Errorf(fsExpGot, "d -> t", applied)
+	}
+
+	if err := parseConst("DIRECTION \"up\"", &RuleSet{}); err == nil {
+		t.Errorf("expected error for invalid direction")
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	fName := "test_data/test_normalization.g2p"
+	rs, err := loadAndTest(t, fName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if rs.Normalization != "NFC" {
+		t.Errorf(fsExpGot, "NFC", rs.Normalization)
+	}
+
+	// decomposed input, precomposed rules
+	for input, expect := range map[string]string{
+		"cafe\u0301": "t a f E",
+		"re\u0301el": "r e e l",
+		"CAFE\u0301": "t a f E",
+		"be\u0301bé": "b E b E",
+	} {
+		res, err := rs.Apply(input)
+		if err != nil {
+			t.Errorf("didn't expect error here : %v", err)
+		}
+		if !reflect.DeepEqual([]string{expect}, res) {
+			t.Errorf(fsExpGot, expect, res)
+		}
+	}
+
+	// without normalization, the decomposed input doesn't match the precomposed rule
+	noNorm := rs
+	noNorm.Normalization = ""
+	if _, err := noNorm.Apply("cafe\u0301"); err == nil {
+		t.Errorf("expected error here")
+	}
+
+	// decomposed rule file, normalized to NFC at load time
+	content := strings.Join([]string{
+		"CHARACTER_SET \"acee\u0301\"",
+		"NORMALIZATION \"NFC\"",
+		"e\u0301 -> E",
+		"a -> a",
+		"c -> k",
+		"e -> e",
+		"FILTER \"a E\" -> \"a e\"",
+		"TEST caé -> k a e",
+		"TEST cae\u0301 -> k a e",
+	}, "\n")
+	rs, err = load(bufio.NewScanner(strings.NewReader(content)), "")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	result := rs.Test()
+	if len(result.Errors) > 0 || len(result.FailedTests) > 0 {
+		t.Errorf("didn't expect errors or failed tests here : %v %v", result.Errors, result.FailedTests)
+	}
+	if !Contains(rs.CharacterSet, "é") {
+		t.Errorf("expected normalized character set, got %v", rs.CharacterSet)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "mixes Unicode normal forms") {
+		t.Errorf("expected mixed normal forms warning, got %v", result.Warnings)
+	}
+
+	if _, err := load(bufio.NewScanner(strings.NewReader("NORMALIZATION \"NFX\"")), ""); err == nil {
+		t.Errorf("expected error for invalid normalization")
+	}
+}
+
+func TestGraphemes(t *testing.T) {
+	fName := "test_data/test_graphemes.g2p"
+	rs, err := loadAndTest(t, fName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	expectChars := []string{"a", "b", "e\u0301", "कि", "क", "ख"}
+	if !reflect.DeepEqual(expectChars, rs.CharacterSet) {
+		t.Errorf(fsExpGot, expectChars, rs.CharacterSet)
+	}
+
+	// one default phoneme per unmapped grapheme cluster
+	for _, rtl := range []bool{false, true} {
+		rs.RightToLeft = rtl
+		rs.IndexRules()
+		for input, expect := range map[string]string{
+			"bo\u0308a":          "b _ a",
+			"\u0917\u093f\u0915": "_ k a",
+		} {
+			res, err := rs.Apply(input)
+			if err == nil {
+				t.Errorf("expected error here")
+			}
+			if !reflect.DeepEqual([]string{expect}, res) {
+				t.Errorf(fsExpGot, expect, res)
+			}
+		}
+		_, err = rs.Apply("bo\u0308")
+		if expect := "found unmappable symbol(s) in input string: [o\u0308] in bo\u0308"; err == nil || err.Error() != expect {
+			t.Errorf(fsExpGot, expect, err)
+		}
+	}
+
+	// the clusters are looked up by start and end position, also if a rule has consumed part of a cluster
+	graphemes := newGraphemeIndex([]rune("bo\u0308\u0917\u093f"))
+	for _, test := range []struct {
+		i           int
+		rightToLeft bool
+		expect      string
+	}{
+		{0, false, "b"},
+		{1, false, "o\u0308"},
+		{2, false, "\u0308"},
+		{3, false, "\u0917\u093f"},
+		{5, true, "\u0917\u093f"},
+		{4, true, "\u0917"},
+		{3, true, "o\u0308"},
+		{1, true, "b"},
+	} {
+		if res := graphemes.at(test.i, test.rightToLeft); res != test.expect {
+			t.Errorf(fsExpGot, test.expect, res)
+		}
+	}
+
+	// the character set is checked per grapheme cluster
+	rs.CharacterSet = append(rs.CharacterSet, "o\u0308")
+	result := rs.Test()
+	expectErr := "no default rule for character(s): o\u0308"
+	if !Contains(result.Errors, expectErr) {
+		t.Errorf(fsExpGot, expectErr, result.Errors)
+	}
+}
+
+func TestCaseSensitiveRules(t *testing.T) {
+	fName := "test_data/test_case.g2p"
+	rs, err := loadAndTest(t, fName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if rs.Locale != "tr" || rs.DowncaseInput {
+		t.Errorf("expected case sensitive rule set with locale tr for input file %s", fName)
+	}
+	if !rs.Rules[3].CaseInsensitive || rs.Rules[3].Input != "a" || rs.Rules[3].String() != "(?i)a -> a /  _ " {
+		t.Errorf(fsExpGot, "(?i)a -> a /  _ ", rs.Rules[3])
+	}
+
+	// without the Turkish locale, I is matched by the rule for i
+	noLocale := rs
+	noLocale.Locale = ""
+	res, err := noLocale.Apply("IŞIK")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if expect := []string{"i S i k"}; !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+
+	// locale-aware downcasing
+	downcased := rs
+	downcased.DowncaseInput = true
+	for input, expect := range map[string]string{
+		"IŞIK": "1 S 1 k",
+		"İKİ":  "i k i",
+		"KM":   "k m",
+	} {
+		res, err := downcased.Apply(input)
+		if err != nil {
+			t.Errorf("didn't expect error here : %v", err)
+		}
+		if !reflect.DeepEqual([]string{expect}, res) {
+			t.Errorf(fsExpGot, expect, res)
+		}
+	}
+
+	// the casers are created when the locale is parsed, and shared by concurrent rule applications
+	if _, ok := casers.Load("tr"); !ok {
+		t.Errorf("expected cached casers for locale tr")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := downcased.Apply("IŞIK"); err != nil || !reflect.DeepEqual([]string{"1 S 1 k"}, res) {
+				t.Errorf(fsExpGot, "1 S 1 k", res)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// case-insensitive default rules cover the character in both cases, exact-case rules don't
+	rs.CharacterSet = append(rs.CharacterSet, "Ş", "Ö")
+	rs.Rules = append(rs.Rules, Rule{Input: "ö", Output: []string{"o"}})
+	result := rs.Test()
+	expectErrs := []string{"no default rule for character(s): Ö", "undefined character(s) used in rule set: ö"}
+	if !reflect.DeepEqual(expectErrs, result.Errors) {
+		t.Errorf(fsExpGot, expectErrs, result.Errors)
+	}
+
+	if err := parseConst("LOCALE \"not a locale\"", &RuleSet{}); err == nil {
+		t.Errorf("expected error for invalid locale")
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	fName := "test_data/test_specs_fail_var.g2p"
+	_, err := LoadFile(fName)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("expected ParseError, got %v", err)
+	} else if parseErr.File != fName || parseErr.Line != 30 || parseErr.Column != 1 {
+		t.Errorf(fsExpGot, fName+":30:1", fmt.Sprintf("%s:%d:%d", parseErr.File, parseErr.Line, parseErr.Column))
+	}
+
+	content := strings.Join([]string{
+		"CHARACTER_SET \"ab\"",
+		"a -> a",
+		"  b -> b / _ (",
+	}, "\n")
+	_, err = load(bufio.NewScanner(strings.NewReader(content)), "test.g2p")
+	if !errors.As(err, &parseErr) {
+		t.Errorf("expected ParseError, got %v", err)
+	} else if expect := "test.g2p:3:3: "; !strings.HasPrefix(err.Error(), expect) {
+		t.Errorf(fsExpGot, expect, err)
+	}
+
+	fName = "test_data/test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	for _, rtl := range []bool{false, true} {
+		rs.RightToLeft = rtl
+		rs.IndexRules()
+		_, err = rs.Apply("a3b4")
+		var unmappableErr *UnmappableSymbolError
+		if !errors.As(err, &unmappableErr) {
+			t.Errorf("expected UnmappableSymbolError, got %v", err)
+			continue
+		}
+		expect := []UnmappableSymbol{{Offset: 1, Symbol: "3"}, {Offset: 3, Symbol: "4"}}
+		if unmappableErr.Input != "a3b4" || !reflect.DeepEqual(expect, unmappableErr.Symbols) {
+			t.Errorf(fsExpGot, expect, unmappableErr.Symbols)
+		}
+	}
+	rs.RightToLeft = false
+	rs.IndexRules()
+
+	rs.Prefilters = append(rs.Prefilters, Prefilter{Regexp: regexp2.MustCompile("(a+)+b", regexp2.None), Output: "b", LineNumber: 99})
+	rs.SetMatchTimeout(10 * time.Millisecond)
+	_, err = rs.Apply(strings.Repeat("a", 40) + "c")
+	var regexpErr *RegexpError
+	var timeoutErr *RegexpTimeoutError
+	if !errors.As(err, &regexpErr) || !errors.As(err, &timeoutErr) {
+		t.Errorf("expected RegexpError with RegexpTimeoutError, got %v", err)
+	} else if regexpErr.Rule != `PREFILTER "(a+)+b" -> "b"` || regexpErr.LineNumber != 99 {
+		t.Errorf(fsExpGot, `PREFILTER "(a+)+b" -> "b" (line 99)`, regexpErr)
+	}
+
+	// errors for lines of the rule set content refer to the position in the rule file
+	lineNo := rs.Rules[0].LineNumber
+	rs.Prefilters[len(rs.Prefilters)-1].LineNumber = lineNo
+	_, err = rs.Apply(strings.Repeat("a", 40) + "c")
+	expectSource := SourceLine{File: fName, Line: lineNo}
+	if !errors.As(err, &regexpErr) || regexpErr.Source != expectSource {
+		t.Errorf(fsExpGot, expectSource, err)
+	} else if expect := fmt.Sprintf(", %s)", expectSource); !strings.HasSuffix(err.Error(), expect) {
+		t.Errorf(fsExpGot, expect, err)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	fName := "test_data/test_normalization.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	for _, s := range []string{"café", "réel"} {
+		if _, err := rs.Apply(s); err != nil {
+			t.Errorf("didn't expect error here : %v", err)
+		}
+	}
+	cov := rs.Coverage()
+	expectRules := map[int]int{15: 1, 16: 1, 18: 1, 20: 2, 21: 1, 23: 1, 25: 1}
+	if !reflect.DeepEqual(expectRules, cov.Rules) {
+		t.Errorf(fsExpGot, expectRules, cov.Rules)
+	}
+	if expect := map[int]int{11: 1}; !reflect.DeepEqual(expect, cov.Prefilters) {
+		t.Errorf(fsExpGot, expect, cov.Prefilters)
+	}
+	notApplied := []int{}
+	for _, r := range cov.RulesNotApplied(rs) {
+		notApplied = append(notApplied, r.LineNumber)
+	}
+	if expect := []int{17, 19, 22, 24, 26}; !reflect.DeepEqual(expect, notApplied) {
+		t.Errorf(fsExpGot, expect, notApplied)
+	}
+
+	// the snapshot is not affected by later rule applications
+	if _, err := rs.Apply("bal"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if cov.Rules[16] != 1 || rs.Coverage().Rules[16] != 2 {
+		t.Errorf(fsExpGot, "1 vs 2", fmt.Sprintf("%d vs %d", cov.Rules[16], rs.Coverage().Rules[16]))
+	}
+
+	// save, load and merge
+	covFile := filepath.Join(t.TempDir(), "coverage.json")
+	if err := cov.SaveFile(covFile); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	loaded, err := LoadCoverageFile(covFile)
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if !reflect.DeepEqual(cov, loaded) {
+		t.Errorf(fsExpGot, cov, loaded)
+	}
+	rs.ResetCoverage()
+	if n := len(rs.Coverage().Rules); n != 0 {
+		t.Errorf(fsExpGot, 0, n)
+	}
+	if _, err := rs.Apply("bal"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	merged := rs.Coverage()
+	merged.Merge(loaded)
+	if merged.Rules[16] != 2 || merged.Rules[17] != 1 || merged.Prefilters[11] != 1 {
+		t.Errorf("unexpected merged coverage : %v", merged)
+	}
+	if n := len(merged.RulesNotApplied(rs)); n != 4 {
+		t.Errorf(fsExpGot, 4, n)
+	}
+
+	// counts saved for another rule at the same line (e.g. for an earlier version of the rule file) are skipped
+	if def := loaded.Definitions.Rules[18]; def != rs.Rules[3].String() {
+		t.Errorf(fsExpGot, rs.Rules[3].String(), def)
+	}
+	loaded.Definitions.Rules[18] = "x -> y /  _ "
+	if n := len(loaded.RulesNotApplied(rs)); n != 6 {
+		t.Errorf(fsExpGot, 6, n)
+	}
+	merged = rs.Coverage()
+	merged.Merge(loaded)
+	if merged.Rules[16] != 2 || merged.Rules[18] != 0 || merged.Definitions.Rules[18] != rs.Rules[3].String() {
+		t.Errorf("unexpected merged coverage : %v", merged)
+	}
+
+	// merge into a partially initialized coverage
+	partial := Coverage{Rules: map[int]int{}}
+	partial.Merge(loaded)
+	if partial.Rules[16] != 1 || partial.Prefilters[11] != 1 || partial.Definitions.Rules[16] != rs.Rules[1].String() || partial.Lexicon == nil {
+		t.Errorf("unexpected merged coverage : %v", partial)
+	}
+}
+
+func TestRulesAppliedDeprecated(t *testing.T) {
+	fName := "test_data/test_normalization.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	if rs.RulesApplied != nil || rs.RulesAppliedMutex == nil {
+		t.Errorf("expected nil RulesApplied and non-nil RulesAppliedMutex")
+	}
+	rs.RulesApplied = make(map[string]int)
+	for _, s := range []string{"bal", "bal"} {
+		if _, err := rs.Apply(s); err != nil {
+			t.Errorf("didn't expect error here : %v", err)
+		}
+	}
+	rs.RulesAppliedMutex.RLock()
+	defer rs.RulesAppliedMutex.RUnlock()
+	if n := rs.RulesApplied[rs.Rules[2].String()]; n != 2 {
+		t.Errorf(fsExpGot, 2, n)
+	}
+	if n := rs.Coverage().Rules[rs.Rules[2].LineNumber]; n != 2 {
+		t.Errorf(fsExpGot, 2, n)
+	}
+
+	// a compiled transcriber has its own counts (and mutex)
+	before := fmt.Sprint(rs.RulesApplied)
+	tr, err := rs.Compile()
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	if _, err := tr.Apply("bal"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if after := fmt.Sprint(rs.RulesApplied); after != before {
+		t.Errorf(fsExpGot, before, after)
+	}
+	if tr.rs.RulesAppliedMutex == rs.RulesAppliedMutex {
+		t.Errorf("expected separate RulesAppliedMutex")
+	}
+	if n := tr.rs.RulesApplied[rs.Rules[2].String()]; n != 3 {
+		t.Errorf(fsExpGot, 3, n)
+	}
+}
+
+func TestCoverageOptOut(t *testing.T) {
+	fName := "test_data/test_normalization.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	if !rs.CollectCoverage {
+		t.Errorf("expected coverage collection to be switched on by default")
+	}
+
+	// per call: the copy shares the coverage counts, but doesn't count
+	noCov := rs
+	noCov.CollectCoverage = false
+	if _, err := noCov.Apply("bal"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if n := len(rs.Coverage().Rules); n != 0 {
+		t.Errorf(fsExpGot, 0, n)
+	}
+	if _, err := rs.Apply("bal"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if n := noCov.Coverage().Rules[16]; n != 1 {
+		t.Errorf(fsExpGot, 1, n)
+	}
+
+	// per rule set
+	rs.CollectCoverage = false
+	rs.ResetCoverage()
+	rs.ApplyBatch([]string{"bal", "caé"}, 2)
+	if cov := rs.Coverage(); len(cov.Rules) != 0 || len(cov.Prefilters) != 0 {
+		t.Errorf("expected empty coverage, got %v", cov)
+	}
+
+	// rules added after loading are counted too
+	rs.CollectCoverage = true
+	rs.Rules = append(rs.Rules, Rule{Input: "x", Output: []string{"k s"}, LineNumber: 99})
+	rs.IndexRules()
+	if _, err := rs.Apply("ax"); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if n := rs.Coverage().Rules[99]; n != 1 {
+		t.Errorf(fsExpGot, 1, n)
+	}
+}
+
+func TestTranscriber(t *testing.T) {
+	fName := "test_data/sws_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	if _, err := (RuleSet{}).Compile(); err == nil {
+		t.Errorf("expected error for uninitialized rule set")
+	}
+	tr, err := rs.Compile()
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	if result := tr.Test(); len(result.Errors) > 0 || len(result.FailedTests) > 0 {
+		t.Errorf("didn't expect errors or failed tests : %v %v", result.Errors, result.FailedTests)
+	}
+
+	// changes to the rule set don't affect the transcriber
+	test := rs.Tests[0]
+	for i := range rs.Rules {
+		rs.Rules[i].Output[0] = "X"
+	}
+	rs.SetMatchTimeout(time.Nanosecond)
+	for _, r := range tr.rs.Rules {
+		if r.LeftContext.IsDefined() && r.LeftContext.Regexp.MatchTimeout == time.Nanosecond {
+			t.Errorf("expected separate regexps for rule %v", r)
+		}
+	}
+	if res, err := tr.Apply(test.Input); err != nil || !reflect.DeepEqual(test.Output, res) {
+		t.Errorf(fsExpGot, test.Output, res)
+	}
+
+	// derived configurations
+	dashed := tr.WithPhonemeDelimiter("-")
+	expect := []string{}
+	for _, o := range test.Output {
+		expect = append(expect, strings.Join(strings.Fields(o), "-"))
+	}
+	if res, err := dashed.Apply(test.Input); err != nil || !reflect.DeepEqual(expect, res) {
+		t.Errorf(fsExpGot, expect, res)
+	}
+	if res, err := tr.Apply(test.Input); err != nil || !reflect.DeepEqual(test.Output, res) {
+		t.Errorf(fsExpGot, test.Output, res)
+	}
+	if res := dashed.ApplyBatch([]string{test.Input}, 1); !reflect.DeepEqual(expect, res[0].Transes) {
+		t.Errorf(fsExpGot, expect, res[0].Transes)
+	}
+	inputs := make(chan string, 1)
+	inputs <- test.Input
+	close(inputs)
+	for res := range dashed.ApplyStream(context.Background(), inputs, 1) {
+		if res.Err != nil || !reflect.DeepEqual(expect, res.Transes) {
+			t.Errorf(fsExpGot, expect, res.Transes)
+		}
+	}
+	if res, err := dashed.ApplyBounded(test.Input, 1); err != nil || !reflect.DeepEqual(expect[0:1], res.Transes) {
+		t.Errorf(fsExpGot, expect[0:1], res.Transes)
+	}
+	if res, err := dashed.ApplyAligned(test.Input); err != nil || len(res) != len(expect) || res[0].Transcription != expect[0] {
+		t.Errorf(fsExpGot, expect[0], res)
+	}
+	timed := tr.WithMatchTimeout(time.Second)
+	if timed.rs.MatchTimeout != time.Second || tr.rs.MatchTimeout == time.Second {
+		t.Errorf(fsExpGot, "1s vs "+tr.rs.MatchTimeout.String(), timed.rs.MatchTimeout.String()+" vs "+tr.rs.MatchTimeout.String())
+	}
+
+	// copies share the coverage counts, clones don't
+	tr.ResetCoverage()
+	clone := tr.Clone()
+	if _, err := dashed.Apply(test.Input); err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+	}
+	if n, n0 := len(tr.Coverage().Rules), len(clone.Coverage().Rules); n == 0 || n0 != 0 {
+		t.Errorf(fsExpGot, "n > 0, 0", fmt.Sprintf("%d, %d", n, n0))
+	}
+	if n := len(tr.WithCoverage(false).RuleSet().Coverage().Rules); n != 0 {
+		t.Errorf(fsExpGot, 0, n)
+	}
+
+	// concurrent use
+	done := make(chan bool)
+	for w := 0; w < 4; w++ {
+		go func() {
+			for _, test := range tr.rs.Tests {
+				apply := tr.Apply
+				if tr.rs.isPhrase(test.Input) {
+					apply = tr.ApplyPhrase
+				}
+				if res, err := apply(test.Input); err != nil || !reflect.DeepEqual(test.Output, res) {
+					t.Errorf(fsExpGot, test.Output, res)
+				}
+			}
+			done <- true
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		<-done
+	}
+}
+
+func TestTranscriberDelimiterError(t *testing.T) {
+	fName := "test_data/ipa_test.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	// an output symbol that isn't in the phoneme set can't be split when there is no phoneme delimiter
+	for i, r := range rs.Rules {
+		if r.Input == "a" {
+			rs.Rules[i].Output = []string{"§"}
+		}
+	}
+	tr, err := rs.Compile()
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	if res, err := tr.Apply("ab"); err != nil || !reflect.DeepEqual([]string{"§b"}, res) {
+		t.Errorf(fsExpGot, []string{"§b"}, res)
+	}
+	spaced := tr.WithPhonemeDelimiter(" ")
+	if res, err := spaced.Apply("bb"); err != nil || !reflect.DeepEqual([]string{"b b"}, res) {
+		t.Errorf(fsExpGot, []string{"b b"}, res)
+	}
+	if res, err := spaced.Apply("ab"); err == nil || len(res) != 0 {
+		t.Errorf("expected error and no transcriptions, got %v, %v", res, err)
+	}
+	if res := spaced.ApplyBatch([]string{"ab"}, 1); res[0].Err == nil || len(res[0].Transes) != 0 {
+		t.Errorf("expected error and no transcriptions, got %v", res[0])
+	}
+	if res, err := spaced.ApplyAligned("ab"); err == nil || len(res) != 0 {
+		t.Errorf("expected error and no transcriptions, got %v, %v", res, err)
+	}
+}
+
+func TestShadowedRules(t *testing.T) {
+	vars := map[string]string{"VOWEL": "[aeiou]"}
+	lines := []string{
+		"a -> a",
+		"a -> ? a / # _",          // shadowed by line 1
+		"b -> b / _ #",            //
+		"b -> p / _ #",            // shadowed by line 3
+		"b -> b / VOWEL _",        // not shadowed (line 3 has a right context)
+		"c -> k / VOWEL _",        //
+		"ch -> S / VOWEL _ VOWEL", // shadowed by line 6 (shorter input, no right context)
+		"d -> d / _ a",            //
+		"dd -> d",                 // not shadowed (line 8 has a right context)
+		"(?i)e -> e",              //
+		"E -> E",                  // shadowed by line 10 (case-insensitive input)
+	}
+	rs := RuleSet{}
+	for i, l := range lines {
+		r, _, err := newRule(l, vars)
+		if err != nil {
+			t.Errorf("didn't expect error for rule %s : %v", l, err)
+			return
+		}
+		r.LineNumber = i + 1
+		rs.Rules = append(rs.Rules, r)
+	}
+	expect := [][2]int{{2, 1}, {4, 3}, {7, 6}, {11, 10}}
+	result := [][2]int{}
+	for _, sr := range rs.ShadowedRules() {
+		result = append(result, [2]int{sr.Rule.LineNumber, sr.ShadowedBy.LineNumber})
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf(fsExpGot, expect, result)
+	}
+
+	// the built-in tests report shadowed rules as warnings
+	fName := "test_data/sws_test.g2p"
+	sws, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	expectWarning := "rule at test_data/sws_test.g2p:102 can never be applied, since it is shadowed by rule at test_data/sws_test.g2p:91: e -> @ /  _ # (shadowed by e -> e /  _ )"
+	if warnings := sws.Test().Warnings; !Contains(warnings, expectWarning) {
+		t.Errorf(fsExpGot, expectWarning, warnings)
+	}
+
+	// rules (and tests) from included files are reported at their position in the included file
+	content := strings.Join([]string{
+		`CHARACTER_SET "abdeikln"`,
+		`INCLUDE "test_data/include/default_rules.inc"`,
+		"a -> A / _ #",
+		"TEST a -> A",
+	}, "\n")
+	rs, err = load(bufio.NewScanner(strings.NewReader(content)), "test.g2p")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	testResult := rs.Test()
+	shadowedBy := ""
+	for _, sr := range rs.ShadowedRules() {
+		if sr.Rule.Input == "a" {
+			shadowedBy = sr.ShadowedBySource.String()
+		}
+	}
+	if expect := "test_data/include/default_rules.inc:3"; shadowedBy != expect {
+		t.Errorf(fsExpGot, expect, shadowedBy)
+	}
+	if expect := []string{"test at test.g2p:4: for 'a', expected /A/, got /a/"}; !reflect.DeepEqual(expect, testResult.FailedTests) {
+		t.Errorf(fsExpGot, expect, testResult.FailedTests)
+	}
+}
+
+func TestLint(t *testing.T) {
+	fName := "test_data/test_lint.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %s", fName, err)
+		return
+	}
+	type finding struct {
+		line     int
+		severity Severity
+		check    string
+	}
+	expect := []finding{
+		{7, SeverityWarning, LintVarOutsideCharSet},
+		{10, SeverityInfo, LintUnusedFilter},
+		{14, SeverityError, LintSyllDefPhonemeSet},
+		{16, SeverityError, LintSyllDefPhonemeSet},
+		{21, SeverityWarning, LintPrefilteredInput},
+		{22, SeverityWarning, LintUnmatchableContext},
+	}
+	result := []finding{}
+	for _, f := range rs.Lint() {
+		result = append(result, finding{f.LineNumber, f.Severity, f.Check})
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf(fsExpGot, expect, result)
+	}
+	if n := len(rs.Coverage().Rules); n != 0 {
+		t.Errorf("expected lint not to affect the coverage counts, got %d rules applied", n)
+	}
+
+	expectString := "line 7: warning: VAR VOWEL matches character(s) outside the character set: i o u [var-outside-character-set]"
+	if s := rs.Lint()[0].String(); s != expectString {
+		t.Errorf(fsExpGot, expectString, s)
+	}
+
+	for _, s := range []string{"info", "WARNING", "error"} {
+		if _, err := ParseSeverity(s); err != nil {
+			t.Errorf("didn't expect error for severity %s : %v", s, err)
+		}
+	}
+	if _, err := ParseSeverity("fatal"); err == nil {
+		t.Errorf("expected error for severity fatal")
+	}
+}
+
+// formatSignature returns a string representation of the parsed content of a rule set (excluding line numbers), used to compare rule sets before and after formatting
+func formatSignature(rs RuleSet) string {
+	res := []string{
+		fmt.Sprintf("%v", rs.CharacterSet),
+		fmt.Sprintf("%v", rs.PhonemeSet.Symbols),
+		fmt.Sprintf("%q %q %v %q %q %q %v %v %d %q", rs.PhonemeDelimiter, rs.DefaultPhoneme, rs.DowncaseInput, rs.WordBoundary, rs.Locale, rs.Normalization, rs.RightToLeft, rs.MatchTimeout, rs.MaxVariants, rs.Vars),
+		fmt.Sprintf("%v", rs.PhonemeVars),
+		fmt.Sprintf("%v", rs.Filters),
+		fmt.Sprintf("%v", rs.Prefilters),
+		fmt.Sprintf("%v", rs.Rules),
+		fmt.Sprintf("%v", rs.PhonemeRules),
+		fmt.Sprintf("%+v %v %v", rs.Syllabifier.SyllDef, rs.Syllabifier.StressPlacement, rs.Syllabifier.Tests),
+	}
+	for _, r := range rs.Rules {
+		if r.Label != "" {
+			res = append(res, fmt.Sprintf("LABEL %s %s", r.Label, r))
+		}
+	}
+	for _, test := range rs.Tests {
+		res = append(res, fmt.Sprintf("TEST %s %v", test.Input, test.Output))
+	}
+	lex := []string{}
+	for orth, e := range rs.Lexicon {
+		lex = append(lex, fmt.Sprintf("%s %v", orth, e.Transes))
+	}
+	sort.Strings(lex)
+	return strings.Join(append(res, lex...), "\n")
+}
+
+func TestFormat(t *testing.T) {
+	files, err := filepath.Glob("test_data/*.g2p")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	syllFiles, err := filepath.Glob("test_data/*.syll")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	for _, fName := range append(files, syllFiles...) {
+		formatted, err := FormatFile(fName)
+		if err != nil {
+			// files with syntax errors can't be formatted (nor loaded)
+			if _, loadErr := LoadFile(fName); loadErr == nil {
+				t.Errorf("didn't expect format error for input file %s : %v", fName, err)
+			}
+			continue
+		}
+		formatted2, err := Format(fName, formatted)
+		if err != nil {
+			t.Errorf("didn't expect error when formatting formatted file %s : %v", fName, err)
+			continue
+		}
+		if !bytes.Equal(formatted, formatted2) {
+			t.Errorf("expected formatting of %s to be idempotent, got:\n%s\n---\n%s", fName, formatted, formatted2)
+		}
+
+		if strings.HasSuffix(fName, ".syll") {
+			syll1, err := LoadSyllFile(fName)
+			if err != nil {
+				continue
+			}
+			syll2, err := loadSyll(bufio.NewScanner(bytes.NewReader(formatted)), fName)
+			if err != nil {
+				t.Errorf("didn't expect error for formatted file %s : %v", fName, err)
+				continue
+			}
+			if s1, s2 := formatSignature(RuleSet{Syllabifier: syll1}), formatSignature(RuleSet{Syllabifier: syll2}); s1 != s2 {
+				t.Errorf("expected formatted file %s to be equivalent to the original, got:\n%s\n---\n%s", fName, s1, s2)
+			}
+			continue
+		}
+		rs1, err := LoadFile(fName)
+		if err != nil {
+			continue
+		}
+		// loaded using the original file name, so that lexicon files are resolved in the same way
+		rs2, err := load(bufio.NewScanner(bytes.NewReader(formatted)), fName)
+		if err != nil {
+			t.Errorf("didn't expect error for formatted file %s : %v", fName, err)
+			continue
+		}
+		if s1, s2 := formatSignature(rs1), formatSignature(rs2); s1 != s2 {
+			t.Errorf("expected formatted file %s to be equivalent to the original, got:\n%s\n---\n%s", fName, s1, s2)
+		}
+	}
+
+	src := `// header
+
+CHARACTER_SET "ab"
+VAR V [a]
+a -> a
+// b rule
+bb -> b / V _
+b -> b // default
+TEST ab -> a b
+PHONEME_DELIMITER " "
+`
+	expect := `// header
+
+CHARACTER_SET "ab"
+PHONEME_DELIMITER " "
+
+VAR V [a]
+
+a  -> a
+// b rule
+bb -> b / V _
+b  -> b // default
+
+TEST ab -> a b
+`
+	result, err := Format("test", []byte(src))
+	if err != nil {
+		t.Errorf("didn't expect error : %v", err)
+	} else if string(result) != expect {
+		t.Errorf(fsExpGot, expect, string(result))
+	}
+	if _, err := Format("test", []byte("a -> \n")); err == nil {
+		t.Errorf("expected error for invalid rule")
+	}
+}
+
+func TestRuleSetJSON(t *testing.T) {
+	files, err := filepath.Glob("test_data/*.g2p")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	syllFiles, err := filepath.Glob("test_data/*.syll")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	for _, fName := range append(files, syllFiles...) {
+		isSyll := strings.HasSuffix(fName, ".syll")
+		var sig string
+		if isSyll {
+			syll, err := LoadSyllFile(fName)
+			if err != nil {
+				continue
+			}
+			sig = formatSignature(RuleSet{Syllabifier: syll})
+		} else {
+			rs, err := LoadFile(fName)
+			if err != nil {
+				continue
+			}
+			sig = formatSignature(rs)
+		}
+		src, err := os.ReadFile(fName)
+		if err != nil {
+			t.Fatalf("didn't expect error : %v", err)
+		}
+		jsonSrc, err := G2PToJSON(fName, src)
+		if err != nil {
+			t.Errorf("didn't expect error for input file %s : %v", fName, err)
+			continue
+		}
+
+		// the JSON representation loads to the same rule set
+		var sigJSON string
+		if isSyll {
+			syll, err := loadSyllJSON(fName, jsonSrc)
+			if err != nil {
+				t.Errorf("didn't expect error for JSON representation of %s : %v", fName, err)
+				continue
+			}
+			sigJSON = formatSignature(RuleSet{Syllabifier: syll})
+		} else {
+			rs, err := loadJSON(fName, jsonSrc)
+			if err != nil {
+				t.Errorf("didn't expect error for JSON representation of %s : %v", fName, err)
+				continue
+			}
+			sigJSON = formatSignature(rs)
+		}
+		if sig != sigJSON {
+			t.Errorf("expected JSON representation of %s to be equivalent to the original, got:\n%s\n---\n%s", fName, sig, sigJSON)
+		}
+
+		// and converting back and forth doesn't change the JSON representation
+		g2pSrc, err := JSONToG2P(fName, jsonSrc)
+		if err != nil {
+			t.Errorf("didn't expect error for JSON representation of %s : %v", fName, err)
+			continue
+		}
+		jsonSrc2, err := G2PToJSON(fName, g2pSrc)
+		if err != nil {
+			t.Errorf("didn't expect error for converted file %s : %v", fName, err)
+			continue
+		}
+		if !bytes.Equal(jsonSrc, jsonSrc2) {
+			t.Errorf("expected conversion of %s to be lossless, got:\n%s\n---\n%s", fName, jsonSrc, jsonSrc2)
+		}
+	}
+
+	fName := "test_data/test_rtl.json"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", fName, err)
+		return
+	}
+	if !rs.RightToLeft {
+		t.Errorf("expected right-to-left rule set for input file %s", fName)
+	}
+	if res := rs.Test(); res.Failed() {
+		t.Errorf("expected no errors or failed tests for input file %s, got %v", fName, res.AllErrors())
+	}
+
+	for _, test := range []struct {
+		src    string
+		expect string
+	}{
+		{`{"character_set": "ab", "rules": [{"input": "a", "output": ["a"], "left_context": "("}]}`, "test.json: rules[0]: "},
+		{`{"character_set": "ab", "rulez": []}`, "test.json: invalid JSON rule file: "},
+		{`{"character_set": "ab"} {}`, "test.json: invalid JSON rule file: "},
+	} {
+		_, err := loadJSON("test.json", []byte(test.src))
+		if err == nil {
+			t.Errorf("expected error for %s", test.src)
+		} else if !strings.HasPrefix(err.Error(), test.expect) {
+			t.Errorf(fsExpGot, test.expect, err.Error())
+		}
+	}
+}
+
+// TestJSONSchema checks that the properties of the JSON schema match the fields of the JSON representation
+func TestJSONSchema(t *testing.T) {
+	src, err := os.ReadFile("rbg2p.schema.json")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	type schemaObject struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	schema := struct {
+		schemaObject
+		Defs map[string]schemaObject `json:"$defs"`
+	}{}
+	if err := json.Unmarshal(src, &schema); err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	jsonFields := func(v interface{}) []string {
+		res := []string{}
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			res = append(res, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		sort.Strings(res)
+		return res
+	}
+	properties := func(o schemaObject) []string {
+		res := []string{}
+		for name := range o.Properties {
+			res = append(res, name)
+		}
+		sort.Strings(res)
+		return res
+	}
+	for name, v := range map[string]interface{}{
+		"":              RuleSetJSON{},
+		"var":           VarJSON{},
+		"phoneme_var":   PhonemeVarJSON{},
+		"filter":        FilterJSON{},
+		"sylldef":       SyllDefJSON{},
+		"rule":          RuleJSON{},
+		"phoneme_rule":  PhonemeRuleJSON{},
+		"lexicon_entry": LexiconJSON{},
+		"test":          TestJSON{},
+		"sylldef_test":  SyllTestJSON{},
+	} {
+		o := schema.schemaObject
+		if name != "" {
+			o = schema.Defs[name]
+		}
+		if expect, result := jsonFields(v), properties(o); !reflect.DeepEqual(expect, result) {
+			t.Errorf("schema definition %q: "+fsExpGot, name, expect, result)
+		}
+	}
+}
+
+func TestIncludeFromURL(t *testing.T) {
+	localFile, err := filepath.Abs("test_data/include/common.inc")
+	if err != nil {
+		t.Errorf("didn't expect error here : %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("test_data")))
+	for name, directive := range map[string]string{
+		"include_local.g2p": fmt.Sprintf("INCLUDE %q", localFile),
+		"lexicon_local.g2p": fmt.Sprintf("LEXICON_FILE %q", localFile),
+	} {
+		content := fmt.Sprintf("CHARACTER_SET \"ab\"\n%s\na -> a\nb -> b\n", directive)
+		mux.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, content)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// relative references are resolved against the URL
+	url := server.URL + "/include/dialect.g2p"
+	rs, err := LoadURL(url)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", url, err)
+	} else if expect, result := server.URL+"/include/default_rules.inc:3", rs.Source(rs.Rules[2].LineNumber).String(); result != expect {
+		t.Errorf(fsExpGot, expect, result)
+	}
+
+	// a file read from an URL can't refer to local files
+	for _, name := range []string{"include_local.g2p", "lexicon_local.g2p"} {
+		url := server.URL + "/" + name
+		_, err := LoadURL(url)
+		if err == nil || !strings.Contains(err.Error(), "can't refer to a local file") {
+			t.Errorf(fsExpGot, "can't refer to a local file", err)
+		}
+	}
+	if _, err := resolvePath(url, "file:///etc/hostname"); err == nil {
+		t.Errorf("expected error for file URL referenced from %s", url)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	fName := "test_data/include/dialect.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", fName, err)
+		return
+	}
+	if res := rs.Test(); res.Failed() {
+		t.Errorf("expected no errors or failed tests for input file %s, got %v", fName, res.AllErrors())
+	}
+	// the included VAR CONS is not used, but may be used by another file including it
+	if _, ok := rs.Vars["CONS"]; !ok {
+		t.Errorf("expected included VAR CONS to be defined")
+	}
+	// the dialect rules precede the included default rules
+	for i, expect := range []string{"test_data/include/dialect.g2p:5", "test_data/include/dialect.g2p:6", "test_data/include/default_rules.inc:3"} {
+		if result := rs.Source(rs.Rules[i].LineNumber).String(); result != expect {
+			t.Errorf(fsExpGot, expect, result)
+		}
+	}
+
+	fsRS, err := LoadFS(os.DirFS("test_data/include"), "dialect.g2p")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", fName, err)
+		return
+	}
+	if s1, s2 := formatSignature(rs), formatSignature(fsRS); s1 != s2 {
+		t.Errorf("expected rule set loaded from file system to be equivalent, got:\n%s\n---\n%s", s1, s2)
+	}
+	if expect, result := "default_rules.inc:3", fsRS.Source(fsRS.Rules[2].LineNumber).String(); result != expect {
+		t.Errorf(fsExpGot, expect, result)
+	}
+
+	for _, test := range []struct {
+		fName  string
+		expect string
+	}{
+		{"test_data/include/cycle.g2p", "test_data/include/cycle.inc:2:1: include cycle: test_data/include/cycle.g2p -> test_data/include/cycle.inc -> test_data/include/cycle.g2p"},
+		{"test_data/include/invalid.g2p", "test_data/include/invalid.inc:2:1: invalid rule output definition: b -> (b,"},
+	} {
+		_, err := LoadFile(test.fName)
+		if err == nil {
+			t.Errorf("expected error for input file %s", test.fName)
+		} else if err.Error() != test.expect {
+			t.Errorf(fsExpGot, test.expect, err.Error())
+		}
+	}
+
+	// unused variables in the including file are still reported
+	content := `INCLUDE "common.inc"
+VAR UNUSED [ab]
+a -> a`
+	_, err = load(bufio.NewScanner(strings.NewReader(content)), "test_data/include/test.g2p")
+	if expect := "test_data/include/test.g2p:2:1: unused variable(s) UNUSED in test_data/include/test.g2p"; err == nil || err.Error() != expect {
+		t.Errorf(fsExpGot, expect, err)
+	}
+
+	// definitions are not moved across INCLUDE directives
+	src := `a -> a
+INCLUDE "rules.inc"
+VAR V [a]
+b -> b / V _
+`
+	expect := `a -> a
+
+INCLUDE "rules.inc"
+
+VAR V [a]
+
+b -> b / V _
+`
+	result, err := Format("test", []byte(src))
+	if err != nil {
+		t.Errorf("didn't expect error : %v", err)
+	} else if string(result) != expect {
+		t.Errorf(fsExpGot, expect, string(result))
+	}
+
+	// INCLUDE directives following rules can't be represented in JSON
+	if _, err := ParseG2P("test", []byte(src)); err == nil {
+		t.Errorf("expected error for INCLUDE following rules")
+	}
+	doc, err := ParseG2P("test", []byte("INCLUDE \"common.inc\"\na -> a\n"))
+	if err != nil {
+		t.Errorf("didn't expect error : %v", err)
+	} else if !reflect.DeepEqual(doc.Includes, []string{"common.inc"}) {
+		t.Errorf(fsExpGot, []string{"common.inc"}, doc.Includes)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	fName := "test_data/overlay/north.g2p"
+	rs, err := LoadFile(fName)
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", fName, err)
+		return
+	}
+	if expect := "test_data/overlay/base.g2p"; rs.Base != expect {
+		t.Errorf(fsExpGot, expect, rs.Base)
+	}
+	if res := rs.Test(); res.Failed() {
+		t.Errorf("expected no errors or failed tests for input file %s, got %v", fName, res.AllErrors())
+	}
+	expect := []string{
+		"a test_data/overlay/base.g2p:7 false",
+		"b test_data/overlay/base.g2p:8 false",
+		"d test_data/overlay/base.g2p:9 false",
+		"e test_data/overlay/base.g2p:12 false",
+		"i test_data/overlay/base.g2p:13 false",
+		"k test_data/overlay/north.g2p:11 true",
+		"k test_data/overlay/base.g2p:14 false",
+		"l test_data/overlay/base.g2p:15 false",
+		"n test_data/overlay/base.g2p:16 false",
+		"o test_data/overlay/base.g2p:17 false",
+		"rr test_data/overlay/base.g2p:19 false",
+		"rn test_data/overlay/north.g2p:13 true",
+		"rt test_data/overlay/north.g2p:14 true",
+		"r test_data/overlay/base.g2p:20 false",
+		"s test_data/overlay/base.g2p:21 false",
+		"t test_data/overlay/base.g2p:22 false",
+		"u test_data/overlay/north.g2p:15 true",
+	}
+	result := []string{}
+	labels := []string{}
+	for _, r := range rs.Rules {
+		source := rs.Source(r.LineNumber)
+		result = append(result, fmt.Sprintf("%s %s %v", r.Input, source, source.Overlay))
+		if r.Label != "" {
+			labels = append(labels, r.Label)
+		}
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf(fsExpGot, expect, result)
+	}
+	if expect := []string{"rr", "rn"}; !reflect.DeepEqual(expect, labels) {
+		t.Errorf(fsExpGot, expect, labels)
+	}
+	if len(rs.Filters) != 1 || rs.Filters[0].Output != "k:" {
+		t.Errorf(fsExpGot, "FILTER \"k k\" -> \"k:\"", rs.Filters)
+	}
+	// overlay tests replace the base tests for the same input
+	if expect, result := 8, len(rs.Tests); result != expect {
+		t.Errorf(fsExpGot, expect, result)
+	}
+	// the coverage counts are keyed by line number in the derived rule set, so base and overlay rules are told apart using their source position
+	notApplied := []string{}
+	for _, r := range rs.Coverage().RulesNotApplied(rs) {
+		notApplied = append(notApplied, fmt.Sprintf("%s %s", r.Input, rs.Source(r.LineNumber)))
+	}
+	if expect := []string{"r test_data/overlay/base.g2p:20", "t test_data/overlay/base.g2p:22"}; !reflect.DeepEqual(expect, notApplied) {
+		t.Errorf(fsExpGot, expect, notApplied)
+	}
+
+	// an overlay on top of an overlay, referring to rules of its base by line number and label
+	fName = "test_data/overlay/coast.g2p"
+	coast, err := LoadFS(os.DirFS("test_data/overlay"), "coast.g2p")
+	if err != nil {
+		t.Errorf("didn't expect error for input file %s : %v", fName, err)
+		return
+	}
+	if res := coast.Test(); res.Failed() {
+		t.Errorf("expected no errors or failed tests for input file %s, got %v", fName, res.AllErrors())
+	}
+	if expect, result := 15, len(coast.Rules); result != expect {
+		t.Errorf(fsExpGot, expect, result)
+	}
+	for _, r := range coast.Rules {
+		if coast.Source(r.LineNumber).Overlay {
+			t.Errorf("expected no overlay rules in %s, got %v", fName, r)
+		}
+	}
+
+	for _, test := range []struct {
+		content string
+		expect  string
+	}{
+		{"BASE \"base.g2p\"\nDELETE nolabel", "test_data/overlay/test.g2p:2:1: undefined label nolabel in base rule set test_data/overlay/base.g2p"},
+		{"BASE \"base.g2p\"\nREPLACE 3 a -> b", "test_data/overlay/test.g2p:2:1: line 3 of base rule set test_data/overlay/base.g2p is not a rule"},
+		{"BASE \"base.g2p\"\nDELETE rr\nDELETE 19", "test_data/overlay/test.g2p:3:1: base rule 19 is already replaced or deleted"},
+		{"BASE \"base.g2p\"\nLABEL x\nDELETE rr", "test_data/overlay/test.g2p:2:1: LABEL x must be followed by an INSERT definition"},
+		{"BASE \"base.g2p\"\nb -> p", "test_data/overlay/test.g2p:2:1: invalid overlay definition (only BASE, INSERT, REPLACE, DELETE, LABEL, VAR, PHONEME_VAR, FILTER, PREFILTER and TEST are allowed): b -> p"},
+		{"BASE \"base.g2p\"\nINSERT AFTER rr a -> (b,", "test_data/overlay/test.g2p:2:1: invalid rule output definition: a -> (b,"},
+		{"BASE \"cycle.g2p\"", "test_data/overlay/cycle.g2p:1:1: base cycle: test_data/overlay/cycle.g2p -> test_data/overlay/cycle.g2p"},
+		{"CHARACTER_SET \"ab\"\na -> a\nDELETE 2", "test_data/overlay/test.g2p:3:1: overlay definition in a rule file without a BASE definition: DELETE 2"},
+		{"CHARACTER_SET \"ab\"\nLABEL x\nTEST a -> a", "test_data/overlay/test.g2p:2:1: LABEL x must be followed by a rule"},
+		{"BASE \"../include/dialect.g2p\"\nDELETE 8", "test_data/overlay/test.g2p:2:1: line 8 of base rule set test_data/include/dialect.g2p is not a rule defined in that file (rules read from files included by the base rule set, or from its base rule set, can only be referred to by label)"},
+		{"BASE \"../include/dialect.g2p\"\nDELETE 99", "test_data/overlay/test.g2p:2:1: no line 99 in base rule set test_data/include/dialect.g2p"},
+	} {
+		_, err := load(bufio.NewScanner(strings.NewReader(test.content)), "test_data/overlay/test.g2p")
+		if err == nil {
+			t.Errorf("expected error for input %q", test.content)
+		} else if err.Error() != test.expect {
+			t.Errorf(fsExpGot, test.expect, err.Error())
+		}
+	}
+
+	// failed tests and shadowed rules are reported with their origin
+	for _, test := range []struct {
+		content string
+		expect  []string
+	}{
+		{"BASE \"base.g2p\"\nTEST dansa -> d a n s @", []string{"overlay test at test_data/overlay/test.g2p:2: for 'dansa', expected /d a n s @/, got /d a n s a/"}},
+		{"BASE \"base.g2p\"\nDELETE rr", []string{"base test at test_data/overlay/base.g2p:27: for 'barr', expected /b a r/, got /b a r r/"}},
+		{"BASE \"base.g2p\"\nINSERT AFTER 12 ek -> E k", []string{"overlay rule at test_data/overlay/test.g2p:2 can never be applied, since it is shadowed by base rule at test_data/overlay/base.g2p:12: ek -> E k /  _  (shadowed by e -> e /  _ )"}},
+	} {
+		rs, err := load(bufio.NewScanner(strings.NewReader(test.content)), "test_data/overlay/test.g2p")
+		if err != nil {
+			t.Errorf("didn't expect error for input %q : %v", test.content, err)
+			continue
+		}
+		res := rs.Test()
+		if result := append(res.FailedTests, res.Warnings...); !reflect.DeepEqual(test.expect, result) {
+			t.Errorf(fsExpGot, test.expect, result)
+		}
+	}
+
+	// formatting keeps labels and overlay definitions in place
+	for _, fName := range []string{"test_data/overlay/base.g2p", "test_data/overlay/north.g2p"} {
+		src, err := os.ReadFile(fName)
+		if err != nil {
+			t.Fatalf("didn't expect error : %v", err)
+		}
+		formatted, err := Format(fName, src)
+		if err != nil {
+			t.Errorf("didn't expect error for input file %s : %v", fName, err)
+			continue
+		}
+		rs1, err1 := LoadFile(fName)
+		rs2, err2 := load(bufio.NewScanner(bytes.NewReader(formatted)), fName)
+		if err1 != nil || err2 != nil {
+			t.Errorf("didn't expect error for input file %s : %v, %v", fName, err1, err2)
+		} else if s1, s2 := formatSignature(rs1), formatSignature(rs2); s1 != s2 {
+			t.Errorf("expected formatted file %s to be equivalent to the original, got:\n%s\n---\n%s", fName, s1, s2)
+		}
+	}
+	expectFormatted := `BASE "base.g2p"
+
+DELETE final_e
+LABEL rn
+INSERT AFTER rr rn -> rn
+REPLACE 23 u       -> }:
+INSERT BEFORE 9 dd -> d
+`
+	formatted, err := Format("test", []byte("DELETE final_e\nLABEL   rn\nINSERT  AFTER rr rn  -> rn\nREPLACE 23 u -> }:\nINSERT BEFORE 9 dd -> d\nBASE \"base.g2p\"\n"))
+	if err != nil {
+		t.Errorf("didn't expect error : %v", err)
+	} else if string(formatted) != expectFormatted {
+		t.Errorf(fsExpGot, expectFormatted, string(formatted))
+	}
+
+	// labels are kept in the JSON representation, but overlay files can't be represented in JSON
+	src, err := os.ReadFile("test_data/overlay/base.g2p")
+	if err != nil {
+		t.Fatalf("didn't expect error : %v", err)
+	}
+	doc, err := ParseG2P("base.g2p", src)
+	if err != nil {
+		t.Errorf("didn't expect error : %v", err)
+	} else if expect, result := "final_e", doc.Rules[3].Label; result != expect {
+		t.Errorf(fsExpGot, expect, result)
+	}
+	if _, err := ParseG2P(fName, []byte("BASE \"base.g2p\"\nDELETE final_e\n")); err == nil {
+		t.Errorf("expected error for overlay file")
+	}
+}
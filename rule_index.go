@@ -0,0 +1,118 @@
+package rbg2p
+
+import (
+	"sort"
+)
+
+// ruleIndexNode is a node in the rule index trie
+type ruleIndexNode struct {
+	children map[rune]*ruleIndexNode
+	rules    []int // indices (in RuleSet.Rules) of the rules with input ending at this node
+}
+
+// ruleIndex is a prefix index (trie) of the rule inputs, used to look up the candidate rules for an input position without testing every rule in the rule set. For right-to-left rule application, the index is a suffix index (a trie of the reversed rule inputs).
+type ruleIndex struct {
+	root     *ruleIndexNode
+	reversed bool
+
+	// inputs holds the indexed input of each rule (with the case-insensitive prefix, for case-insensitive rules), used to check that the rules haven't been modified since the index was built
+	inputs []string
+}
+
+// indexedInput returns the input of a rule as indexed, i.e., with the case-insensitive prefix for case-insensitive rules (which are indexed differently)
+func indexedInput(rule Rule) string {
+	if rule.CaseInsensitive {
+		return caseInsensitivePrefix + rule.Input
+	}
+	return rule.Input
+}
+
+func newRuleIndex(rules []Rule, reversed bool) *ruleIndex {
+	idx := &ruleIndex{root: &ruleIndexNode{}, reversed: reversed, inputs: make([]string, len(rules))}
+	for ri, rule := range rules {
+		idx.inputs[ri] = indexedInput(rule)
+		node := idx.root
+		if rule.CaseInsensitive { // case-insensitive rules are tested at each input position
+			node.rules = append(node.rules, ri)
+			continue
+		}
+		input := []rune(rule.Input)
+		if reversed {
+			input = reverseRunes(input)
+		}
+		for _, r := range input {
+			if node.children == nil {
+				node.children = make(map[rune]*ruleIndexNode)
+			}
+			child, ok := node.children[r]
+			if !ok {
+				child = &ruleIndexNode{}
+				node.children[r] = child
+			}
+			node = child
+		}
+		node.rules = append(node.rules, ri)
+	}
+	return idx
+}
+
+// validFor checks that the index was built for the specified rules and direction. If rules have been added, removed, reordered, or had their inputs modified since the index was built, the index is no longer valid.
+func (idx *ruleIndex) validFor(rules []Rule, reversed bool) bool {
+	if idx == nil || len(idx.inputs) != len(rules) || idx.reversed != reversed {
+		return false
+	}
+	for i, rule := range rules {
+		if idx.inputs[i] != indexedInput(rule) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the indices of all rules with an input that is a prefix (or a suffix, for a reversed index) of the input string, in the original rule order
+func (idx *ruleIndex) candidates(s []rune) []int {
+	res := []int{}
+	node := idx.root
+	res = append(res, node.rules...)
+	for i := range s {
+		r := s[i]
+		if idx.reversed {
+			r = s[len(s)-1-i]
+		}
+		child, ok := node.children[r]
+		if !ok {
+			break
+		}
+		node = child
+		res = append(res, node.rules...)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// IndexRules builds a prefix index of the rule inputs (or a suffix index, for right-to-left rule application), so that only candidate rules are tested for each input position. The index is built automatically when a rule set is loaded from file or URL, and should be rebuilt if the rules or the application direction are modified. If the application direction is modified, the phonological contexts of the rules are recompiled for the new direction too. If the rules are modified after the index is built (e.g. if a rule is added, removed or has its input changed), the index is ignored, and all rules are tested at each input position.
+func (rs *RuleSet) IndexRules() {
+	// the contexts were compiled (from valid definitions) when the rule set was loaded, so this can't fail
+	_ = rs.anchorPhonemeContexts()
+	rs.ruleIndex = newRuleIndex(rs.Rules, rs.RightToLeft)
+}
+
+// candidateRules returns the indices of the rules to test for the input string s: the unprocessed input, starting at the current position (or ending at the current position, for right-to-left rule application). The indexed flag tells if the rule index is valid for the rules (see ruleIndex.validFor), which is checked once for each rule application.
+func (rs RuleSet) candidateRules(s []rune, indexed bool) []int {
+	if indexed {
+		return rs.ruleIndex.candidates(s)
+	}
+	res := make([]int, len(rs.Rules))
+	for i := range rs.Rules {
+		res[i] = i
+	}
+	return res
+}
+
+func reverseRunes(s []rune) []rune {
+	res := make([]rune, len(s))
+	for i, r := range s {
+		res[len(s)-1-i] = r
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package rbg2p
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShadowedRule is a rule that can never be applied, since an earlier rule always matches first
+type ShadowedRule struct {
+	Rule       Rule
+	ShadowedBy Rule
+
+	// Source and ShadowedBySource are the positions of the rules in the rule files they were read from (see RuleSet.Source)
+	Source           SourceLine
+	ShadowedBySource SourceLine
+
+	// overlay is true if the rule set is loaded from an overlay file (see SourceLine.describe)
+	overlay bool
+}
+
+// String returns a string representation of the ShadowedRule, with the positions of the rules in the rule files they were read from
+func (s ShadowedRule) String() string {
+	return fmt.Sprintf("%s can never be applied, since it is shadowed by %s: %s (shadowed by %s)", s.Source.describe("rule", s.overlay), s.ShadowedBySource.describe("rule", s.overlay), s.Rule, s.ShadowedBy)
+}
+
+// sameContext returns true if the contexts are identical (after variable expansion)
+func sameContext(c1, c2 Context) bool {
+	if !c1.IsDefined() || !c2.IsDefined() {
+		return c1.IsDefined() == c2.IsDefined()
+	}
+	return c1.Regexp.String() == c2.Regexp.String()
+}
+
+// subsumes returns true if context c1 matches whenever context c2 matches, i.e., if c1 is undefined, or if the contexts are identical
+func (c1 Context) subsumes(c2 Context) bool {
+	return !c1.IsDefined() || sameContext(c1, c2)
+}
+
+// inputShadows returns true if rule r1 matches the input whenever the input of rule r2 matches, i.e., if the input of r1 is the same as (or a prefix of) the input of r2 (a suffix, for right-to-left rule application)
+func (rs RuleSet) inputShadows(r1, r2 Rule) bool {
+	if r2.CaseInsensitive && !r1.CaseInsensitive {
+		return false
+	}
+	in1, in2 := r1.Input, r2.Input
+	if r1.CaseInsensitive {
+		in1, in2 = rs.downcase(in1), rs.downcase(in2)
+	}
+	if rs.RightToLeft {
+		return strings.HasSuffix(in2, in1)
+	}
+	return strings.HasPrefix(in2, in1)
+}
+
+// shadows returns true if rule r1 matches whenever rule r2 matches (at the same input position)
+func (rs RuleSet) shadows(r1, r2 Rule) bool {
+	if !rs.inputShadows(r1, r2) {
+		return false
+	}
+	if !r1.PhonemeContext.subsumes(r2.PhonemeContext) {
+		return false
+	}
+	if len([]rune(r1.Input)) == len([]rune(r2.Input)) {
+		return r1.LeftContext.subsumes(r2.LeftContext) && r1.RightContext.subsumes(r2.RightContext)
+	}
+	// r1 has a shorter input, so the context following its input (the right context, or the left context for right-to-left rule application) starts inside the input of r2
+	if rs.RightToLeft {
+		return !r1.LeftContext.IsDefined() && r1.RightContext.subsumes(r2.RightContext)
+	}
+	return !r1.RightContext.IsDefined() && r1.LeftContext.subsumes(r2.LeftContext)
+}
+
+// ShadowedRules returns the rules that can never be applied, since an earlier rule with the same or a shorter input always matches first (rules are tested in rule order, and the first matching rule is applied). The analysis is conservative: contexts are compared as written (after variable expansion), so a rule is only reported as shadowed if each context of the earlier rule is undefined or identical to the corresponding context of the later rule. For an earlier rule with a shorter input, the context following its input must be undefined.
+func (rs RuleSet) ShadowedRules() []ShadowedRule {
+	res := []ShadowedRule{}
+	for i, r := range rs.Rules {
+		for _, r0 := range rs.Rules[0:i] {
+			if rs.shadows(r0, r) {
+				res = append(res, ShadowedRule{Rule: r, ShadowedBy: r0, Source: rs.Source(r.LineNumber), ShadowedBySource: rs.Source(r0.LineNumber), overlay: rs.Base != ""})
+				break
+			}
+		}
+	}
+	return res
+}
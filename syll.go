@@ -193,7 +193,7 @@ func (s Syllabifier) syllabifyToString(t trans) string {
 	sylled := s.syllabify(t)
 	res := s.stringWithStressPlacement(sylled)
 	if s.Debug {
-		fmt.Fprintf(os.Stderr, "%s\t%s\t%v\t%s\n", "SYLLABIFY", t, sylled, res)
+		fmt.Fprintf(os.Stderr, "%s\t%v\t%v\t%s\n", "SYLLABIFY", t, sylled, res)
 	}
 	return res
 }
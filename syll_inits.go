@@ -3,6 +3,7 @@ package rbg2p
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net/http"
 	u "net/url"
 	"os"
@@ -12,7 +13,7 @@ import (
 	"strings"
 )
 
-// LoadSyllURL loads a syllabifier from an URL
+// LoadSyllURL loads a syllabifier from an URL. URLs with the extension .json are loaded as JSON rule files (see RuleSetJSON).
 func LoadSyllURL(url string) (Syllabifier, error) {
 	urlP, err := u.Parse(url)
 	if err != nil {
@@ -23,12 +24,26 @@ func LoadSyllURL(url string) (Syllabifier, error) {
 		return Syllabifier{}, err
 	}
 	defer resp.Body.Close()
+	if isJSONPath(urlP.Path) {
+		src, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return Syllabifier{}, err
+		}
+		return loadSyllJSON(url, src)
+	}
 	scanner := bufio.NewScanner(resp.Body)
 	return loadSyll(scanner, url)
 }
 
-// LoadSyllFile loads a syllabifier from the specified file
+// LoadSyllFile loads a syllabifier from the specified file. Files with the extension .json are loaded as JSON rule files (see RuleSetJSON).
 func LoadSyllFile(fName string) (Syllabifier, error) {
+	if isJSONPath(fName) {
+		src, err := os.ReadFile(filepath.Clean(fName))
+		if err != nil {
+			return Syllabifier{}, err
+		}
+		return loadSyllJSON(fName, src)
+	}
 	fh, err := os.Open(filepath.Clean(fName))
 	if err != nil {
 		return Syllabifier{}, err
@@ -39,25 +54,30 @@ func LoadSyllFile(fName string) (Syllabifier, error) {
 	return loadSyll(scanner, fName)
 }
 
-// LoadSyllFile loads a syllabifier from the specified file
 func loadSyll(scanner *bufio.Scanner, inputPath string) (Syllabifier, error) {
+	return loadSyllFrom(scanner, inputPath, openRelativePath)
+}
+
+// loadSyllFrom loads a syllabifier, using the opener to read included files
+func loadSyllFrom(scanner *bufio.Scanner, inputPath string, open pathOpener) (Syllabifier, error) {
 	var err error
 	syllDefLines := []string{}
 	res := Syllabifier{}
 	phonemeDelimiter := " "
-	n := 0
 	var phonemeSetLine string
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return res, err
-		}
-		n++
-		l := trimComment(strings.TrimSpace(scanner.Text()))
+	var phonemeSetSource SourceLine
+	lines, sources, err := readSource(scanner, inputPath, open, []string{sourceKey(inputPath)})
+	if err != nil {
+		return res, err
+	}
+	for i, line := range lines {
+		src := sources[i]
+		l := trimComment(strings.TrimSpace(line))
 		if isBlankLine(l) || isComment(l) {
 		} else if isSyllTest(l) {
 			t, err := newSyllTest(l)
 			if err != nil {
-				return res, err
+				return res, parseError(src.File, src.Line, line, err)
 			}
 			res.Tests = append(res.Tests, t)
 		} else if isSyllDefLine(l) {
@@ -65,29 +85,30 @@ func loadSyll(scanner *bufio.Scanner, inputPath string) (Syllabifier, error) {
 		} else if isPhonemeDelimiter(l) {
 			phonemeDelimiter, err = parsePhonemeDelimiter(l)
 			if err != nil {
-				return res, err
+				return res, parseError(src.File, src.Line, line, err)
 			}
 		} else if isPhonemeSet(l) {
 			phonemeSetLine = l
+			phonemeSetSource = src
 		} else if isG2PLine(l) {
 			// do nothing
 		} else {
-			return res, fmt.Errorf("unknown input line: %s", l)
+			return res, parseError(src.File, src.Line, line, fmt.Errorf("unknown input line: %s", l))
 		}
 
 	}
 	if len(phonemeSetLine) == 0 {
-		return res, fmt.Errorf("missing required phoneme set definition")
+		return res, &ParseError{File: inputPath, Err: fmt.Errorf("missing required phoneme set definition")}
 	}
 
 	syllDef, stressPlacement, err := loadSyllDef(syllDefLines, phonemeDelimiter)
 	if err != nil {
-		return res, err
+		return res, &ParseError{File: inputPath, Err: err}
 	}
 	res.SyllDef = syllDef
 	phnSet, err := parsePhonemeSet(phonemeSetLine, res.SyllDef, phonemeDelimiter)
 	if err != nil {
-		return res, err
+		return res, &ParseError{File: phonemeSetSource.File, Line: phonemeSetSource.Line, Column: 1, Err: err}
 	}
 	res.StressPlacement = stressPlacement
 	res.PhonemeSet = phnSet
@@ -161,7 +161,7 @@ func testSyllabify(t *testing.T, syller Syllabifier, input string, expect string
 	var fsExpGot = "Input: %s; Expected: %v got: %v"
 	inputT := trans{}
 	for _, p := range strings.Split(input, " ") {
-		inputT.phonemes = append(inputT.phonemes, g2p{"", []string{p}})
+		inputT.phonemes = append(inputT.phonemes, g2p{g: "", p: []string{p}})
 	}
 	resT := syller.syllabify(inputT)
 	res := resT.string(" ", ".")
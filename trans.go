@@ -17,8 +17,18 @@ type trans struct {
   rt -> ʈ
 */
 type g2p struct {
-	g string
-	p []string
+	g          string
+	p          []string
+	w          []float64 // variant weights, if any (in the same order as p)
+	lineNumber int // line number of the rule that produced the mapping (0 if no rule was applied, or for a lexicon entry)
+}
+
+// weight returns the weight of the variant output with index i (1.0 if no weights are defined)
+func (g g2p) weight(i int) float64 {
+	if i < len(g.w) {
+		return g.w[i]
+	}
+	return 1.0
 }
 
 //listPhonemes returns a slice of phonemes as strings
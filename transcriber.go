@@ -0,0 +1,289 @@
+package rbg2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlclark/regexp2"
+)
+
+// Transcriber is a compiled, immutable g2p rule set, created from a RuleSet using RuleSet.Compile. While the RuleSet is the editable description of the rules, the Transcriber doesn't share any editable state with the rule set it was compiled from (changing the rule set, or its match timeout, after compilation doesn't affect the Transcriber). A Transcriber is safe to share between goroutines, and to copy. Derived configurations, such as a different phoneme delimiter, are created using the With* methods.
+//
+// Copies of a Transcriber (including the ones created by the With* methods) share the coverage counts; use Clone to create a Transcriber with its own coverage counts.
+type Transcriber struct {
+	rs RuleSet
+
+	// phonemeDelimiter is the phoneme delimiter used in the output transcriptions (by default, the phoneme delimiter of the rule set)
+	phonemeDelimiter string
+}
+
+// Compile creates a Transcriber from the rule set. The rules, filters, lexicon, etc, are copied, so that later changes to the rule set don't affect the Transcriber. The Transcriber has its own coverage counts, collected if RuleSet.CollectCoverage is set.
+func (rs RuleSet) Compile() (Transcriber, error) {
+	if !rs.isInitialized() {
+		return Transcriber{}, fmt.Errorf("RuleSet is not initialized")
+	}
+	res := Transcriber{rs: rs.clone(), phonemeDelimiter: rs.PhonemeDelimiter}
+	res.rs.coverage = newCoverageCounter(res.rs)
+	return res, nil
+}
+
+// cloneRegexp returns a separate copy of a compiled regexp, with the same match timeout. All regexps in a rule set are compiled using regexp2.None.
+func cloneRegexp(re *regexp2.Regexp) *regexp2.Regexp {
+	if re == nil {
+		return nil
+	}
+	// the pattern has already been compiled once, so it is known to be valid
+	res := regexp2.MustCompile(re.String(), regexp2.None)
+	res.MatchTimeout = re.MatchTimeout
+	return res
+}
+
+func (c Context) clone() Context {
+	return Context{Input: c.Input, Regexp: cloneRegexp(c.Regexp)}
+}
+
+// clone returns a deep copy of the rule set (except the syllabifier and phoneme set, which are not modified after loading), with a rebuilt rule index. The coverage counts are shared with the input rule set. The deprecated RulesApplied counts are copied, with a separate mutex.
+func (rs RuleSet) clone() RuleSet {
+	res := rs
+	res.RulesAppliedMutex = &sync.RWMutex{}
+	if rs.RulesApplied != nil {
+		if rs.RulesAppliedMutex != nil {
+			rs.RulesAppliedMutex.RLock()
+			defer rs.RulesAppliedMutex.RUnlock()
+		}
+		res.RulesApplied = make(map[string]int, len(rs.RulesApplied))
+		for k, v := range rs.RulesApplied {
+			res.RulesApplied[k] = v
+		}
+	}
+	res.CharacterSet = append([]string{}, rs.CharacterSet...)
+	res.Vars = make(map[string]string, len(rs.Vars))
+	for k, v := range rs.Vars {
+		res.Vars[k] = v
+	}
+	res.PhonemeVars = make(map[string][]string, len(rs.PhonemeVars))
+	for k, v := range rs.PhonemeVars {
+		res.PhonemeVars[k] = append([]string{}, v...)
+	}
+	res.Rules = make([]Rule, 0, len(rs.Rules))
+	for _, r := range rs.Rules {
+		r.Output = append([]string{}, r.Output...)
+		if r.Weights != nil {
+			r.Weights = append([]float64{}, r.Weights...)
+		}
+		r.LeftContext = r.LeftContext.clone()
+		r.RightContext = r.RightContext.clone()
+		r.PhonemeContext = r.PhonemeContext.clone()
+		res.Rules = append(res.Rules, r)
+	}
+	res.PhonemeRules = make([]PhonemeRule, 0, len(rs.PhonemeRules))
+	for _, r := range rs.PhonemeRules {
+		r.Input = append([]string{}, r.Input...)
+		r.Output = append([]string{}, r.Output...)
+		r.LeftContext = r.LeftContext.clone()
+		r.RightContext = r.RightContext.clone()
+		res.PhonemeRules = append(res.PhonemeRules, r)
+	}
+	res.Filters = make([]Filter, 0, len(rs.Filters))
+	for _, f := range rs.Filters {
+		f.Regexp = cloneRegexp(f.Regexp)
+		res.Filters = append(res.Filters, f)
+	}
+	res.Prefilters = make([]Prefilter, 0, len(rs.Prefilters))
+	for _, pf := range rs.Prefilters {
+		pf.Regexp = cloneRegexp(pf.Regexp)
+		res.Prefilters = append(res.Prefilters, pf)
+	}
+	res.Tests = make([]Test, 0, len(rs.Tests))
+	for _, t := range rs.Tests {
+		t.Output = append([]string{}, t.Output...)
+		res.Tests = append(res.Tests, t)
+	}
+	if rs.Lexicon != nil {
+		res.Lexicon = make(map[string]LexiconEntry, len(rs.Lexicon))
+		for k, e := range rs.Lexicon {
+			e.Transes = append([]string{}, e.Transes...)
+			res.Lexicon[k] = e
+		}
+	}
+	res.IndexRules()
+	return res
+}
+
+// RuleSet returns an editable copy of the rule set the Transcriber was compiled from (with the settings of the Transcriber, except the output phoneme delimiter). The copy has its own coverage counts.
+func (t Transcriber) RuleSet() RuleSet {
+	res := t.rs.clone()
+	res.coverage = newCoverageCounter(res)
+	return res
+}
+
+// Clone returns a copy of the Transcriber with its own (empty) coverage counts
+func (t Transcriber) Clone() Transcriber {
+	res := t
+	res.rs.coverage = newCoverageCounter(res.rs)
+	return res
+}
+
+// WithPhonemeDelimiter returns a copy of the Transcriber using the specified phoneme delimiter in the output transcriptions. The rules (and the built-in tests) still use the phoneme delimiter of the rule set.
+func (t Transcriber) WithPhonemeDelimiter(delimiter string) Transcriber {
+	t.phonemeDelimiter = delimiter
+	return t
+}
+
+// WithMaxVariants returns a copy of the Transcriber returning at most maxVariants transcription variants (0 means no limit)
+func (t Transcriber) WithMaxVariants(maxVariants int) Transcriber {
+	t.rs.MaxVariants = maxVariants
+	return t
+}
+
+// WithCoverage returns a copy of the Transcriber that collects coverage counts (or not)
+func (t Transcriber) WithCoverage(collectCoverage bool) Transcriber {
+	t.rs.CollectCoverage = collectCoverage
+	return t
+}
+
+// WithMatchTimeout returns a copy of the Transcriber with the specified match timeout (see RuleSet.SetMatchTimeout). The regexps are copied, so the timeout of the input Transcriber is not affected.
+func (t Transcriber) WithMatchTimeout(timeout time.Duration) Transcriber {
+	t.rs.SetMatchTimeout(timeout)
+	return t
+}
+
+// PhonemeDelimiter returns the phoneme delimiter used in the output transcriptions
+func (t Transcriber) PhonemeDelimiter() string {
+	return t.phonemeDelimiter
+}
+
+// output converts a transcription from the phoneme delimiter of the rule set to the output phoneme delimiter
+func (t Transcriber) output(s string) (string, error) {
+	if t.phonemeDelimiter == t.rs.PhonemeDelimiter {
+		return s, nil
+	}
+	phns, err := t.rs.splitPhonemes(s)
+	if err != nil {
+		return s, fmt.Errorf("couldn't convert transcription %s to phoneme delimiter %q : %w", s, t.phonemeDelimiter, err)
+	}
+	return strings.Join(phns, t.phonemeDelimiter), nil
+}
+
+// outputs converts the transcriptions returned by the rule set (along with the error returned, if any) to the output phoneme delimiter. If a transcription can't be converted, no transcriptions are returned, and the conversion error is added to the error.
+func (t Transcriber) outputs(transes []string, err error) ([]string, error) {
+	if t.phonemeDelimiter == t.rs.PhonemeDelimiter {
+		return transes, err
+	}
+	res := make([]string, 0, len(transes))
+	for _, s := range transes {
+		o, oErr := t.output(s)
+		if oErr != nil {
+			return []string{}, errors.Join(err, oErr)
+		}
+		res = append(res, o)
+	}
+	return res, err
+}
+
+// Apply applies the rules to an input string, in the same way as RuleSet.Apply
+func (t Transcriber) Apply(s string) ([]string, error) {
+	return t.outputs(t.rs.Apply(s))
+}
+
+// ApplyContext applies the rules to an input string, in the same way as RuleSet.ApplyContext
+func (t Transcriber) ApplyContext(ctx context.Context, s string) ([]string, error) {
+	return t.outputs(t.rs.ApplyContext(ctx, s))
+}
+
+// ApplyPhrase transcribes an input phrase, in the same way as RuleSet.ApplyPhrase
+func (t Transcriber) ApplyPhrase(s string) ([]string, error) {
+	return t.outputs(t.rs.ApplyPhrase(s))
+}
+
+// ApplyBounded returns at most maxVariants transcription variants, in the same way as RuleSet.ApplyBounded
+func (t Transcriber) ApplyBounded(s string, maxVariants int) (ApplyResult, error) {
+	res, err := t.rs.ApplyBounded(s, maxVariants)
+	res.Transes, err = t.outputs(res.Transes, err)
+	return res, err
+}
+
+// ApplyAligned returns grapheme-phoneme aligned transcriptions, in the same way as RuleSet.ApplyAligned. The output phoneme delimiter is used in the transcription strings (the aligned chunks hold separate phonemes).
+func (t Transcriber) ApplyAligned(s string) ([]AlignedTrans, error) {
+	res, err := t.rs.ApplyAligned(s)
+	for i := range res {
+		o, oErr := t.output(res[i].Transcription)
+		if oErr != nil {
+			return []AlignedTrans{}, errors.Join(err, oErr)
+		}
+		res[i].Transcription = o
+	}
+	return res, err
+}
+
+// ApplyNBest returns the n best transcriptions, in the same way as RuleSet.ApplyNBest
+func (t Transcriber) ApplyNBest(s string, n int) ([]ScoredTrans, error) {
+	res, err := t.rs.ApplyNBest(s, n)
+	for i := range res {
+		o, oErr := t.output(res[i].Trans)
+		if oErr != nil {
+			return []ScoredTrans{}, errors.Join(err, oErr)
+		}
+		res[i].Trans = o
+	}
+	return res, err
+}
+
+// outputBatchResult converts the transcriptions of a batch result to the output phoneme delimiter (see outputs)
+func (t Transcriber) outputBatchResult(r BatchResult) BatchResult {
+	r.Transes, r.Err = t.outputs(r.Transes, r.Err)
+	return r
+}
+
+// ApplyBatch transcribes the input strings concurrently, in the same way as RuleSet.ApplyBatch
+func (t Transcriber) ApplyBatch(inputs []string, nWorkers int) []BatchResult {
+	res := t.rs.ApplyBatch(inputs, nWorkers)
+	for i := range res {
+		res[i] = t.outputBatchResult(res[i])
+	}
+	return res
+}
+
+// ApplyStream transcribes the input strings read from the input channel concurrently, in the same way as RuleSet.ApplyStream
+func (t Transcriber) ApplyStream(ctx context.Context, inputs <-chan string, nWorkers int) <-chan BatchResult {
+	results := t.rs.ApplyStream(ctx, inputs, nWorkers)
+	if t.phonemeDelimiter == t.rs.PhonemeDelimiter {
+		return results
+	}
+	res := make(chan BatchResult)
+	go func() {
+		defer close(res)
+		for r := range results {
+			select {
+			case res <- t.outputBatchResult(r):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// Explain returns a trace of the rule application, in the same way as RuleSet.Explain. The trace uses the phoneme delimiter of the rule set.
+func (t Transcriber) Explain(s string) (Trace, error) {
+	return t.rs.Explain(s)
+}
+
+// Test runs the built-in tests of the rule set (see RuleSet.Test)
+func (t Transcriber) Test() TestResult {
+	return t.rs.Test()
+}
+
+// Coverage returns a snapshot of the coverage counts of the Transcriber (see RuleSet.Coverage)
+func (t Transcriber) Coverage() Coverage {
+	return t.rs.Coverage()
+}
+
+// ResetCoverage clears the coverage counts of the Transcriber
+func (t Transcriber) ResetCoverage() {
+	t.rs.ResetCoverage()
+}
@@ -0,0 +1,164 @@
+package rbg2p
+
+import (
+	"strings"
+)
+
+// variantIterator generates the transcription variants for a sequence of grapheme-phoneme chunks lazily, one at a time, so that the full Cartesian product of the variant outputs is never built. The variants are generated in a deterministic order: the first chunk's outputs vary slowest, and the last chunk's outputs vary fastest.
+type variantIterator struct {
+	chunks   []g2p
+	phnDelim string
+	counters []int
+	done     bool
+}
+
+func newVariantIterator(chunks []g2p, phnDelim string) *variantIterator {
+	it := &variantIterator{chunks: chunks, phnDelim: phnDelim, counters: make([]int, len(chunks))}
+	if len(chunks) == 0 {
+		it.done = true
+	}
+	for _, c := range chunks {
+		if len(c.p) == 0 {
+			it.done = true
+		}
+	}
+	return it
+}
+
+// variantGenerator generates transcription variants one at a time
+type variantGenerator interface {
+	// next returns the next variant and its score, or false if there are no more variants
+	next() (trans, float64, bool)
+}
+
+// newVariantGenerator returns a generator for the variants of the input chunk sequences, in variant order, or ranked by score (best first)
+func newVariantGenerator(chunkSeqs [][]g2p, phnDelim string, ranked bool) variantGenerator {
+	gens := []variantGenerator{}
+	for _, chunks := range chunkSeqs {
+		if ranked {
+			gens = append(gens, newRankedVariantIterator(chunks, phnDelim))
+		} else {
+			gens = append(gens, newVariantIterator(chunks, phnDelim))
+		}
+	}
+	if len(gens) == 1 {
+		return gens[0]
+	}
+	if ranked {
+		return newMergedVariantGenerator(gens)
+	}
+	return &chainedVariantGenerator{gens: gens}
+}
+
+// chainedVariantGenerator generates the variants of each generator in turn
+type chainedVariantGenerator struct {
+	gens []variantGenerator
+}
+
+func (g *chainedVariantGenerator) next() (trans, float64, bool) {
+	for len(g.gens) > 0 {
+		if t, score, ok := g.gens[0].next(); ok {
+			return t, score, true
+		}
+		g.gens = g.gens[1:]
+	}
+	return trans{}, 0, false
+}
+
+// mergedVariantGenerator merges the variants of generators that are ranked by score, so that the variants are generated best first. Variants with the same score are generated in generator order.
+type mergedVariantGenerator struct {
+	gens   []variantGenerator
+	heads  []trans
+	scores []float64
+	ok     []bool
+}
+
+func newMergedVariantGenerator(gens []variantGenerator) *mergedVariantGenerator {
+	g := &mergedVariantGenerator{gens: gens, heads: make([]trans, len(gens)), scores: make([]float64, len(gens)), ok: make([]bool, len(gens))}
+	for i, gen := range gens {
+		g.heads[i], g.scores[i], g.ok[i] = gen.next()
+	}
+	return g
+}
+
+func (g *mergedVariantGenerator) next() (trans, float64, bool) {
+	best := -1
+	for i := range g.gens {
+		if g.ok[i] && (best < 0 || g.scores[i] > g.scores[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return trans{}, 0, false
+	}
+	t, score := g.heads[best], g.scores[best]
+	g.heads[best], g.scores[best], g.ok[best] = g.gens[best].next()
+	return t, score, true
+}
+
+// buildVariant creates the transcription variant for the selected output index of each chunk, along with its score (the product of the weights of the selected outputs)
+func buildVariant(chunks []g2p, selected []int, phnDelim string) (trans, float64) {
+	res := trans{}
+	score := 1.0
+	for i, c := range chunks {
+		res.phonemes = append(res.phonemes, g2p{g: c.g, p: strings.Split(c.p[selected[i]], phnDelim), lineNumber: c.lineNumber})
+		score *= c.weight(selected[i])
+	}
+	return res, score
+}
+
+func (it *variantIterator) next() (trans, float64, bool) {
+	if it.done {
+		return trans{}, 0, false
+	}
+	res, score := buildVariant(it.chunks, it.counters, it.phnDelim)
+	// increment counters, last chunk first
+	it.done = true
+	for i := len(it.counters) - 1; i >= 0; i-- {
+		it.counters[i]++
+		if it.counters[i] < len(it.chunks[i].p) {
+			it.done = false
+			break
+		}
+		it.counters[i] = 0
+	}
+	return res, score, true
+}
+
+// variant is an expanded transcription variant, along with its syllabification and its output string (after syllabification and filters)
+type variant struct {
+	trans  trans
+	sylled sylledTrans
+	output string
+	score  float64
+}
+
+// applyResult is the internal result of a rule application
+type applyResult struct {
+	variants  []variant
+	truncated bool
+}
+
+func (r applyResult) transes() []string {
+	var res []string
+	for _, v := range r.variants {
+		res = append(res, v.output)
+	}
+	return res
+}
+
+// ApplyResult is the result of a bounded rule application
+type ApplyResult struct {
+	Transes []string
+
+	// Truncated is true if the variant expansion was stopped at the maximum number of variants because a further distinct variant was found, i.e., there are more variants than the ones returned
+	Truncated bool
+}
+
+// ApplyBounded is like Apply, but returns at most maxVariants (distinct) transcription variants (if maxVariants < 1, there is no limit). The result tells whether the variant list was truncated.
+func (rs RuleSet) ApplyBounded(s string, maxVariants int) (ApplyResult, error) {
+	opts := rs.newApplyOpts()
+	opts.maxVariants = maxVariants
+	res, err := rs.apply(s, opts)
+	return ApplyResult{Transes: res.transes(), Truncated: res.truncated}, err
+}